@@ -0,0 +1,365 @@
+// Package config holds the settings of the service. They are loaded once at
+// startup from a YAML or TOML file, the environment and command line flags,
+// validated, and handed to whatever needs them.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aki-0517/go-user-management/util"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// minSecretLength is the minimum length of HMAC keys and session secrets,
+// i.e. 256 bits.
+const minSecretLength = 32
+
+// Every setting has a key in configuration files and, for scalars and
+// lists, an environment variable. Flags are named after the variable, e.g.
+// -db-host for DB_HOST.
+type Config struct {
+	// BaseURL is where users reach the service. Links in emails, redirect
+	// URIs and the WebAuthn origin are derived from it.
+	BaseURL string `config:"base_url" env:"APP_BASE_URL"`
+	// AppName is shown in authenticator apps and passkey prompts.
+	AppName string `config:"app_name" env:"APP_NAME"`
+	// AdminEmail bootstraps the first administrator; further admins can be
+	// appointed through the user_roles table.
+	AdminEmail string `config:"admin_email" env:"ADMIN_EMAIL"`
+	// RequireEmailVerification refuses logins until the email is verified.
+	RequireEmailVerification bool `config:"require_email_verification" env:"REQUIRE_EMAIL_VERIFICATION"`
+
+	Server    ServerConfig    `config:"server"`
+	Database  DatabaseConfig  `config:"database"`
+	Redis     RedisConfig     `config:"redis"`
+	Tokens    TokenConfig     `config:"tokens"`
+	Session   SessionConfig   `config:"session"`
+	SMTP      SMTPConfig      `config:"smtp"`
+	WebAuthn  WebAuthnConfig  `config:"webauthn"`
+	OIDC      OIDCConfig      `config:"oidc"`
+	RateLimit RateLimitConfig `config:"rate_limit"`
+	Login     LoginConfig     `config:"login"`
+	Password  PasswordConfig  `config:"password"`
+	CORS      CORSConfig      `config:"cors"`
+}
+
+type ServerConfig struct {
+	ListenAddr   string        `config:"listen_addr" env:"LISTEN_ADDR"`
+	ReadTimeout  time.Duration `config:"read_timeout" env:"SERVER_READ_TIMEOUT"`
+	WriteTimeout time.Duration `config:"write_timeout" env:"SERVER_WRITE_TIMEOUT"`
+	IdleTimeout  time.Duration `config:"idle_timeout" env:"SERVER_IDLE_TIMEOUT"`
+	// ShutdownTimeout is how long in-flight requests may take to finish
+	// once the server is asked to stop.
+	ShutdownTimeout time.Duration `config:"shutdown_timeout" env:"SERVER_SHUTDOWN_TIMEOUT"`
+	// StartupTimeout is how long Postgres and Redis are waited for at
+	// startup.
+	StartupTimeout time.Duration `config:"startup_timeout" env:"SERVER_STARTUP_TIMEOUT"`
+}
+
+type DatabaseConfig struct {
+	Host     string `config:"host" env:"DB_HOST"`
+	Port     string `config:"port" env:"DB_PORT"`
+	User     string `config:"user" env:"DB_USER"`
+	Password string `config:"password" env:"DB_PASSWORD"`
+	Name     string `config:"name" env:"DB_NAME"`
+	SSLMode  string `config:"sslmode" env:"DB_SSLMODE"`
+	// Migrate applies pending migrations on startup instead of refusing to
+	// serve from an out of date schema.
+	Migrate bool `config:"migrate" env:"DB_MIGRATE"`
+}
+
+// Validate reports whether the database can be connected to. Config.Validate
+// includes it.
+func (c DatabaseConfig) Validate() error {
+	if c.Host == "" || c.User == "" || c.Name == "" {
+		return errors.New("database host, user and name are required")
+	}
+	return nil
+}
+
+// DSN returns the connection string of the database.
+func (c DatabaseConfig) DSN() string {
+	u := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(c.User, c.Password),
+		Host:     c.Host + ":" + c.Port,
+		Path:     "/" + c.Name,
+		RawQuery: "sslmode=" + url.QueryEscape(c.SSLMode),
+	}
+	return u.String()
+}
+
+type RedisConfig struct {
+	Host     string `config:"host" env:"REDIS_HOST"`
+	Port     string `config:"port" env:"REDIS_PORT"`
+	Password string `config:"password" env:"REDIS_PASSWORD"`
+	DB       int    `config:"db" env:"REDIS_DB"`
+}
+
+func (c RedisConfig) Addr() string {
+	return c.Host + ":" + c.Port
+}
+
+type TokenConfig struct {
+	// Alg is the signing algorithm. HS256 signs with Key; the asymmetric
+	// algorithms read PrivateKeyFile or, if unset, generate a key that is
+	// shared between instances through Redis. With KeyRotationInterval set,
+	// new keys are generated and shared the same way.
+	Alg            string `config:"alg" env:"JWT_ALG"`
+	Key            string `config:"key" env:"JWT_KEY"`
+	PrivateKeyFile string `config:"private_key_file" env:"JWT_PRIVATE_KEY_FILE"`
+	// KeyEncryptionKey encrypts the keys shared through Redis. It is
+	// required whenever keys are generated, and has to be the same on every
+	// instance.
+	KeyEncryptionKey    string        `config:"key_encryption_key" env:"JWT_KEY_ENCRYPTION_KEY"`
+	KeyGracePeriod      time.Duration `config:"key_grace_period" env:"JWT_KEY_GRACE_PERIOD"`
+	KeyRotationInterval time.Duration `config:"key_rotation_interval" env:"JWT_KEY_ROTATION_INTERVAL"`
+	Issuer              string        `config:"issuer" env:"JWT_ISSUER"`
+	Audience            string        `config:"audience" env:"JWT_AUDIENCE"`
+	AccessTokenTTL      time.Duration `config:"access_token_ttl" env:"ACCESS_TOKEN_TTL"`
+	RefreshTokenTTL     time.Duration `config:"refresh_token_ttl" env:"REFRESH_TOKEN_TTL"`
+	// BlocklistFailOpen lets requests through when Redis cannot tell
+	// whether their token was revoked. By default they are refused.
+	BlocklistFailOpen bool `config:"blocklist_fail_open" env:"TOKEN_BLOCKLIST_FAIL_OPEN"`
+}
+
+// SharesKeys reports whether signing keys are generated and shared between
+// instances through Redis.
+func (c TokenConfig) SharesKeys() bool {
+	return c.Alg != util.AlgHS256 && (c.PrivateKeyFile == "" || c.KeyRotationInterval > 0)
+}
+
+type SessionConfig struct {
+	// Secrets sign and encrypt cookie sessions, newest first; see
+	// util.SessionKeyPairs.
+	Secrets []string `config:"secrets" env:"SESSION_SECRET"`
+	// CookieAuth lets browsers log in with ?mode=cookie.
+	CookieAuth bool `config:"cookie_auth" env:"COOKIE_AUTH"`
+	// SecureCookies limits session cookies to HTTPS. Only turn it off for
+	// local development over plain HTTP.
+	SecureCookies bool `config:"secure_cookies" env:"SECURE_COOKIES"`
+}
+
+// SMTPConfig configures outgoing mail. Without a host mail is only logged.
+type SMTPConfig struct {
+	Host     string `config:"host" env:"SMTP_HOST"`
+	Port     string `config:"port" env:"SMTP_PORT"`
+	Username string `config:"username" env:"SMTP_USERNAME"`
+	Password string `config:"password" env:"SMTP_PASSWORD"`
+	From     string `config:"from" env:"MAIL_FROM"`
+}
+
+type WebAuthnConfig struct {
+	// RPID is the host name passkeys are bound to, by default that of
+	// BaseURL.
+	RPID string `config:"rp_id" env:"WEBAUTHN_RP_ID"`
+}
+
+type OIDCConfig struct {
+	// Enabled makes this service an OpenID Connect provider: it serves
+	// discovery and userinfo, and issues ID tokens for the openid scope.
+	// Clients verify ID tokens with the JWKS, so it requires an asymmetric
+	// token algorithm.
+	Enabled bool `config:"enabled" env:"OIDC_ENABLED"`
+	// Issuer is where OpenID Connect clients discover this service, by
+	// default BaseURL.
+	Issuer string `config:"issuer" env:"OIDC_ISSUER"`
+	// AuthorizationURL is the frontend page users are sent to for
+	// consent, which calls /oauth/authorize with their token.
+	AuthorizationURL string `config:"authorization_url" env:"OAUTH_AUTHORIZATION_URL"`
+	// Providers are the external identity providers users can log in
+	// with. In the environment OIDC_PROVIDERS names them, e.g.
+	// "google,corp", and each is configured by OIDC_<NAME>_ISSUER,
+	// OIDC_<NAME>_CLIENT_ID and OIDC_<NAME>_CLIENT_SECRET.
+	Providers []OIDCProviderConfig `config:"providers"`
+}
+
+type OIDCProviderConfig struct {
+	Name         string `config:"name"`
+	Issuer       string `config:"issuer"`
+	ClientID     string `config:"client_id"`
+	ClientSecret string `config:"client_secret"`
+}
+
+// RateLimitConfig sets how many requests are allowed per minute, and how
+// many password reset emails per hour.
+type RateLimitConfig struct {
+	PerIP   int `config:"per_ip" env:"RATE_LIMIT_PER_IP"`
+	PerUser int `config:"per_user" env:"RATE_LIMIT_PER_USER"`
+	// PasswordResetsPerEmail is counted per address whether or not it
+	// belongs to an account, PasswordResetsPerIP per client.
+	PasswordResetsPerEmail int `config:"password_resets_per_email" env:"RATE_LIMIT_PASSWORD_RESETS_PER_EMAIL"`
+	PasswordResetsPerIP    int `config:"password_resets_per_ip" env:"RATE_LIMIT_PASSWORD_RESETS_PER_IP"`
+}
+
+// LoginConfig sets when repeated failed logins lock an account.
+type LoginConfig struct {
+	MaxFailures     int           `config:"max_failures" env:"LOGIN_MAX_FAILURES"`
+	FailureWindow   time.Duration `config:"failure_window" env:"LOGIN_FAILURE_WINDOW"`
+	LockoutDuration time.Duration `config:"lockout_duration" env:"LOGIN_LOCKOUT_DURATION"`
+}
+
+type PasswordConfig struct {
+	BcryptCost int `config:"bcrypt_cost" env:"BCRYPT_COST"`
+	// ResetURL is the frontend page the emailed reset link opens, with the
+	// token in its query. It posts the new password to /password/reset.
+	ResetURL string `config:"reset_url" env:"PASSWORD_RESET_URL"`
+}
+
+// CORSConfig lists the origins browsers may call the API from, e.g.
+// https://app.example.com.
+type CORSConfig struct {
+	AllowedOrigins []string `config:"allowed_origins" env:"CORS_ALLOWED_ORIGINS"`
+}
+
+// Default returns the settings used where nothing else is configured.
+func Default() *Config {
+	return &Config{
+		BaseURL: "http://localhost:8080",
+		AppName: "go-user-management",
+		Server: ServerConfig{
+			ListenAddr:      ":8080",
+			ReadTimeout:     15 * time.Second,
+			WriteTimeout:    30 * time.Second,
+			IdleTimeout:     2 * time.Minute,
+			ShutdownTimeout: 30 * time.Second,
+			StartupTimeout:  time.Minute,
+		},
+		Database: DatabaseConfig{
+			Port:    "5432",
+			SSLMode: "disable",
+		},
+		Redis: RedisConfig{
+			Port: "6379",
+		},
+		Tokens: TokenConfig{
+			Alg:             util.AlgHS256,
+			KeyGracePeriod:  util.DefaultKeyGracePeriod,
+			Issuer:          util.DefaultTokenIssuer,
+			Audience:        util.DefaultTokenAudience,
+			AccessTokenTTL:  util.DefaultAccessTokenTTL,
+			RefreshTokenTTL: util.DefaultRefreshTokenTTL,
+		},
+		Session: SessionConfig{
+			SecureCookies: true,
+		},
+		RateLimit: RateLimitConfig{
+			PerIP:                  120,
+			PerUser:                60,
+			PasswordResetsPerEmail: 3,
+			PasswordResetsPerIP:    10,
+		},
+		Login: LoginConfig{
+			MaxFailures:     5,
+			FailureWindow:   15 * time.Minute,
+			LockoutDuration: 15 * time.Minute,
+		},
+		Password: PasswordConfig{
+			BcryptCost: bcrypt.DefaultCost,
+		},
+	}
+}
+
+// complete fills in the settings that default to others.
+func (c *Config) complete() {
+	c.BaseURL = strings.TrimSuffix(c.BaseURL, "/")
+	if c.OIDC.Issuer == "" {
+		c.OIDC.Issuer = c.BaseURL
+	}
+	c.OIDC.Issuer = strings.TrimSuffix(c.OIDC.Issuer, "/")
+	if c.OIDC.AuthorizationURL == "" {
+		c.OIDC.AuthorizationURL = c.OIDC.Issuer + "/oauth/authorize"
+	}
+	if c.Password.ResetURL == "" {
+		c.Password.ResetURL = c.BaseURL + "/reset-password"
+	}
+	if c.WebAuthn.RPID == "" {
+		if u, err := url.Parse(c.BaseURL); err == nil {
+			c.WebAuthn.RPID = u.Hostname()
+		}
+	}
+}
+
+var providerNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// Validate reports every setting that is missing or unusable.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(isHTTPURL(c.BaseURL), "base_url must be an http(s) URL")
+	check(c.Server.ListenAddr != "", "listen_addr is required")
+	check(c.Server.ReadTimeout > 0 && c.Server.WriteTimeout > 0 && c.Server.IdleTimeout > 0, "server timeouts must be positive")
+	check(c.Server.ShutdownTimeout > 0 && c.Server.StartupTimeout > 0, "shutdown_timeout and startup_timeout must be positive")
+	if err := c.Database.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	check(c.Redis.Host != "", "redis host is required")
+
+	switch c.Tokens.Alg {
+	case util.AlgHS256:
+		check(len(c.Tokens.Key) >= minSecretLength, "tokens.key must be at least %d bytes for HS256", minSecretLength)
+	case util.AlgRS256, util.AlgES256, util.AlgEdDSA:
+	default:
+		errs = append(errs, fmt.Errorf("unsupported token algorithm %q", c.Tokens.Alg))
+	}
+	check(c.Tokens.Issuer != "" && c.Tokens.Audience != "", "token issuer and audience are required")
+	check(c.Tokens.AccessTokenTTL > 0, "access_token_ttl must be positive")
+	check(c.Tokens.RefreshTokenTTL > c.Tokens.AccessTokenTTL, "refresh_token_ttl must be longer than access_token_ttl")
+	// Tokens signed by a retired key have to stay verifiable until they
+	// expire.
+	check(c.Tokens.KeyGracePeriod >= c.Tokens.AccessTokenTTL, "key_grace_period must be at least access_token_ttl")
+	check(c.Tokens.KeyRotationInterval >= 0, "key_rotation_interval must not be negative")
+	// Only public keys can be published through the JWKS endpoint, and new
+	// keys are published for a while before they are used.
+	check(c.Tokens.KeyRotationInterval == 0 || c.Tokens.Alg != util.AlgHS256, "key_rotation_interval requires an asymmetric algorithm")
+	check(c.Tokens.KeyRotationInterval == 0 || c.Tokens.KeyRotationInterval > util.KeyPublishLead, "key_rotation_interval must be longer than %s", util.KeyPublishLead)
+	// Whoever reads a shared private key can sign tokens for any user.
+	check(!c.Tokens.SharesKeys() || len(c.Tokens.KeyEncryptionKey) >= minSecretLength,
+		"tokens.key_encryption_key must be at least %d bytes when keys are generated; set it or tokens.private_key_file", minSecretLength)
+
+	check(!c.Session.CookieAuth || len(c.Session.Secrets) > 0, "cookie_auth requires session secrets")
+	for _, secret := range c.Session.Secrets {
+		check(len(secret) >= minSecretLength, "session secrets must be at least %d bytes", minSecretLength)
+	}
+
+	check(c.SMTP.Host == "" || c.SMTP.From != "", "smtp from is required with an smtp host")
+	check(!c.OIDC.Enabled || c.Tokens.Alg != util.AlgHS256, "oidc requires an asymmetric token algorithm")
+	check(isHTTPURL(c.OIDC.Issuer), "oidc issuer must be an http(s) URL")
+	check(isHTTPURL(c.OIDC.AuthorizationURL), "oidc authorization_url must be an http(s) URL")
+	check(isHTTPURL(c.Password.ResetURL), "password reset_url must be an http(s) URL")
+	names := map[string]bool{}
+	for _, provider := range c.OIDC.Providers {
+		check(providerNamePattern.MatchString(provider.Name), "invalid identity provider name %q", provider.Name)
+		check(!names[provider.Name], "duplicate identity provider %q", provider.Name)
+		check(isHTTPURL(provider.Issuer) && provider.ClientID != "", "identity provider %q needs an issuer and client_id", provider.Name)
+		names[provider.Name] = true
+	}
+
+	check(c.RateLimit.PerIP > 0 && c.RateLimit.PerUser > 0, "rate limits must be positive")
+	check(c.RateLimit.PasswordResetsPerEmail > 0 && c.RateLimit.PasswordResetsPerIP > 0, "password reset limits must be positive")
+	check(c.Login.MaxFailures > 0 && c.Login.FailureWindow > 0 && c.Login.LockoutDuration > 0, "login lockout settings must be positive")
+	check(c.Password.BcryptCost >= bcrypt.MinCost && c.Password.BcryptCost <= bcrypt.MaxCost, "bcrypt_cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+
+	// Responses carry credentials, so a wildcard is not an option.
+	for _, origin := range c.CORS.AllowedOrigins {
+		u, err := url.Parse(origin)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" && u.Path == "" && u.RawQuery == "",
+			"invalid CORS origin %q", origin)
+	}
+	return errors.Join(errs...)
+}
+
+func isHTTPURL(value string) bool {
+	u, err := url.Parse(value)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
@@ -0,0 +1,189 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testKey = "0123456789abcdef0123456789abcdef"
+
+func testEnv(env map[string]string) func(string) (string, bool) {
+	base := map[string]string{
+		"DB_HOST":    "localhost",
+		"DB_USER":    "postgres",
+		"DB_NAME":    "postgres",
+		"REDIS_HOST": "localhost",
+		"JWT_KEY":    testKey,
+	}
+	for name, value := range env {
+		base[name] = value
+	}
+	return func(name string) (string, bool) {
+		value, ok := base[name]
+		return value, ok
+	}
+}
+
+func writeFile(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	assert.Nil(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestLoadDefaults(t *testing.T) {
+	cfg, err := load(nil, testEnv(nil))
+	assert.Nil(t, err)
+
+	assert.Equal(t, ":8080", cfg.Server.ListenAddr)
+	assert.Equal(t, "postgres://postgres:@localhost:5432/postgres?sslmode=disable", cfg.Database.DSN())
+	assert.Equal(t, "localhost:6379", cfg.Redis.Addr())
+	assert.Equal(t, 15*time.Minute, cfg.Tokens.AccessTokenTTL)
+	assert.Equal(t, "http://localhost:8080", cfg.OIDC.Issuer)
+	assert.Equal(t, "http://localhost:8080/oauth/authorize", cfg.OIDC.AuthorizationURL)
+	assert.Equal(t, "localhost", cfg.WebAuthn.RPID)
+	assert.Equal(t, "http://localhost:8080/reset-password", cfg.Password.ResetURL)
+}
+
+func TestLoadEnv(t *testing.T) {
+	cfg, err := load(nil, testEnv(map[string]string{
+		"APP_BASE_URL":               "https://auth.example.com/",
+		"ACCESS_TOKEN_TTL":           "5m",
+		"RATE_LIMIT_PER_IP":          "10",
+		"REQUIRE_EMAIL_VERIFICATION": "true",
+		"CORS_ALLOWED_ORIGINS":       "https://app.example.com, https://admin.example.com",
+		"OIDC_PROVIDERS":             "google",
+		"OIDC_GOOGLE_ISSUER":         "https://accounts.google.com",
+		"OIDC_GOOGLE_CLIENT_ID":      "client",
+	}))
+	assert.Nil(t, err)
+
+	assert.Equal(t, "https://auth.example.com", cfg.BaseURL)
+	assert.Equal(t, 5*time.Minute, cfg.Tokens.AccessTokenTTL)
+	assert.Equal(t, 10, cfg.RateLimit.PerIP)
+	assert.True(t, cfg.RequireEmailVerification)
+	assert.Equal(t, []string{"https://app.example.com", "https://admin.example.com"}, cfg.CORS.AllowedOrigins)
+	assert.Equal(t, []OIDCProviderConfig{{Name: "google", Issuer: "https://accounts.google.com", ClientID: "client"}}, cfg.OIDC.Providers)
+	assert.Equal(t, "auth.example.com", cfg.WebAuthn.RPID)
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeFile(t, "config.yaml", `
+app_name: from-file
+server:
+  listen_addr: ":9000"
+  shutdown_timeout: 5s
+tokens:
+  access_token_ttl: 10m
+rate_limit:
+  per_user: 30
+oidc:
+  providers:
+    - name: corp
+      issuer: https://sso.example.com
+      client_id: client
+`)
+
+	cfg, err := load([]string{"-config", path, "-listen-addr", ":9100"}, testEnv(map[string]string{
+		"LISTEN_ADDR": ":9001",
+		"APP_NAME":    "from-env",
+	}))
+	assert.Nil(t, err)
+
+	// Flags override the environment, which overrides the file
+	assert.Equal(t, ":9100", cfg.Server.ListenAddr)
+	assert.Equal(t, "from-env", cfg.AppName)
+	assert.Equal(t, 5*time.Second, cfg.Server.ShutdownTimeout)
+	assert.Equal(t, 10*time.Minute, cfg.Tokens.AccessTokenTTL)
+	assert.Equal(t, 30, cfg.RateLimit.PerUser)
+	assert.Equal(t, "corp", cfg.OIDC.Providers[0].Name)
+}
+
+func TestLoadTOML(t *testing.T) {
+	path := writeFile(t, "config.toml", `
+bcrypt_typo = 1
+`)
+	_, err := load(nil, testEnv(map[string]string{"CONFIG_FILE": path}))
+	assert.ErrorContains(t, err, `unknown setting "bcrypt_typo"`)
+
+	path = writeFile(t, "config.toml", `
+[tokens]
+refresh_token_ttl = "24h"
+
+[password]
+bcrypt_cost = 12
+
+[cors]
+allowed_origins = ["https://app.example.com"]
+`)
+	cfg, err := load(nil, testEnv(map[string]string{"CONFIG_FILE": path}))
+	assert.Nil(t, err)
+	assert.Equal(t, 24*time.Hour, cfg.Tokens.RefreshTokenTTL)
+	assert.Equal(t, 12, cfg.Password.BcryptCost)
+	assert.Equal(t, []string{"https://app.example.com"}, cfg.CORS.AllowedOrigins)
+}
+
+func TestValidate(t *testing.T) {
+	for name, env := range map[string]map[string]string{
+		"missing key":          {"JWT_KEY": ""},
+		"weak key":             {"JWT_KEY": "secret"},
+		"unknown algorithm":    {"JWT_ALG": "none"},
+		"missing database":     {"DB_HOST": ""},
+		"cookie auth":          {"COOKIE_AUTH": "true"},
+		"weak session secret":  {"SESSION_SECRET": "secret"},
+		"bcrypt cost":          {"BCRYPT_COST": "40"},
+		"refresh ttl":          {"REFRESH_TOKEN_TTL": "1m"},
+		"wildcard origin":      {"CORS_ALLOWED_ORIGINS": "*"},
+		"origin with path":     {"CORS_ALLOWED_ORIGINS": "https://app.example.com/"},
+		"incomplete provider":  {"OIDC_PROVIDERS": "corp"},
+		"invalid base url":     {"APP_BASE_URL": "localhost"},
+		"invalid rate limit":   {"RATE_LIMIT_PER_IP": "0"},
+		"invalid reset limit":  {"RATE_LIMIT_PASSWORD_RESETS_PER_EMAIL": "0"},
+		"missing mail address": {"SMTP_HOST": "smtp.example.com"},
+		"shutdown timeout":     {"SERVER_SHUTDOWN_TIMEOUT": "0s"},
+		"hs256 rotation":       {"JWT_KEY_ROTATION_INTERVAL": "24h"},
+		"hs256 oidc":           {"OIDC_ENABLED": "true"},
+		"unencrypted keys":     {"JWT_ALG": "ES256"},
+	} {
+		_, err := load(nil, testEnv(env))
+		assert.NotNil(t, err, name)
+	}
+
+	// Asymmetric algorithms need no shared key, but generated keys are
+	// encrypted
+	_, err := load(nil, testEnv(map[string]string{"JWT_ALG": "ES256", "JWT_KEY": "", "JWT_KEY_ENCRYPTION_KEY": testKey}))
+	assert.Nil(t, err)
+	_, err = load(nil, testEnv(map[string]string{"JWT_ALG": "ES256", "JWT_KEY_ROTATION_INTERVAL": "24h", "JWT_KEY_ENCRYPTION_KEY": testKey, "OIDC_ENABLED": "true"}))
+	assert.Nil(t, err)
+	_, err = load(nil, testEnv(map[string]string{"JWT_ALG": "ES256", "JWT_PRIVATE_KEY_FILE": "key.pem"}))
+	assert.Nil(t, err)
+	// New keys have to be published for a while before they are used
+	_, err = load(nil, testEnv(map[string]string{"JWT_ALG": "ES256", "JWT_KEY_ROTATION_INTERVAL": "5m", "JWT_KEY_ENCRYPTION_KEY": testKey}))
+	assert.ErrorContains(t, err, "key_rotation_interval")
+
+	// Every problem is reported at once
+	_, err = load(nil, testEnv(map[string]string{"JWT_KEY": "", "REDIS_HOST": ""}))
+	assert.Len(t, strings.Split(err.Error(), "\n"), 2)
+}
+
+func TestLoadInvalidValues(t *testing.T) {
+	_, err := load(nil, testEnv(map[string]string{"ACCESS_TOKEN_TTL": "15"}))
+	assert.ErrorContains(t, err, "ACCESS_TOKEN_TTL")
+
+	_, err = load([]string{"-rate-limit-per-ip", "many"}, testEnv(nil))
+	assert.ErrorContains(t, err, "-rate-limit-per-ip")
+}
+
+func TestLoadDatabase(t *testing.T) {
+	// Only the database settings are required
+	cfg, err := loadDatabase(nil, testEnv(map[string]string{"JWT_KEY": "", "REDIS_HOST": ""}))
+	assert.Nil(t, err)
+	assert.Equal(t, "localhost", cfg.Database.Host)
+
+	_, err = loadDatabase(nil, testEnv(map[string]string{"DB_HOST": ""}))
+	assert.ErrorContains(t, err, "database")
+}
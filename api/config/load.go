@@ -0,0 +1,279 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Load reads the settings, each source overriding the ones before: the
+// defaults, the file named by the -config flag or CONFIG_FILE, the
+// environment, and the flags in args. The result has been validated.
+func Load(args []string) (*Config, error) {
+	return load(args, os.LookupEnv)
+}
+
+// LoadDatabase reads the settings like Load, but only validates those of the
+// database, for commands such as migrate that need nothing else.
+func LoadDatabase(args []string) (*Config, error) {
+	return loadDatabase(args, os.LookupEnv)
+}
+
+func load(args []string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	cfg, err := read(args, lookupEnv)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func loadDatabase(args []string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	cfg, err := read(args, lookupEnv)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Database.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// read merges the sources of the settings without validating them.
+func read(args []string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	cfg := Default()
+
+	fs := flag.NewFlagSet("go-user-management", flag.ContinueOnError)
+	path := fs.String("config", "", "YAML or TOML configuration file")
+	flags := map[string]string{}
+	fields := map[string]reflect.Value{}
+	walkEnv(reflect.ValueOf(cfg).Elem(), func(field reflect.Value, env string) {
+		name := flagName(env)
+		fields[name] = field
+		fs.Func(name, "overrides "+env, func(value string) error {
+			flags[name] = value
+			return nil
+		})
+	})
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *path == "" {
+		*path, _ = lookupEnv("CONFIG_FILE")
+	}
+	if *path != "" {
+		if err := loadFile(cfg, *path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := loadEnv(cfg, lookupEnv); err != nil {
+		return nil, err
+	}
+
+	for name, value := range flags {
+		if err := setValue(fields[name], value); err != nil {
+			return nil, fmt.Errorf("-%s: %w", name, err)
+		}
+	}
+
+	cfg.complete()
+	return cfg, nil
+}
+
+func flagName(env string) string {
+	return strings.ReplaceAll(strings.ToLower(env), "_", "-")
+}
+
+// loadFile decodes the file at path by its extension. Both formats are
+// decoded into plain maps first so that durations such as "15m" are read the
+// same way as from the environment.
+func loadFile(cfg *Config, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	values := map[string]interface{}{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &values)
+	case ".toml":
+		err = toml.Unmarshal(data, &values)
+	default:
+		return fmt.Errorf("%s: unsupported configuration format", path)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if err := setFields(reflect.ValueOf(cfg).Elem(), values); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+func loadEnv(cfg *Config, lookupEnv func(string) (string, bool)) error {
+	var errs []error
+	walkEnv(reflect.ValueOf(cfg).Elem(), func(field reflect.Value, env string) {
+		if value, ok := lookupEnv(env); ok {
+			if err := setValue(field, value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", env, err))
+			}
+		}
+	})
+
+	if names, ok := lookupEnv("OIDC_PROVIDERS"); ok {
+		cfg.OIDC.Providers = nil
+		for _, name := range strings.Split(names, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			prefix := "OIDC_" + strings.ToUpper(name) + "_"
+			issuer, _ := lookupEnv(prefix + "ISSUER")
+			clientID, _ := lookupEnv(prefix + "CLIENT_ID")
+			clientSecret, _ := lookupEnv(prefix + "CLIENT_SECRET")
+			cfg.OIDC.Providers = append(cfg.OIDC.Providers, OIDCProviderConfig{
+				Name:         name,
+				Issuer:       issuer,
+				ClientID:     clientID,
+				ClientSecret: clientSecret,
+			})
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// walkEnv calls fn for every field of v, including those of nested
+// sections, that has an environment variable.
+func walkEnv(v reflect.Value, fn func(field reflect.Value, env string)) {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if env := v.Type().Field(i).Tag.Get("env"); env != "" {
+			fn(field, env)
+		} else if field.Kind() == reflect.Struct {
+			walkEnv(field, fn)
+		}
+	}
+}
+
+// setFields sets the fields of struct v from a decoded file section. Keys
+// that match no setting are an error, so that typos do not go unnoticed.
+func setFields(v reflect.Value, values map[string]interface{}) error {
+	known := map[string]reflect.Value{}
+	for i := 0; i < v.NumField(); i++ {
+		if key := v.Type().Field(i).Tag.Get("config"); key != "" {
+			known[key] = v.Field(i)
+		}
+	}
+	for key, value := range values {
+		field, ok := known[key]
+		if !ok {
+			return fmt.Errorf("unknown setting %q", key)
+		}
+		if err := setValue(field, value); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// setValue stores value, as decoded from a file or given as a string, in v.
+// Lists can also be given as comma separated strings.
+func setValue(v reflect.Value, value interface{}) error {
+	if v.Type() == durationType {
+		s, ok := value.(string)
+		if !ok {
+			return errors.New("durations are written like \"15m\"")
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		switch value := value.(type) {
+		case string:
+			v.SetString(value)
+		case int, int64, float64:
+			v.SetString(fmt.Sprint(value))
+		default:
+			return fmt.Errorf("expected a string, got %T", value)
+		}
+	case reflect.Bool:
+		switch value := value.(type) {
+		case bool:
+			v.SetBool(value)
+		case string:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return err
+			}
+			v.SetBool(b)
+		default:
+			return fmt.Errorf("expected a boolean, got %T", value)
+		}
+	case reflect.Int:
+		switch value := value.(type) {
+		case int:
+			v.SetInt(int64(value))
+		case int64:
+			v.SetInt(value)
+		case string:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return err
+			}
+			v.SetInt(int64(n))
+		default:
+			return fmt.Errorf("expected an integer, got %T", value)
+		}
+	case reflect.Slice:
+		var items []interface{}
+		switch value := value.(type) {
+		case []interface{}:
+			items = value
+		case string:
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+		default:
+			return fmt.Errorf("expected a list, got %T", value)
+		}
+		slice := reflect.MakeSlice(v.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := setValue(slice.Index(i), item); err != nil {
+				return err
+			}
+		}
+		v.Set(slice)
+	case reflect.Struct:
+		values, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("expected a section, got %T", value)
+		}
+		return setFields(v, values)
+	default:
+		return fmt.Errorf("unsupported setting type %s", v.Type())
+	}
+	return nil
+}
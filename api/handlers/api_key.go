@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/aki-0517/go-user-management/middleware"
+	"github.com/aki-0517/go-user-management/models"
+	"github.com/gin-gonic/gin"
+)
+
+// ListAPIKeysHandler lists the current user's API keys, without the keys
+// themselves.
+func (h *Handler) ListAPIKeysHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		keys, err := models.GetAPIKeys(h.db, middleware.CurrentUser(c).ID)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		c.JSON(http.StatusOK, keys)
+	}
+}
+
+// CreateAPIKeyHandler creates an API key for the current user. The key is
+// only part of this response.
+func (h *Handler) CreateAPIKeyHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request struct {
+			Name      string     `json:"name" binding:"required"`
+			Scope     string     `json:"scope"`
+			ExpiresAt *time.Time `json:"expires_at"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.Error(invalidRequest(err))
+			return
+		}
+
+		apiKey := models.APIKey{
+			UserID:    middleware.CurrentUser(c).ID,
+			Name:      request.Name,
+			Scope:     request.Scope,
+			ExpiresAt: request.ExpiresAt,
+		}
+		key, err := models.CreateAPIKey(h.db, &apiKey)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{
+			"id":         apiKey.ID,
+			"name":       apiKey.Name,
+			"prefix":     apiKey.Prefix,
+			"scope":      apiKey.Scope,
+			"expires_at": apiKey.ExpiresAt,
+			"created_at": apiKey.CreatedAt,
+			"key":        key,
+		})
+	}
+}
+
+// RevokeAPIKeyHandler deletes one of the current user's API keys.
+func (h *Handler) RevokeAPIKeyHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := uuidParam(c, "key_id")
+		if !ok {
+			return
+		}
+		revoked, err := models.RevokeAPIKey(h.db, middleware.CurrentUser(c).ID, id)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		if !revoked {
+			c.Error(models.NotFoundError("api_key_not_found", "API key not found"))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "API key revoked"})
+	}
+}
@@ -2,27 +2,74 @@ package handlers
 
 import (
 	"errors"
+	"io"
+	"math"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
 	"github.com/go-redis/redis/v8"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+	"github.com/aki-0517/go-user-management/config"
+	"github.com/aki-0517/go-user-management/middleware"
 	"github.com/aki-0517/go-user-management/models"
 	"github.com/aki-0517/go-user-management/util"
 	"gorm.io/gorm"
 )
 
 type AuthHandler struct {
-	db     *gorm.DB
-	JWTKey []byte
-	rdb    *redis.Client
+	cfg           *config.Config
+	db            *gorm.DB
+	users         models.UserRepository
+	Keys          *util.KeySet
+	rdb           *redis.Client
+	blocklist     util.TokenBlocklist
+	refreshTokens *util.RefreshTokenStore
+	loginGuard    *util.LoginGuard
+	rateLimits    util.RateLimitStore
+	mailer        util.Mailer
+	// background tracks work that outlives its request, such as sending
+	// emails, so that the server can wait for it when shutting down.
+	background *sync.WaitGroup
+
+	webAuthn         *webauthn.WebAuthn
+	webAuthnSessions *util.WebAuthnSessionStore
+	// oidcProviders are the external identity providers by name.
+	oidcProviders map[string]*util.OIDCProvider
+	// cookieOptions are the attributes of the auth cookie. Cookie mode is
+	// disabled if they are nil.
+	cookieOptions *sessions.Options
+	// dummyPasswordHash is compared against when no user matches the
+	// email, so that unknown accounts take as long to reject as wrong
+	// passwords. It is hashed at the configured cost for the same reason.
+	dummyPasswordHash string
 }
 
-func AuthHandlerInit(db *gorm.DB, jwtkey []byte, rdb *redis.Client) AuthHandler {
+func AuthHandlerInit(cfg *config.Config, db *gorm.DB, users models.UserRepository, keys *util.KeySet, rdb *redis.Client, loginGuard *util.LoginGuard, mailer util.Mailer, background *sync.WaitGroup, webAuthn *webauthn.WebAuthn, oidcProviders map[string]*util.OIDCProvider, cookieOptions *sessions.Options) AuthHandler {
+	dummyPasswordHash, _ := util.HashPassword("dummy-password", cfg.Password.BcryptCost)
 	return AuthHandler{
-		db:     db,
-		JWTKey: jwtkey,
-		rdb:    rdb,
+		cfg:           cfg,
+		db:            db,
+		users:         users,
+		Keys:          keys,
+		rdb:           rdb,
+		blocklist:     util.NewRedisTokenBlocklist(rdb),
+		refreshTokens: util.NewRefreshTokenStore(rdb, cfg.Tokens.RefreshTokenTTL),
+		loginGuard:    loginGuard,
+		rateLimits:    util.NewRedisRateLimitStore(rdb),
+		mailer:        mailer,
+		background:    background,
+
+		webAuthn:         webAuthn,
+		webAuthnSessions: util.NewWebAuthnSessionStore(rdb),
+		oidcProviders:    oidcProviders,
+
+		cookieOptions:     cookieOptions,
+		dummyPasswordHash: dummyPasswordHash,
 	}
 }
 
@@ -30,81 +77,125 @@ func (h *AuthHandler) LoginHandler() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var user models.User
 		if err := c.ShouldBindJSON(&user); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			c.Error(invalidRequest(err))
 			return
 		}
 
-		foundUser, err := models.GetUserByEmail(h.db, user.Email)
-
+		ip := c.ClientIP()
+		wait, err := h.loginGuard.Check(user.Email, ip)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving user"})
+			c.Error(err)
 			return
-		} else if foundUser == nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid email or password"})
+		}
+		if wait > 0 {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			c.Error(errLoginLocked)
+			return
+		}
+
+		foundUser, err := h.users.GetByEmail(user.Email)
+		if err != nil {
+			c.Error(err)
 			return
 		}
 
 		// ユーザーが入力したパスワードと、データベースに保存されているハッシュ化されたパスワードを比較
-		if !util.CheckPasswordHash(user.Password, foundUser.Password) {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid email or password"})
+		passwordHash := h.dummyPasswordHash
+		if foundUser != nil {
+			passwordHash = foundUser.Password
+		}
+		if !util.CheckPasswordHash(user.Password, passwordHash) || foundUser == nil {
+			if err := h.loginGuard.RecordFailure(user.Email, ip); err != nil {
+				c.Error(err)
+				return
+			}
+			c.Error(models.UnauthorizedError("invalid_credentials", "Invalid email or password"))
+			return
+		}
+		if err := h.loginGuard.Reset(user.Email); err != nil {
+			c.Error(err)
+			return
+		}
+		if h.cfg.RequireEmailVerification && !foundUser.IsEmailVerified() {
+			c.Error(errEmailNotVerified)
 			return
 		}
 
-		tokenString, err := util.GenerateToken(h.JWTKey, foundUser.Email)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating token"})
+		if foundUser.TOTPEnabled {
+			h.respondWithMFAChallenge(c, foundUser)
 			return
 		}
-		c.JSON(http.StatusOK, gin.H{"token": tokenString})
+		h.completeLogin(c, foundUser, wantsCookie(c))
 	}
 }
 
-func (h *AuthHandler) ChangePasswordHandler() gin.HandlerFunc {
+// UnlockUserHandler lifts a login lockout of the user in the path.
+func (h *AuthHandler) UnlockUserHandler() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		err := h.processAndBlacklistToken(c)
+		id, ok := uuidParam(c, "id")
+		if !ok {
+			return
+		}
+		user, err := h.users.GetByID(id)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			c.Error(err)
 			return
 		}
-		var changePasswordRequest struct {
-			OldPassword string `json:"old_password"`
-			NewPassword string `json:"new_password"`
+		if user == nil {
+			c.Error(models.ErrUserNotFound)
+			return
 		}
 
-		if err := c.ShouldBindJSON(&changePasswordRequest); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		if err := h.loginGuard.Unlock(user.Email); err != nil {
+			c.Error(err)
 			return
 		}
+		c.JSON(http.StatusOK, gin.H{"message": "User unlocked"})
+	}
+}
 
-		email, err := util.GetSubjectFromJWT(c, h.JWTKey)
-		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+func (h *AuthHandler) ChangePasswordHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Passwords can only be changed by their owner, who has to know the
+		// old one; administrators are not exempt.
+		user := middleware.CurrentUser(c)
+		id, ok := uuidParam(c, "id")
+		if !ok {
 			return
 		}
-
-		user, err := models.GetUserByEmail(h.db, email)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving user"})
+		if user.ID != id {
+			c.Error(errForbidden)
 			return
 		}
-		if user == nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "No user found with this email"})
+
+		var changePasswordRequest struct {
+			OldPassword string `json:"old_password" binding:"required"`
+			NewPassword string `json:"new_password" binding:"required"`
+		}
+
+		if err := c.ShouldBindJSON(&changePasswordRequest); err != nil {
+			c.Error(invalidRequest(err))
 			return
 		}
 
 		if !util.CheckPasswordHash(changePasswordRequest.OldPassword, user.Password) {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid password"})
+			c.Error(models.UnauthorizedError("invalid_password", "Invalid password"))
 			return
 		}
-		hashedPassword, err := util.HashPassword(changePasswordRequest.NewPassword)
+		hashedPassword, err := util.HashPassword(changePasswordRequest.NewPassword, h.cfg.Password.BcryptCost)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error hashing password"})
+			c.Error(err)
+			return
+		}
+		if _, err := h.users.Update(user.ID, models.UserChanges{Password: &hashedPassword}); err != nil {
+			c.Error(err)
 			return
 		}
-		user.Password = hashedPassword
 
-		if err := h.db.Save(user).Error; err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating password"})
+		// The session only ends once the password has actually changed, so
+		// that a mistyped old password does not log the user out.
+		if err := h.processAndBlacklistToken(c); err != nil {
+			c.Error(err)
 			return
 		}
 		c.JSON(http.StatusOK, gin.H{"message": "Password updated successfully"})
@@ -113,73 +204,212 @@ func (h *AuthHandler) ChangePasswordHandler() gin.HandlerFunc {
 
 func (h *AuthHandler) RefreshTokenHandler() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		err := h.processAndBlacklistToken(c)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		var refreshRequest struct {
+			RefreshToken string `json:"refresh_token" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&refreshRequest); err != nil {
+			c.Error(invalidRequest(err))
 			return
 		}
 
-		authHeader := c.Request.Header.Get("Authorization")
-		if authHeader == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header required"})
+		grant, refreshToken, err := h.refreshTokens.RotateForClient(refreshRequest.RefreshToken, "", nil)
+		if errors.Is(err, util.ErrRefreshTokenReused) {
+			// The token was stolen from one of the two parties that used
+			// it, so the session ends for both, as on logout.
+			if err := h.endReusedSession(grant); err != nil {
+				c.Error(err)
+				return
+			}
+		}
+		if errors.Is(err, util.ErrInvalidRefreshToken) || errors.Is(err, util.ErrRefreshTokenReused) {
+			c.Error(models.UnauthorizedError("invalid_refresh_token", err.Error()))
+			return
+		} else if err != nil {
+			c.Error(err)
 			return
 		}
-		oldToken, err := util.ExtractBearerToken(authHeader)
+		id, err := uuid.Parse(grant.Subject)
 		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			c.Error(errInvalidRefreshToken)
 			return
 		}
-
-		newToken, err := util.RefreshJWTToken(h.JWTKey, oldToken)
+		user, err := h.users.GetByID(id)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			c.Error(err)
 			return
 		}
-		c.JSON(http.StatusOK, gin.H{"token": newToken})
+		if user == nil {
+			c.Error(errInvalidRefreshToken)
+			return
+		}
+		// Tokens issued before sessions were recorded have none.
+		if grant.SessionID != "" {
+			if !h.touchSession(c, grant.SessionID) {
+				return
+			}
+		}
+		h.respondWithTokens(c, user, grant.SessionID, refreshToken)
+	}
+}
+
+// endReusedSession ends the session a reused refresh token was issued to,
+// revoking the access tokens issued with it as well.
+func (h *AuthHandler) endReusedSession(grant *util.RefreshTokenGrant) error {
+	// Tokens issued before sessions were recorded have none.
+	if grant.SessionID == "" {
+		return nil
+	}
+	userID, err := uuid.Parse(grant.Subject)
+	if err != nil {
+		return nil
+	}
+	sessionID, err := uuid.Parse(grant.SessionID)
+	if err != nil {
+		return nil
 	}
+	_, err = h.endSession(userID, sessionID)
+	return err
 }
 
 func (h *AuthHandler) LogOutHandler() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		// The refresh token is optional so that clients which only hold an
+		// access token can still log out.
+		var logoutRequest struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		if err := c.ShouldBindJSON(&logoutRequest); err != nil && !errors.Is(err, io.EOF) {
+			c.Error(invalidRequest(err))
+			return
+		}
+
 		err := h.processAndBlacklistToken(c)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			c.Error(err)
 			return
 		}
+
+		// Only the user's own refresh tokens are revoked, others are
+		// ignored like unknown ones.
+		if logoutRequest.RefreshToken != "" {
+			grant, err := h.refreshTokens.Lookup(logoutRequest.RefreshToken)
+			if err != nil && !errors.Is(err, util.ErrInvalidRefreshToken) {
+				c.Error(err)
+				return
+			}
+			if err == nil && grant.Subject == middleware.CurrentUser(c).ID.String() {
+				if err := h.refreshTokens.Revoke(logoutRequest.RefreshToken); err != nil {
+					c.Error(err)
+					return
+				}
+			}
+		}
+		if sessionID := middleware.CurrentSessionID(c); sessionID != "" {
+			id, _ := uuid.Parse(sessionID)
+			if _, err := h.endSession(middleware.CurrentUser(c).ID, id); err != nil {
+				c.Error(err)
+				return
+			}
+		}
 		c.JSON(http.StatusOK, gin.H{"message": "Successfully logged out"})
 	}
 }
 
+// JWKSHandler publishes the public signing keys so that other services can
+// verify access tokens without sharing a secret.
+func (h *AuthHandler) JWKSHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Cache-Control", "public, max-age="+strconv.Itoa(int(util.JWKSMaxAge.Seconds())))
+		c.JSON(http.StatusOK, h.Keys.JWKS())
+	}
+}
+
+// wantsCookie reports whether a login asks for cookie mode, in which the
+// browser is authenticated by an HttpOnly cookie instead of tokens that
+// scripts can read.
+func wantsCookie(c *gin.Context) bool {
+	return c.Query("mode") == "cookie"
+}
+
+// completeLogin starts a new session for an authenticated user and responds
+// with its first tokens, or sets the auth cookie in cookie mode.
+func (h *AuthHandler) completeLogin(c *gin.Context, user *models.User, cookie bool) {
+	if cookie && h.cookieOptions == nil {
+		c.Error(errCookieAuthDisabled)
+		return
+	}
+	session, err := models.CreateSession(h.db, user.ID, c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	sessionID := session.ID.String()
+
+	if cookie {
+		csrfToken, err := middleware.StartCookieSession(c, *h.cookieOptions, user.ID.String(), sessionID)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"csrf_token": csrfToken,
+			"expires_in": h.cookieOptions.MaxAge,
+		})
+		return
+	}
+	refreshToken, err := h.refreshTokens.IssueGrant(util.RefreshTokenGrant{Subject: user.ID.String(), SessionID: sessionID})
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	h.respondWithTokens(c, user, sessionID, refreshToken)
+}
+
+func (h *AuthHandler) respondWithTokens(c *gin.Context, user *models.User, sessionID string, refreshToken string) {
+	accessToken, err := util.GenerateSessionToken(h.Keys, user.ID.String(), user.RoleNames(), sessionID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"token":         accessToken,
+		"token_type":    "Bearer",
+		"expires_in":    int(h.Keys.AccessTokenTTL.Seconds()),
+		"refresh_token": refreshToken,
+	})
+}
+
 func (h *AuthHandler) processAndBlacklistToken(c *gin.Context) error {
+	// Cookie sessions carry no token; ending the session and removing the
+	// cookie takes its place.
+	if middleware.IsCookieAuthenticated(c) {
+		return h.endCookieSession(c)
+	}
 	authHeader := c.Request.Header.Get("Authorization")
 	if authHeader == "" {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header required"})
-		c.Abort()
-		return errors.New("Authorization header required")
+		return models.UnauthorizedError("authorization_required", "Authorization header required")
 	}
 	tokenString, err := util.ExtractBearerToken(authHeader)
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
-		c.Abort()
-		return err
+		return models.UnauthorizedError("invalid_token", err.Error())
 	}
 
-	isBlacklisted, err := util.IsTokenBlocklisted(tokenString, h.rdb)
+	isBlacklisted, err := h.blocklist.IsBlocklisted(tokenString)
 	if err != nil {
 		return err
 	}
 
 	if isBlacklisted {
-		return errors.New("Token is blacklisted")
+		return models.UnauthorizedError("token_revoked", "Token has been revoked")
 	}
 
-	claims, err := util.ParseToken(h.JWTKey, tokenString)
+	claims, err := util.ParseToken(h.Keys, tokenString)
 	if err != nil {
-		return err
+		return models.UnauthorizedError("invalid_token", "Invalid token")
 	}
 
 	expireTime := time.Unix(claims.ExpiresAt, 0)
 	expiration := expireTime.Sub(time.Now())
 
-	return util.AddTokenToBlacklist(tokenString, h.rdb, expiration)
+	return h.blocklist.Add(tokenString, expiration)
 }
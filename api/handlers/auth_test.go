@@ -0,0 +1,208 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/aki-0517/go-user-management/config"
+	"github.com/aki-0517/go-user-management/middleware"
+	"github.com/aki-0517/go-user-management/models"
+	"github.com/aki-0517/go-user-management/util"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+type testAuthAPI struct {
+	router     *gin.Engine
+	cfg        *config.Config
+	db         *gorm.DB
+	redis      *miniredis.Miniredis
+	users      models.UserRepository
+	keys       *util.KeySet
+	mailer     *util.MemoryMailer
+	background *sync.WaitGroup
+}
+
+// newTestAuthAPI serves the login and password reset routes from the test
+// database, with Redis replaced by miniredis. Access tokens are only
+// accepted while their session is active, as in the server.
+func newTestAuthAPI(t *testing.T) *testAuthAPI {
+	gin.SetMode(gin.TestMode)
+	db := setupTestDB(t)
+
+	cfg := config.Default()
+	cfg.Password.BcryptCost = bcrypt.MinCost
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	keys := util.NewKeySet(util.NewHMACSigner("test", []byte("test_key")), util.DefaultKeyGracePeriod)
+	users := models.NewGormUserRepository(db)
+	mailer := util.NewMemoryMailer()
+	background := &sync.WaitGroup{}
+	loginGuard := util.NewLoginGuard(rdb, cfg.Login.MaxFailures, cfg.Login.FailureWindow, cfg.Login.LockoutDuration)
+	uh := UserHandler(cfg, db, users, keys, util.NewEmailVerifier(rdb, mailer, cfg.BaseURL), background)
+	ah := AuthHandlerInit(cfg, db, users, keys, rdb, loginGuard, mailer, background, nil, nil, nil)
+
+	m := middleware.NewMiddleware(keys, util.NewRedisTokenBlocklist(rdb), false, false, func(subject string) (*models.User, error) {
+		id, err := uuid.Parse(subject)
+		if err != nil {
+			return nil, nil
+		}
+		return users.GetByID(id)
+	}, func(key string) (*models.APIKey, error) {
+		return models.AuthenticateAPIKey(db, key)
+	}, func(sessionID string) (bool, error) {
+		id, err := uuid.Parse(sessionID)
+		if err != nil {
+			return false, nil
+		}
+		session, err := models.GetActiveSession(db, id, cfg.Tokens.RefreshTokenTTL)
+		return session != nil, err
+	})
+
+	r := gin.New()
+	r.Use(middleware.Errors())
+	r.POST("/login", ah.LoginHandler())
+	r.POST("/login/mfa", ah.LoginMFAHandler())
+	r.POST("/password/forgot", ah.ForgotPasswordHandler())
+	r.POST("/password/reset", ah.ResetPasswordHandler())
+	r.POST("/me/refresh-token", ah.RefreshTokenHandler())
+	r.POST("/logout", m.AuthenticateMiddleware(), ah.LogOutHandler())
+	r.DELETE("/me/sessions", m.AuthenticateMiddleware(), ah.LogOutEverywhereHandler())
+	r.GET("/me/:id", m.AuthenticateMiddleware(), uh.GetUserHandler())
+	return &testAuthAPI{router: r, cfg: cfg, db: db, redis: mr, users: users, keys: keys, mailer: mailer, background: background}
+}
+
+func (api *testAuthAPI) createUser(t *testing.T, email string) *models.User {
+	user, err := api.users.Create(models.User{Name: "test", Email: email, Password: "password"}, bcrypt.MinCost)
+	assert.Nil(t, err)
+	return user
+}
+
+// do sends a request with the given headers and returns the decoded
+// response.
+func (api *testAuthAPI) do(t *testing.T, method string, path string, headers map[string]string, body interface{}) (*httptest.ResponseRecorder, map[string]interface{}) {
+	var payload bytes.Buffer
+	if body != nil {
+		assert.Nil(t, json.NewEncoder(&payload).Encode(body))
+	}
+	req, _ := http.NewRequest(method, path, &payload)
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	api.router.ServeHTTP(w, req)
+
+	var response map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return w, response
+}
+
+// login logs in with email and password and returns the response.
+func (api *testAuthAPI) login(t *testing.T, email string, password string) (*httptest.ResponseRecorder, map[string]interface{}) {
+	return api.do(t, http.MethodPost, "/login", nil, gin.H{"email": email, "password": password})
+}
+
+func bearer(token interface{}) map[string]string {
+	s, _ := token.(string)
+	return map[string]string{"Authorization": "Bearer " + s}
+}
+
+func TestChangePasswordHandler(t *testing.T) {
+	api := newTestUserAPI(t)
+	user := api.createUser(t, "test@test.com")
+	token, _ := util.GenerateToken(api.keys, user.ID.String(), user.RoleNames())
+	path := "/me/" + user.ID.String() + "/password"
+
+	// Mistakes leave the password and the session as they are
+	w := api.doWithToken(t, http.MethodPut, path, token, gin.H{"old_password": "wrong", "new_password": "changed"})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = api.doWithToken(t, http.MethodPut, path, token, gin.H{"old_password": "password"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	stored, _ := api.users.GetByID(user.ID)
+	assert.True(t, util.CheckPasswordHash("password", stored.Password))
+
+	w = api.doWithToken(t, http.MethodPut, path, token, gin.H{"old_password": "password", "new_password": "changed"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	stored, _ = api.users.GetByID(user.ID)
+	assert.True(t, util.CheckPasswordHash("changed", stored.Password))
+
+	// The token the password was changed with has been revoked
+	w = api.doWithToken(t, http.MethodGet, "/me/"+user.ID.String(), token, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestRefreshTokenReuseEndsSession(t *testing.T) {
+	api := newTestAuthAPI(t)
+	user := api.createUser(t, "test@test.com")
+
+	w, tokens := api.login(t, "test@test.com", "password")
+	assert.Equal(t, http.StatusOK, w.Code)
+	w, rotated := api.do(t, http.MethodPost, "/me/refresh-token", nil, gin.H{"refresh_token": tokens["refresh_token"]})
+	assert.Equal(t, http.StatusOK, w.Code)
+	w, _ = api.do(t, http.MethodGet, "/me/"+user.ID.String(), bearer(rotated["token"]), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Replaying the used refresh token ends the session, for whoever holds
+	// its tokens
+	w, body := api.do(t, http.MethodPost, "/me/refresh-token", nil, gin.H{"refresh_token": tokens["refresh_token"]})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "invalid_refresh_token", body["code"])
+	sessions, err := models.GetActiveSessions(api.db, user.ID, api.cfg.Tokens.RefreshTokenTTL)
+	assert.Nil(t, err)
+	assert.Empty(t, sessions)
+	for _, token := range []interface{}{tokens["token"], rotated["token"]} {
+		w, _ = api.do(t, http.MethodGet, "/me/"+user.ID.String(), bearer(token), nil)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	}
+	w, _ = api.do(t, http.MethodPost, "/me/refresh-token", nil, gin.H{"refresh_token": rotated["refresh_token"]})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestLogOutIgnoresOtherUsersRefreshTokens(t *testing.T) {
+	api := newTestAuthAPI(t)
+	api.createUser(t, "test@test.com")
+	api.createUser(t, "other@test.com")
+
+	_, tokens := api.login(t, "test@test.com", "password")
+	_, other := api.login(t, "other@test.com", "password")
+
+	w, _ := api.do(t, http.MethodPost, "/logout", bearer(tokens["token"]), gin.H{"refresh_token": other["refresh_token"]})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// The other user stays logged in
+	w, _ = api.do(t, http.MethodPost, "/me/refresh-token", nil, gin.H{"refresh_token": other["refresh_token"]})
+	assert.Equal(t, http.StatusOK, w.Code)
+	// while the user's own tokens are done with
+	w, _ = api.do(t, http.MethodPost, "/me/refresh-token", nil, gin.H{"refresh_token": tokens["refresh_token"]})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestLogOutEverywhereRevokesAPIKeys(t *testing.T) {
+	api := newTestAuthAPI(t)
+	user := api.createUser(t, "test@test.com")
+
+	_, tokens := api.login(t, "test@test.com", "password")
+	apiKey, err := models.CreateAPIKey(api.db, &models.APIKey{UserID: user.ID, Name: "ci", Scope: models.PermissionUsersRead})
+	assert.Nil(t, err)
+	w, _ := api.do(t, http.MethodGet, "/me/"+user.ID.String(), map[string]string{middleware.APIKeyHeader: apiKey}, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w, _ = api.do(t, http.MethodDelete, "/me/sessions", bearer(tokens["token"]), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Nothing issued before keeps working, API keys included
+	w, _ = api.do(t, http.MethodGet, "/me/"+user.ID.String(), map[string]string{middleware.APIKeyHeader: apiKey}, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w, _ = api.do(t, http.MethodPost, "/me/refresh-token", nil, gin.H{"refresh_token": tokens["refresh_token"]})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/aki-0517/go-user-management/migrations"
+	"github.com/aki-0517/go-user-management/models"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// setupTestDB connects to the same database as the models tests, in a schema
+// of its own so that the packages can be tested in parallel. Tests that need
+// it are skipped when the database is not running.
+func setupTestDB(t *testing.T) *gorm.DB {
+	connStr := "host=localhost port=5432 user=postgres password=password dbname=postgres sslmode=disable search_path=handlers_test,public"
+	db, err := gorm.Open(postgres.Open(connStr), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Skipf("database not available: %v", err)
+	}
+	if err := db.Exec(`CREATE EXTENSION IF NOT EXISTS "uuid-ossp" SCHEMA public;`).Error; err != nil {
+		t.Fatalf("failed to create uuid-ossp extension: %v", err)
+	}
+	if err := db.Exec(`CREATE SCHEMA IF NOT EXISTS handlers_test;`).Error; err != nil {
+		t.Fatalf("failed to create schema: %v", err)
+	}
+
+	m, err := migrations.New(db)
+	if err != nil {
+		t.Fatalf("failed to load migrations: %v", err)
+	}
+	if _, err := m.Up(); err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+	if err := models.SeedRoles(db); err != nil {
+		t.Fatalf("failed to seed roles: %v", err)
+	}
+	t.Cleanup(func() {
+		for {
+			reverted, err := m.Down()
+			if err != nil {
+				t.Fatalf("failed to revert migrations: %v", err)
+			}
+			if reverted == nil {
+				break
+			}
+		}
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return db
+}
@@ -0,0 +1,31 @@
+package handlers
+
+import (
+	"github.com/aki-0517/go-user-management/models"
+	"github.com/aki-0517/go-user-management/util"
+)
+
+// Errors reported by more than one handler. Handlers record errors with
+// c.Error and leave the response to middleware.Errors.
+var (
+	errForbidden                   = models.ForbiddenError("forbidden", "Forbidden")
+	errAPIKeyEmailChange           = models.ForbiddenError("api_key_not_allowed", "API keys cannot change the email address")
+	errEmailNotVerified            = models.ForbiddenError("email_not_verified", "Email address has not been verified")
+	errLoginLocked                 = models.RateLimitedError("login_locked", "Too many failed login attempts, try again later")
+	errInvalidCode                 = models.UnauthorizedError("invalid_code", "Invalid code")
+	errInvalidMFAToken             = models.UnauthorizedError("invalid_mfa_token", "Invalid or expired MFA token")
+	errInvalidRefreshToken         = models.UnauthorizedError("invalid_refresh_token", util.ErrInvalidRefreshToken.Error())
+	errInvalidOIDCResponse         = models.UnauthorizedError("invalid_identity_provider_response", util.ErrInvalidOIDCResponse.Error())
+	errPasskeyAuthenticationFailed = models.UnauthorizedError("passkey_authentication_failed", "Passkey authentication failed")
+	errCookieAuthDisabled          = models.ValidationError("cookie_auth_disabled", "Cookie mode is not enabled")
+	errInvalidResetToken           = models.ValidationError("invalid_reset_token", "Invalid or expired reset token")
+	errInvalidVerificationToken    = models.ValidationError("invalid_verification_token", util.ErrInvalidVerificationToken.Error())
+	errInvalidWebAuthnSession      = models.ValidationError("invalid_webauthn_session", util.ErrWebAuthnSessionNotFound.Error())
+	errTOTPAlreadyEnabled          = models.ConflictError("mfa_already_enabled", "Two-factor authentication is already enabled")
+	errUnknownProvider             = models.NotFoundError("unknown_identity_provider", "Unknown identity provider")
+)
+
+// invalidRequest reports a request body or query that could not be bound.
+func invalidRequest(err error) error {
+	return models.ValidationError("invalid_request", err.Error())
+}
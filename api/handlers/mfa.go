@@ -0,0 +1,256 @@
+package handlers
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aki-0517/go-user-management/middleware"
+	"github.com/aki-0517/go-user-management/models"
+	"github.com/aki-0517/go-user-management/util"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	purposeMFAPending = "mfa-pending"
+	// mfaPendingTTL is how long a user has to enter their code after the
+	// password step.
+	mfaPendingTTL = 5 * time.Minute
+	// totpReplayWindow covers every step a code is accepted in.
+	totpReplayWindow = 3 * 30 * time.Second
+)
+
+// respondWithMFAChallenge answers a successful password step of a user with
+// two-factor authentication enabled. The token it returns is exchanged for
+// access and refresh tokens at /login/mfa.
+func (h *AuthHandler) respondWithMFAChallenge(c *gin.Context, user *models.User) {
+	token, err := util.GeneratePurposeToken(h.Keys, purposeMFAPending, user.ID.String(), user.Email, mfaPendingTTL)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"mfa_required": true,
+		"mfa_token":    token,
+		"expires_in":   int(mfaPendingTTL.Seconds()),
+	})
+}
+
+// LoginMFAHandler completes a login with a TOTP or recovery code.
+func (h *AuthHandler) LoginMFAHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var mfaRequest struct {
+			MFAToken     string `json:"mfa_token" binding:"required"`
+			Code         string `json:"code"`
+			RecoveryCode string `json:"recovery_code"`
+		}
+		if err := c.ShouldBindJSON(&mfaRequest); err != nil {
+			c.Error(invalidRequest(err))
+			return
+		}
+
+		claims, err := util.ParsePurposeToken(h.Keys, purposeMFAPending, mfaRequest.MFAToken)
+		if err != nil {
+			c.Error(errInvalidMFAToken)
+			return
+		}
+		id, err := uuid.Parse(claims.Subject)
+		if err != nil {
+			c.Error(errInvalidMFAToken)
+			return
+		}
+		user, err := h.users.GetByID(id)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		if user == nil || !user.TOTPEnabled {
+			c.Error(errInvalidMFAToken)
+			return
+		}
+
+		// Codes are guessed far more easily than passwords, so failures
+		// count towards the same lockout.
+		ip := c.ClientIP()
+		wait, err := h.loginGuard.Check(user.Email, ip)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		if wait > 0 {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			c.Error(errLoginLocked)
+			return
+		}
+
+		// The pending token is claimed before the code is checked, so that
+		// a used token cannot consume a recovery code, and given back if the
+		// check fails, so that a mistyped code can be corrected.
+		first, err := util.MarkTokenUsed(h.rdb, claims.Id, mfaPendingTTL)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		if !first {
+			c.Error(errInvalidMFAToken)
+			return
+		}
+		ok, err := h.verifySecondFactor(user, mfaRequest.Code, mfaRequest.RecoveryCode)
+		if err != nil || !ok {
+			if err := util.ReleaseToken(h.rdb, claims.Id); err != nil {
+				c.Error(err)
+				return
+			}
+		}
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		if !ok {
+			if err := h.loginGuard.RecordFailure(user.Email, ip); err != nil {
+				c.Error(err)
+				return
+			}
+			c.Error(errInvalidCode)
+			return
+		}
+
+		if err := h.loginGuard.Reset(user.Email); err != nil {
+			c.Error(err)
+			return
+		}
+		h.completeLogin(c, user, wantsCookie(c))
+	}
+}
+
+// EnrollTOTPHandler starts TOTP enrollment of the current user. Two-factor
+// authentication only takes effect once confirmed with a code.
+func (h *AuthHandler) EnrollTOTPHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := middleware.CurrentUser(c)
+		if user.TOTPEnabled {
+			c.Error(errTOTPAlreadyEnabled)
+			return
+		}
+
+		secret, err := util.GenerateTOTPSecret()
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		if _, err := h.users.Update(user.ID, models.UserChanges{TOTPSecret: &secret}); err != nil {
+			c.Error(err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"secret":           secret,
+			"provisioning_uri": util.TOTPProvisioningURI(h.cfg.AppName, user.Email, secret),
+		})
+	}
+}
+
+// ConfirmTOTPHandler enables two-factor authentication once the user proves
+// their authenticator works, and hands out recovery codes. This is the only
+// time the recovery codes are shown.
+func (h *AuthHandler) ConfirmTOTPHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var confirmRequest struct {
+			Code string `json:"code" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&confirmRequest); err != nil {
+			c.Error(invalidRequest(err))
+			return
+		}
+
+		user := middleware.CurrentUser(c)
+		if user.TOTPEnabled {
+			c.Error(errTOTPAlreadyEnabled)
+			return
+		}
+		if user.TOTPSecret == "" {
+			c.Error(models.ValidationError("mfa_enrollment_not_started", "Two-factor enrollment has not been started"))
+			return
+		}
+
+		ok, err := h.verifyTOTP(user, confirmRequest.Code)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		if !ok {
+			c.Error(errInvalidCode)
+			return
+		}
+
+		codes, err := models.EnableTOTP(h.db, user)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"message":        "Two-factor authentication enabled",
+			"recovery_codes": codes,
+		})
+	}
+}
+
+// DisableTOTPHandler turns off two-factor authentication. A current code or
+// a recovery code is required so that a stolen access token is not enough.
+func (h *AuthHandler) DisableTOTPHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var disableRequest struct {
+			Code         string `json:"code"`
+			RecoveryCode string `json:"recovery_code"`
+		}
+		if err := c.ShouldBindJSON(&disableRequest); err != nil {
+			c.Error(invalidRequest(err))
+			return
+		}
+
+		user := middleware.CurrentUser(c)
+		if !user.TOTPEnabled {
+			c.Error(models.ValidationError("mfa_not_enabled", "Two-factor authentication is not enabled"))
+			return
+		}
+
+		ok, err := h.verifySecondFactor(user, disableRequest.Code, disableRequest.RecoveryCode)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		if !ok {
+			c.Error(errInvalidCode)
+			return
+		}
+
+		if err := models.DisableTOTP(h.db, user); err != nil {
+			c.Error(err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled"})
+	}
+}
+
+// verifySecondFactor accepts either a TOTP code or an unused recovery code of
+// user.
+func (h *AuthHandler) verifySecondFactor(user *models.User, code string, recoveryCode string) (bool, error) {
+	if code != "" {
+		return h.verifyTOTP(user, code)
+	}
+	if recoveryCode != "" {
+		return models.UseRecoveryCode(h.db, user.ID, recoveryCode)
+	}
+	return false, nil
+}
+
+// verifyTOTP checks code against the secret of user. Each code is accepted
+// only once, so one seen over the shoulder cannot be replayed.
+func (h *AuthHandler) verifyTOTP(user *models.User, code string) (bool, error) {
+	step, ok := util.ValidateTOTP(user.TOTPSecret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+	return util.MarkTokenUsed(h.rdb, "totp:"+user.ID.String()+":"+strconv.FormatInt(step, 10), totpReplayWindow)
+}
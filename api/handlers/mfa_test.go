@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aki-0517/go-user-management/models"
+	"github.com/aki-0517/go-user-management/util"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// createMFAUser creates a user with two-factor authentication enabled and
+// returns it with its recovery codes.
+func (api *testAuthAPI) createMFAUser(t *testing.T, email string) (*models.User, []string) {
+	user := api.createUser(t, email)
+	secret, err := util.GenerateTOTPSecret()
+	assert.Nil(t, err)
+	user, err = api.users.Update(user.ID, models.UserChanges{TOTPSecret: &secret})
+	assert.Nil(t, err)
+	codes, err := models.EnableTOTP(api.db, user)
+	assert.Nil(t, err)
+	return user, codes
+}
+
+// mfaToken logs in with the password of email and returns the pending
+// token to complete the login with.
+func (api *testAuthAPI) mfaToken(t *testing.T, email string) string {
+	w, body := api.login(t, email, "password")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, true, body["mfa_required"])
+	assert.Nil(t, body["token"])
+	token, _ := body["mfa_token"].(string)
+	return token
+}
+
+// waitOutBackoff lets the delay imposed by a failed attempt pass.
+func (api *testAuthAPI) waitOutBackoff() {
+	api.redis.FastForward(time.Minute)
+}
+
+func totpCode(t *testing.T, user *models.User, offset int64) string {
+	code, err := util.TOTPCode(user.TOTPSecret, util.TOTPStep(time.Now())+offset)
+	assert.Nil(t, err)
+	return code
+}
+
+func TestLoginMFAHandler(t *testing.T) {
+	api := newTestAuthAPI(t)
+	user, _ := api.createMFAUser(t, "test@test.com")
+	token := api.mfaToken(t, "test@test.com")
+
+	// A wrong code can be corrected with the same token
+	w, body := api.do(t, http.MethodPost, "/login/mfa", nil, gin.H{"mfa_token": token, "code": totpCode(t, user, 10)})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "invalid_code", body["code"])
+	api.waitOutBackoff()
+
+	code := totpCode(t, user, 0)
+	w, body = api.do(t, http.MethodPost, "/login/mfa", nil, gin.H{"mfa_token": token, "code": code})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotEmpty(t, body["token"])
+	assert.NotEmpty(t, body["refresh_token"])
+	w, _ = api.do(t, http.MethodGet, "/me/"+user.ID.String(), bearer(body["token"]), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Tokens are used once
+	w, body = api.do(t, http.MethodPost, "/login/mfa", nil, gin.H{"mfa_token": token, "code": totpCode(t, user, 0)})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "invalid_mfa_token", body["code"])
+
+	// So are codes, even with a new token
+	w, body = api.do(t, http.MethodPost, "/login/mfa", nil, gin.H{"mfa_token": api.mfaToken(t, "test@test.com"), "code": code})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "invalid_code", body["code"])
+
+	w, body = api.do(t, http.MethodPost, "/login/mfa", nil, gin.H{"mfa_token": "forged", "code": totpCode(t, user, 0)})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "invalid_mfa_token", body["code"])
+}
+
+func TestLoginMFAHandlerRecoveryCode(t *testing.T) {
+	api := newTestAuthAPI(t)
+	_, codes := api.createMFAUser(t, "test@test.com")
+	assert.NotEmpty(t, codes)
+
+	w, body := api.do(t, http.MethodPost, "/login/mfa", nil, gin.H{"mfa_token": api.mfaToken(t, "test@test.com"), "recovery_code": codes[0]})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotEmpty(t, body["token"])
+
+	// Recovery codes are used once
+	w, body = api.do(t, http.MethodPost, "/login/mfa", nil, gin.H{"mfa_token": api.mfaToken(t, "test@test.com"), "recovery_code": codes[0]})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "invalid_code", body["code"])
+	api.waitOutBackoff()
+
+	// A used token cannot consume another recovery code
+	token := api.mfaToken(t, "test@test.com")
+	w, _ = api.do(t, http.MethodPost, "/login/mfa", nil, gin.H{"mfa_token": token, "recovery_code": codes[1]})
+	assert.Equal(t, http.StatusOK, w.Code)
+	w, body = api.do(t, http.MethodPost, "/login/mfa", nil, gin.H{"mfa_token": token, "recovery_code": codes[2]})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "invalid_mfa_token", body["code"])
+	w, _ = api.do(t, http.MethodPost, "/login/mfa", nil, gin.H{"mfa_token": api.mfaToken(t, "test@test.com"), "recovery_code": codes[2]})
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestLoginMFAHandlerLockout(t *testing.T) {
+	api := newTestAuthAPI(t)
+	user, _ := api.createMFAUser(t, "test@test.com")
+	token := api.mfaToken(t, "test@test.com")
+
+	for i := 0; i < api.cfg.Login.MaxFailures; i++ {
+		w, body := api.do(t, http.MethodPost, "/login/mfa", nil, gin.H{"mfa_token": token, "code": totpCode(t, user, 10)})
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Equal(t, "invalid_code", body["code"])
+		api.waitOutBackoff()
+	}
+
+	// Once locked out even the right code is refused
+	w, body := api.do(t, http.MethodPost, "/login/mfa", nil, gin.H{"mfa_token": token, "code": totpCode(t, user, 0)})
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "login_locked", body["code"])
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+}
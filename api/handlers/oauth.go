@@ -0,0 +1,713 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aki-0517/go-user-management/config"
+	"github.com/aki-0517/go-user-management/middleware"
+	"github.com/aki-0517/go-user-management/models"
+	"github.com/aki-0517/go-user-management/util"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// OAuthHandler lets other applications obtain tokens for users of this
+// service, acting as an OAuth 2.0 authorization server and OpenID Connect
+// provider.
+type OAuthHandler struct {
+	cfg           *config.Config
+	db            *gorm.DB
+	users         models.UserRepository
+	Keys          *util.KeySet
+	blocklist     util.TokenBlocklist
+	codes         *util.AuthorizationCodeStore
+	refreshTokens *util.RefreshTokenStore
+}
+
+func OAuthHandlerInit(cfg *config.Config, db *gorm.DB, users models.UserRepository, keys *util.KeySet, rdb *redis.Client) *OAuthHandler {
+	return &OAuthHandler{
+		cfg:           cfg,
+		db:            db,
+		users:         users,
+		Keys:          keys,
+		blocklist:     util.NewRedisTokenBlocklist(rdb),
+		codes:         util.NewAuthorizationCodeStore(rdb),
+		refreshTokens: util.NewRefreshTokenStore(rdb, cfg.Tokens.RefreshTokenTTL),
+	}
+}
+
+// oauthError writes an error response as defined by RFC 6749 section 5.2.
+func oauthError(c *gin.Context, status int, code string, description string) {
+	if status == http.StatusUnauthorized {
+		c.Header("WWW-Authenticate", `Basic realm="oauth"`)
+	}
+	c.JSON(status, gin.H{"error": code, "error_description": description})
+}
+
+// RegisterClientHandler registers an OAuth client. The secret of confidential
+// clients is only part of this response.
+func (h *OAuthHandler) RegisterClientHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var registration struct {
+			Name         string   `json:"name" binding:"required"`
+			RedirectURIs []string `json:"redirect_uris"`
+			GrantTypes   []string `json:"grant_types" binding:"required"`
+			Scope        string   `json:"scope"`
+			Public       bool     `json:"public"`
+		}
+		if err := c.ShouldBindJSON(&registration); err != nil {
+			c.Error(invalidRequest(err))
+			return
+		}
+
+		client := models.OAuthClient{
+			Name:         registration.Name,
+			RedirectURIs: strings.Join(registration.RedirectURIs, " "),
+			GrantTypes:   strings.Join(registration.GrantTypes, " "),
+			Scope:        registration.Scope,
+		}
+		secret, err := models.CreateOAuthClient(h.db, &client, registration.Public)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		response := gin.H{
+			"client_id":     client.ClientID,
+			"name":          client.Name,
+			"redirect_uris": registration.RedirectURIs,
+			"grant_types":   registration.GrantTypes,
+			"scope":         client.Scope,
+		}
+		if secret != "" {
+			response["client_secret"] = secret
+		}
+		c.JSON(http.StatusCreated, response)
+	}
+}
+
+type authorizationRequest struct {
+	ResponseType        string `form:"response_type" json:"response_type"`
+	ClientID            string `form:"client_id" json:"client_id"`
+	RedirectURI         string `form:"redirect_uri" json:"redirect_uri"`
+	Scope               string `form:"scope" json:"scope"`
+	State               string `form:"state" json:"state"`
+	CodeChallenge       string `form:"code_challenge" json:"code_challenge"`
+	CodeChallengeMethod string `form:"code_challenge_method" json:"code_challenge_method"`
+	Nonce               string `form:"nonce" json:"nonce"`
+	// Approve is the user's answer to the consent prompt.
+	Approve bool `form:"approve" json:"approve"`
+}
+
+// validateAuthorizationRequest checks an authorization request of the
+// current user. Until the redirect URI is known to belong to the client,
+// errors are reported to the caller; after that they are returned to the
+// client by redirect, as RFC 6749 section 4.1.2.1 requires.
+func (h *OAuthHandler) validateAuthorizationRequest(c *gin.Context) (*authorizationRequest, *models.OAuthClient, bool) {
+	var request authorizationRequest
+	if err := c.ShouldBind(&request); err != nil {
+		oauthError(c, http.StatusBadRequest, "invalid_request", err.Error())
+		return nil, nil, false
+	}
+
+	client, err := models.GetOAuthClient(h.db, request.ClientID)
+	if err != nil {
+		oauthError(c, http.StatusInternalServerError, "server_error", "Error retrieving client")
+		return nil, nil, false
+	}
+	if client == nil {
+		oauthError(c, http.StatusBadRequest, "invalid_client", "Unknown client")
+		return nil, nil, false
+	}
+	if !client.HasRedirectURI(request.RedirectURI) {
+		oauthError(c, http.StatusBadRequest, "invalid_request", "redirect_uri is not registered for this client")
+		return nil, nil, false
+	}
+
+	if request.ResponseType != "code" {
+		h.redirectWithError(c, &request, "unsupported_response_type", "Only the code response type is supported")
+		return nil, nil, false
+	}
+	if !client.AllowsGrant(models.GrantAuthorizationCode) {
+		h.redirectWithError(c, &request, "unauthorized_client", "The client may not use the authorization code grant")
+		return nil, nil, false
+	}
+	if request.Scope == "" {
+		request.Scope = client.Scope
+	}
+	if !util.ScopeIncludes(client.Scope, request.Scope) {
+		h.redirectWithError(c, &request, "invalid_scope", "The client may not request this scope")
+		return nil, nil, false
+	}
+	if !h.cfg.OIDC.Enabled && util.ScopeIncludes(request.Scope, "openid") {
+		h.redirectWithError(c, &request, "invalid_scope", "OpenID Connect is not enabled")
+		return nil, nil, false
+	}
+	// Only S256 is accepted; "plain" would not protect against an
+	// intercepted authorization request.
+	if request.CodeChallenge != "" && request.CodeChallengeMethod != "S256" {
+		h.redirectWithError(c, &request, "invalid_request", "code_challenge_method must be S256")
+		return nil, nil, false
+	}
+	if client.IsPublic() && request.CodeChallenge == "" {
+		h.redirectWithError(c, &request, "invalid_request", "Public clients have to use PKCE")
+		return nil, nil, false
+	}
+	return &request, client, true
+}
+
+// respondWithRedirect tells the caller where to send the user's browser. The
+// authorization endpoints are called by the first-party frontend with the
+// user's access token, so they answer with JSON instead of a 302.
+func (h *OAuthHandler) respondWithRedirect(c *gin.Context, request *authorizationRequest, params url.Values) {
+	redirectURI, _ := url.Parse(request.RedirectURI)
+	query := redirectURI.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	if request.State != "" {
+		query.Set("state", request.State)
+	}
+	// The issuer identifies this server to clients (RFC 9207), which only
+	// know it from the discovery document when OpenID Connect is enabled.
+	if h.cfg.OIDC.Enabled {
+		query.Set("iss", h.cfg.OIDC.Issuer)
+	}
+	redirectURI.RawQuery = query.Encode()
+	c.JSON(http.StatusOK, gin.H{"redirect_to": redirectURI.String()})
+}
+
+func (h *OAuthHandler) redirectWithError(c *gin.Context, request *authorizationRequest, code string, description string) {
+	h.respondWithRedirect(c, request, url.Values{"error": {code}, "error_description": {description}})
+}
+
+func (h *OAuthHandler) redirectWithCode(c *gin.Context, request *authorizationRequest, user *models.User) {
+	code, err := h.codes.Issue(util.AuthorizationGrant{
+		ClientID:      request.ClientID,
+		Subject:       user.ID.String(),
+		RedirectURI:   request.RedirectURI,
+		Scope:         request.Scope,
+		CodeChallenge: request.CodeChallenge,
+		Nonce:         request.Nonce,
+	})
+	if err != nil {
+		h.redirectWithError(c, request, "server_error", "Error issuing authorization code")
+		return
+	}
+	h.respondWithRedirect(c, request, url.Values{"code": {code}})
+}
+
+// AuthorizeHandler validates an authorization request. If the user has
+// already consented to the requested scope the client gets a code right away;
+// otherwise the frontend is asked to prompt the user and post the answer to
+// ConsentHandler.
+func (h *OAuthHandler) AuthorizeHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		request, client, ok := h.validateAuthorizationRequest(c)
+		if !ok {
+			return
+		}
+
+		user := middleware.CurrentUser(c)
+		consented, err := models.HasOAuthConsent(h.db, user.ID, client.ClientID, request.Scope)
+		if err != nil {
+			h.redirectWithError(c, request, "server_error", "Error retrieving consent")
+			return
+		}
+		if consented {
+			h.redirectWithCode(c, request, user)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"consent_required": true,
+			"client": gin.H{
+				"client_id": client.ClientID,
+				"name":      client.Name,
+			},
+			"scope": request.Scope,
+		})
+	}
+}
+
+// ConsentHandler records the user's answer to a consent prompt and finishes
+// the authorization request.
+func (h *OAuthHandler) ConsentHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		request, client, ok := h.validateAuthorizationRequest(c)
+		if !ok {
+			return
+		}
+		if !request.Approve {
+			h.redirectWithError(c, request, "access_denied", "The user denied the request")
+			return
+		}
+
+		user := middleware.CurrentUser(c)
+		if err := models.GrantOAuthConsent(h.db, user.ID, client.ClientID, request.Scope); err != nil {
+			h.redirectWithError(c, request, "server_error", "Error saving consent")
+			return
+		}
+		h.redirectWithCode(c, request, user)
+	}
+}
+
+// authenticateClient identifies the client of a token, introspection or
+// revocation request by HTTP Basic authentication or form parameters.
+// Public clients only identify themselves.
+func (h *OAuthHandler) authenticateClient(c *gin.Context) (*models.OAuthClient, bool) {
+	clientID, secret, basic := c.Request.BasicAuth()
+	if basic {
+		// Credentials are form encoded before being put in the header
+		// (RFC 6749 section 2.3.1).
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID = c.PostForm("client_id")
+		secret = c.PostForm("client_secret")
+	}
+
+	client, err := models.GetOAuthClient(h.db, clientID)
+	if err != nil {
+		oauthError(c, http.StatusInternalServerError, "server_error", "Error retrieving client")
+		return nil, false
+	}
+	if client == nil || (client.IsPublic() && secret != "") || (!client.IsPublic() && !client.CheckSecret(secret)) {
+		oauthError(c, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+		return nil, false
+	}
+	return client, true
+}
+
+// TokenHandler is the token endpoint for the authorization code, client
+// credentials and refresh token grants.
+func (h *OAuthHandler) TokenHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Cache-Control", "no-store")
+		c.Header("Pragma", "no-cache")
+
+		client, ok := h.authenticateClient(c)
+		if !ok {
+			return
+		}
+
+		grantType := c.PostForm("grant_type")
+		switch grantType {
+		case models.GrantAuthorizationCode, models.GrantClientCredentials, models.GrantRefreshToken:
+		default:
+			oauthError(c, http.StatusBadRequest, "unsupported_grant_type", "Unsupported grant type")
+			return
+		}
+		if !client.AllowsGrant(grantType) {
+			oauthError(c, http.StatusBadRequest, "unauthorized_client", "The client may not use this grant type")
+			return
+		}
+
+		switch grantType {
+		case models.GrantAuthorizationCode:
+			h.exchangeAuthorizationCode(c, client)
+		case models.GrantClientCredentials:
+			h.issueClientCredentials(c, client)
+		case models.GrantRefreshToken:
+			h.refreshClientToken(c, client)
+		}
+	}
+}
+
+var errInvalidCodeVerifier = errors.New("Invalid code verifier")
+
+func (h *OAuthHandler) exchangeAuthorizationCode(c *gin.Context, client *models.OAuthClient) {
+	// The code is only redeemed by a request that matches the authorization
+	// request, so that nobody else can burn it.
+	redirectURI := c.PostForm("redirect_uri")
+	verifier := c.PostForm("code_verifier")
+	grant, err := h.codes.Consume(c.PostForm("code"), func(grant *util.AuthorizationGrant) error {
+		if grant.ClientID != client.ClientID || grant.RedirectURI != redirectURI {
+			return util.ErrInvalidAuthorizationCode
+		}
+		if (grant.CodeChallenge == "" && verifier != "") || (grant.CodeChallenge != "" && !util.VerifyPKCE(verifier, grant.CodeChallenge)) {
+			return errInvalidCodeVerifier
+		}
+		return nil
+	})
+	if errors.Is(err, util.ErrInvalidAuthorizationCode) || errors.Is(err, errInvalidCodeVerifier) {
+		oauthError(c, http.StatusBadRequest, "invalid_grant", err.Error())
+		return
+	} else if err != nil {
+		oauthError(c, http.StatusInternalServerError, "server_error", "Error redeeming code")
+		return
+	}
+
+	user, err := h.grantUser(grant.Subject)
+	if err != nil {
+		err.(*grantError).write(c)
+		return
+	}
+	var refreshToken string
+	if client.AllowsGrant(models.GrantRefreshToken) {
+		refreshToken, err = h.refreshTokens.IssueGrant(util.RefreshTokenGrant{
+			Subject:  user.ID.String(),
+			ClientID: client.ClientID,
+			Scope:    grant.Scope,
+		})
+		if err != nil {
+			oauthError(c, http.StatusInternalServerError, "server_error", "Error generating token")
+			return
+		}
+	}
+	idToken, err := h.idToken(user, client, grant.Scope, grant.Nonce)
+	if err != nil {
+		oauthError(c, http.StatusInternalServerError, "server_error", "Error generating token")
+		return
+	}
+	h.respondWithClientTokens(c, user.ID.String(), client, grant.Scope, refreshToken, idToken)
+}
+
+// issueClientCredentials lets a confidential client act on its own behalf.
+func (h *OAuthHandler) issueClientCredentials(c *gin.Context, client *models.OAuthClient) {
+	scope := c.PostForm("scope")
+	if scope == "" {
+		scope = client.Scope
+	}
+	if !util.ScopeIncludes(client.Scope, scope) {
+		oauthError(c, http.StatusBadRequest, "invalid_scope", "The client may not request this scope")
+		return
+	}
+	h.respondWithClientTokens(c, client.ClientID, client, scope, "", "")
+}
+
+func (h *OAuthHandler) refreshClientToken(c *gin.Context, client *models.OAuthClient) {
+	var user *models.User
+	scope := c.PostForm("scope")
+	// Scope and consent are checked before the token is used up, but after
+	// a replayed token has revoked its family.
+	grant, refreshToken, err := h.refreshTokens.RotateForClient(c.PostForm("refresh_token"), client.ClientID, func(grant *util.RefreshTokenGrant) error {
+		// A client may narrow the scope of the new access token, but never
+		// widen it.
+		if scope == "" {
+			scope = grant.Scope
+		}
+		if !util.ScopeIncludes(grant.Scope, scope) {
+			return &grantError{http.StatusBadRequest, "invalid_scope", "The requested scope exceeds the granted scope"}
+		}
+		var err error
+		user, err = h.grantUser(grant.Subject)
+		if err != nil {
+			return err
+		}
+		consented, err := models.HasOAuthConsent(h.db, user.ID, client.ClientID, grant.Scope)
+		if err != nil {
+			return &grantError{http.StatusInternalServerError, "server_error", "Error retrieving consent"}
+		}
+		if !consented {
+			return &grantError{http.StatusBadRequest, "invalid_grant", "The user has withdrawn consent"}
+		}
+		return nil
+	})
+	var grantErr *grantError
+	if errors.As(err, &grantErr) {
+		grantErr.write(c)
+		return
+	} else if errors.Is(err, util.ErrInvalidRefreshToken) || errors.Is(err, util.ErrRefreshTokenReused) {
+		oauthError(c, http.StatusBadRequest, "invalid_grant", err.Error())
+		return
+	} else if err != nil {
+		oauthError(c, http.StatusInternalServerError, "server_error", "Error refreshing token")
+		return
+	}
+	idToken, err := h.idToken(user, client, scope, "")
+	if err != nil {
+		oauthError(c, http.StatusInternalServerError, "server_error", "Error generating token")
+		return
+	}
+	h.respondWithClientTokens(c, grant.Subject, client, scope, refreshToken, idToken)
+}
+
+// grantError is an error response of the token endpoint found while checking
+// a grant.
+type grantError struct {
+	status      int
+	code        string
+	description string
+}
+
+func (e *grantError) Error() string {
+	return e.description
+}
+
+func (e *grantError) write(c *gin.Context) {
+	oauthError(c, e.status, e.code, e.description)
+}
+
+// grantUser returns the user a grant was issued for, as long as they still
+// exist. Errors are *grantError.
+func (h *OAuthHandler) grantUser(subject string) (*models.User, error) {
+	id, err := uuid.Parse(subject)
+	if err != nil {
+		return nil, &grantError{http.StatusBadRequest, "invalid_grant", "Unknown user"}
+	}
+	user, err := h.users.GetByID(id)
+	if err != nil {
+		return nil, &grantError{http.StatusInternalServerError, "server_error", "Error retrieving user"}
+	}
+	if user == nil {
+		return nil, &grantError{http.StatusBadRequest, "invalid_grant", "Unknown user"}
+	}
+	return user, nil
+}
+
+// idToken returns an ID token for OpenID Connect requests, i.e. those with
+// the openid scope, and "" for plain OAuth requests or if OpenID Connect is
+// not enabled.
+func (h *OAuthHandler) idToken(user *models.User, client *models.OAuthClient, scope string, nonce string) (string, error) {
+	if !h.cfg.OIDC.Enabled || !util.ScopeIncludes(scope, "openid") {
+		return "", nil
+	}
+	return util.GenerateIDToken(h.Keys, h.cfg.OIDC.Issuer, client.ClientID, user.UserInfo(scope), nonce)
+}
+
+func (h *OAuthHandler) respondWithClientTokens(c *gin.Context, subject string, client *models.OAuthClient, scope string, refreshToken string, idToken string) {
+	accessToken, err := util.GenerateOAuthToken(h.Keys, subject, client.ClientID, scope)
+	if err != nil {
+		oauthError(c, http.StatusInternalServerError, "server_error", "Error generating token")
+		return
+	}
+	response := gin.H{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(h.Keys.AccessTokenTTL.Seconds()),
+		"scope":        scope,
+	}
+	if refreshToken != "" {
+		response["refresh_token"] = refreshToken
+	}
+	if idToken != "" {
+		response["id_token"] = idToken
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// IntrospectHandler tells resource servers whether a token is active
+// (RFC 7662). Only confidential clients may ask.
+func (h *OAuthHandler) IntrospectHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		client, ok := h.authenticateClient(c)
+		if !ok {
+			return
+		}
+		if client.IsPublic() {
+			oauthError(c, http.StatusUnauthorized, "invalid_client", "Public clients cannot introspect tokens")
+			return
+		}
+
+		token := c.PostForm("token")
+		if c.PostForm("token_type_hint") != "refresh_token" {
+			claims, active, err := h.activeAccessToken(token)
+			if err != nil {
+				oauthError(c, http.StatusInternalServerError, "server_error", "Error introspecting token")
+				return
+			}
+			if active {
+				c.JSON(http.StatusOK, gin.H{
+					"active":     true,
+					"token_type": "Bearer",
+					"client_id":  claims.ClientID,
+					"scope":      claims.Scope,
+					"sub":        claims.Subject,
+					"iss":        claims.Issuer,
+					"aud":        claims.Audience,
+					"jti":        claims.Id,
+					"iat":        claims.IssuedAt,
+					"exp":        claims.ExpiresAt,
+				})
+				return
+			}
+		}
+
+		grant, err := h.refreshTokens.Lookup(token)
+		if err != nil && !errors.Is(err, util.ErrInvalidRefreshToken) {
+			oauthError(c, http.StatusInternalServerError, "server_error", "Error introspecting token")
+			return
+		}
+		// First-party refresh tokens are none of the clients' business.
+		if err != nil || grant.ClientID == "" {
+			c.JSON(http.StatusOK, gin.H{"active": false})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"active":     true,
+			"token_type": "refresh_token",
+			"client_id":  grant.ClientID,
+			"scope":      grant.Scope,
+			"sub":        grant.Subject,
+			"iss":        h.Keys.Issuer,
+		})
+	}
+}
+
+// activeAccessToken parses an access token issued to a client and checks it
+// has not been revoked.
+func (h *OAuthHandler) activeAccessToken(token string) (*util.OAuthClaims, bool, error) {
+	claims, err := util.ParseOAuthToken(h.Keys, token)
+	if err != nil {
+		return nil, false, nil
+	}
+	blocklisted, err := h.blocklist.IsBlocklisted(token)
+	if err != nil || blocklisted {
+		return nil, false, err
+	}
+	revokedAt, err := h.blocklist.SubjectRevokedAt(claims.Subject)
+	if err != nil {
+		return nil, false, err
+	}
+	if util.RevokedBy(claims.IssuedAtNano, revokedAt) {
+		return nil, false, nil
+	}
+	return claims, true, nil
+}
+
+// RevokeHandler lets a client revoke its own tokens (RFC 7009). Revoking a
+// refresh token ends its whole family. Unknown tokens are not an error.
+func (h *OAuthHandler) RevokeHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		client, ok := h.authenticateClient(c)
+		if !ok {
+			return
+		}
+
+		token := c.PostForm("token")
+		if claims, err := util.ParseOAuthToken(h.Keys, token); err == nil {
+			if claims.ClientID == client.ClientID {
+				expiration := time.Until(time.Unix(claims.ExpiresAt, 0))
+				if err := h.blocklist.Add(token, expiration); err != nil {
+					oauthError(c, http.StatusServiceUnavailable, "temporarily_unavailable", "Error revoking token")
+					return
+				}
+			}
+			c.Status(http.StatusOK)
+			return
+		}
+
+		grant, err := h.refreshTokens.Lookup(token)
+		if err != nil && !errors.Is(err, util.ErrInvalidRefreshToken) {
+			oauthError(c, http.StatusServiceUnavailable, "temporarily_unavailable", "Error revoking token")
+			return
+		}
+		if err == nil && grant.ClientID == client.ClientID {
+			if err := h.refreshTokens.Revoke(token); err != nil {
+				oauthError(c, http.StatusServiceUnavailable, "temporarily_unavailable", "Error revoking token")
+				return
+			}
+		}
+		c.Status(http.StatusOK)
+	}
+}
+
+// bearerError writes an error response for requests with an access token
+// as defined by RFC 6750 section 3.
+func bearerError(c *gin.Context, status int, code string, description string) {
+	c.Header("WWW-Authenticate", `Bearer error="`+code+`", error_description="`+description+`"`)
+	c.JSON(status, gin.H{"error": code, "error_description": description})
+}
+
+// UserInfoHandler returns the claims about the user an access token was
+// issued for, limited to the token's scope (OpenID Connect Core section 5.3).
+func (h *OAuthHandler) UserInfoHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, err := util.ExtractBearerToken(c.Request.Header.Get("Authorization"))
+		if err != nil {
+			bearerError(c, http.StatusUnauthorized, "invalid_token", "Access token required")
+			return
+		}
+		claims, active, err := h.activeAccessToken(token)
+		if err != nil {
+			oauthError(c, http.StatusServiceUnavailable, "temporarily_unavailable", "Error checking token")
+			return
+		}
+		if !active {
+			bearerError(c, http.StatusUnauthorized, "invalid_token", "Invalid access token")
+			return
+		}
+		if !util.ScopeIncludes(claims.Scope, "openid") {
+			bearerError(c, http.StatusForbidden, "insufficient_scope", "The openid scope is required")
+			return
+		}
+
+		// Tokens of the client credentials grant have the client as their
+		// subject, so there is no user to describe.
+		id, err := uuid.Parse(claims.Subject)
+		if err != nil {
+			bearerError(c, http.StatusUnauthorized, "invalid_token", "Invalid access token")
+			return
+		}
+		user, err := h.users.GetByID(id)
+		if err != nil {
+			oauthError(c, http.StatusInternalServerError, "server_error", "Error retrieving user")
+			return
+		}
+		if user == nil {
+			bearerError(c, http.StatusUnauthorized, "invalid_token", "Invalid access token")
+			return
+		}
+		c.JSON(http.StatusOK, user.UserInfo(claims.Scope))
+	}
+}
+
+// DiscoveryHandler serves the OpenID Connect discovery document, from which
+// client libraries learn the endpoints and keys of this provider.
+func (h *OAuthHandler) DiscoveryHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Cache-Control", "public, max-age=300")
+		c.JSON(http.StatusOK, gin.H{
+			"issuer":                                         h.cfg.OIDC.Issuer,
+			"authorization_endpoint":                         h.cfg.OIDC.AuthorizationURL,
+			"token_endpoint":                                 h.cfg.OIDC.Issuer + "/oauth/token",
+			"userinfo_endpoint":                              h.cfg.OIDC.Issuer + "/userinfo",
+			"jwks_uri":                                       h.cfg.OIDC.Issuer + "/.well-known/jwks.json",
+			"introspection_endpoint":                         h.cfg.OIDC.Issuer + "/oauth/introspect",
+			"revocation_endpoint":                            h.cfg.OIDC.Issuer + "/oauth/revoke",
+			"response_types_supported":                       []string{"code"},
+			"grant_types_supported":                          []string{models.GrantAuthorizationCode, models.GrantClientCredentials, models.GrantRefreshToken},
+			"subject_types_supported":                        []string{"public"},
+			"id_token_signing_alg_values_supported":          []string{h.Keys.Signer().Method().Alg()},
+			"scopes_supported":                               []string{"openid", "profile", "email"},
+			"claims_supported":                               []string{"sub", "iss", "aud", "exp", "iat", "nonce", "name", "email", "email_verified"},
+			"token_endpoint_auth_methods_supported":          []string{"client_secret_basic", "client_secret_post", "none"},
+			"code_challenge_methods_supported":               []string{"S256"},
+			"authorization_response_iss_parameter_supported": true,
+		})
+	}
+}
+
+// ListConsentsHandler lists the clients the current user has authorized.
+func (h *OAuthHandler) ListConsentsHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		consents, err := models.GetOAuthConsents(h.db, middleware.CurrentUser(c).ID)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		c.JSON(http.StatusOK, consents)
+	}
+}
+
+// RevokeConsentHandler withdraws the current user's consent for a client.
+func (h *OAuthHandler) RevokeConsentHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		revoked, err := models.RevokeOAuthConsent(h.db, middleware.CurrentUser(c).ID, c.Param("client_id"))
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		if !revoked {
+			c.Error(models.NotFoundError("consent_not_found", "Consent not found"))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Consent revoked"})
+	}
+}
@@ -0,0 +1,357 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/aki-0517/go-user-management/config"
+	"github.com/aki-0517/go-user-management/middleware"
+	"github.com/aki-0517/go-user-management/models"
+	"github.com/aki-0517/go-user-management/util"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+const testRedirectURI = "https://app.example.com/callback"
+
+type testOAuthAPI struct {
+	router *gin.Engine
+	db     *gorm.DB
+	users  models.UserRepository
+	keys   *util.KeySet
+}
+
+// newTestOAuthAPI serves the OAuth routes from the test database, with Redis
+// replaced by miniredis.
+func newTestOAuthAPI(t *testing.T) *testOAuthAPI {
+	gin.SetMode(gin.TestMode)
+	db := setupTestDB(t)
+
+	cfg := config.Default()
+	cfg.Password.BcryptCost = bcrypt.MinCost
+	rdb := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	keys := util.NewKeySet(util.NewHMACSigner("test", []byte("test_key")), util.DefaultKeyGracePeriod)
+	users := models.NewGormUserRepository(db)
+	oh := OAuthHandlerInit(cfg, db, users, keys, rdb)
+
+	m := middleware.NewMiddleware(keys, util.NewRedisTokenBlocklist(rdb), false, false, func(subject string) (*models.User, error) {
+		id, err := uuid.Parse(subject)
+		if err != nil {
+			return nil, nil
+		}
+		return users.GetByID(id)
+	}, func(key string) (*models.APIKey, error) {
+		return models.AuthenticateAPIKey(db, key)
+	}, func(sessionID string) (bool, error) {
+		return true, nil
+	})
+
+	r := gin.New()
+	r.Use(middleware.Errors())
+	r.GET("/oauth/authorize", m.AuthenticateMiddleware(), m.RejectAPIKeys(), oh.AuthorizeHandler())
+	r.POST("/oauth/authorize", m.AuthenticateMiddleware(), m.RejectAPIKeys(), oh.ConsentHandler())
+	r.POST("/oauth/token", oh.TokenHandler())
+	r.POST("/oauth/introspect", oh.IntrospectHandler())
+	r.POST("/oauth/revoke", oh.RevokeHandler())
+	return &testOAuthAPI{router: r, db: db, users: users, keys: keys}
+}
+
+func (api *testOAuthAPI) createUser(t *testing.T, email string) *models.User {
+	user, err := api.users.Create(models.User{Name: "test", Email: email, Password: "password"}, bcrypt.MinCost)
+	assert.Nil(t, err)
+	return user
+}
+
+// registerClient registers a client for the authorization code and refresh
+// token grants and returns it with its secret, which public clients lack.
+func (api *testOAuthAPI) registerClient(t *testing.T, public bool) (*models.OAuthClient, string) {
+	client := models.OAuthClient{
+		Name:         "app",
+		RedirectURIs: testRedirectURI,
+		GrantTypes:   models.GrantAuthorizationCode + " " + models.GrantRefreshToken,
+		Scope:        "profile email",
+	}
+	secret, err := models.CreateOAuthClient(api.db, &client, public)
+	assert.Nil(t, err)
+	return &client, secret
+}
+
+// authorize sends an authorization request of user and returns the decoded
+// response.
+func (api *testOAuthAPI) authorize(t *testing.T, method string, user *models.User, request gin.H) (*httptest.ResponseRecorder, map[string]interface{}) {
+	var payload bytes.Buffer
+	assert.Nil(t, json.NewEncoder(&payload).Encode(request))
+	req, _ := http.NewRequest(method, "/oauth/authorize", &payload)
+	req.Header.Set("Content-Type", "application/json")
+	token, err := util.GenerateToken(api.keys, user.ID.String(), user.RoleNames())
+	assert.Nil(t, err)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	api.router.ServeHTTP(w, req)
+
+	var body map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	return w, body
+}
+
+// authorizeCode approves the client for user and returns the query of the
+// redirect back to the client.
+func (api *testOAuthAPI) authorizeCode(t *testing.T, user *models.User, client *models.OAuthClient, codeChallenge string) url.Values {
+	request := gin.H{
+		"response_type": "code",
+		"client_id":     client.ClientID,
+		"redirect_uri":  testRedirectURI,
+		"scope":         "profile",
+		"state":         "state",
+		"approve":       true,
+	}
+	if codeChallenge != "" {
+		request["code_challenge"] = codeChallenge
+		request["code_challenge_method"] = "S256"
+	}
+	w, body := api.authorize(t, http.MethodPost, user, request)
+	assert.Equal(t, http.StatusOK, w.Code)
+	redirectTo, _ := body["redirect_to"].(string)
+	assert.True(t, strings.HasPrefix(redirectTo, testRedirectURI+"?"))
+	redirect, err := url.Parse(redirectTo)
+	assert.Nil(t, err)
+	return redirect.Query()
+}
+
+// post sends a form to an endpoint authenticated as client.
+func (api *testOAuthAPI) post(t *testing.T, path string, client *models.OAuthClient, secret string, form url.Values) (*httptest.ResponseRecorder, map[string]interface{}) {
+	if secret == "" {
+		form.Set("client_id", client.ClientID)
+	}
+	req, _ := http.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if secret != "" {
+		req.SetBasicAuth(client.ClientID, secret)
+	}
+	w := httptest.NewRecorder()
+	api.router.ServeHTTP(w, req)
+
+	var body map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	return w, body
+}
+
+func TestOAuthRefreshTokenReuse(t *testing.T) {
+	api := newTestOAuthAPI(t)
+	user := api.createUser(t, "test@test.com")
+	client, secret := api.registerClient(t, false)
+
+	redirect := api.authorizeCode(t, user, client, "")
+	w, tokens := api.post(t, "/oauth/token", client, secret, url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {redirect.Get("code")},
+		"redirect_uri": {testRedirectURI},
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	refreshToken, _ := tokens["refresh_token"].(string)
+	assert.NotEmpty(t, refreshToken)
+
+	w, rotated := api.post(t, "/oauth/token", client, secret, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refreshToken}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	rotatedToken, _ := rotated["refresh_token"].(string)
+	assert.NotEmpty(t, rotatedToken)
+	assert.NotEqual(t, refreshToken, rotatedToken)
+
+	// Replaying the rotated token is detected
+	w, body := api.post(t, "/oauth/token", client, secret, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refreshToken}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "invalid_grant", body["error"])
+
+	// and revokes the whole family, including the legitimate successor
+	w, body = api.post(t, "/oauth/token", client, secret, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {rotatedToken}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "invalid_grant", body["error"])
+}
+
+func TestOAuthAuthorizeHandler(t *testing.T) {
+	api := newTestOAuthAPI(t)
+	user := api.createUser(t, "test@test.com")
+	client, _ := api.registerClient(t, false)
+	request := gin.H{
+		"response_type": "code",
+		"client_id":     client.ClientID,
+		"redirect_uri":  testRedirectURI,
+		"scope":         "profile",
+		"state":         "state",
+	}
+
+	// The user is asked first
+	w, body := api.authorize(t, http.MethodGet, user, request)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, true, body["consent_required"])
+	assert.Equal(t, "profile", body["scope"])
+
+	// Denying consent is reported to the client
+	request["approve"] = false
+	w, body = api.authorize(t, http.MethodPost, user, request)
+	assert.Equal(t, http.StatusOK, w.Code)
+	redirect, _ := url.Parse(body["redirect_to"].(string))
+	assert.Equal(t, "access_denied", redirect.Query().Get("error"))
+	assert.Equal(t, "state", redirect.Query().Get("state"))
+	// OpenID Connect is disabled, so no issuer is announced
+	assert.False(t, redirect.Query().Has("iss"))
+
+	// Once the user has consented, later requests get a code right away
+	api.authorizeCode(t, user, client, "")
+	delete(request, "approve")
+	w, body = api.authorize(t, http.MethodGet, user, request)
+	assert.Equal(t, http.StatusOK, w.Code)
+	redirect, _ = url.Parse(body["redirect_to"].(string))
+	assert.NotEmpty(t, redirect.Query().Get("code"))
+
+	// Unregistered redirect URIs are never redirected to
+	request["redirect_uri"] = "https://evil.example.com/callback"
+	w, body = api.authorize(t, http.MethodGet, user, request)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "invalid_request", body["error"])
+
+	// Scopes beyond the client's are refused
+	request["redirect_uri"] = testRedirectURI
+	request["scope"] = "admin"
+	_, body = api.authorize(t, http.MethodGet, user, request)
+	redirect, _ = url.Parse(body["redirect_to"].(string))
+	assert.Equal(t, "invalid_scope", redirect.Query().Get("error"))
+}
+
+func TestOAuthCodeExchangeWithPKCE(t *testing.T) {
+	api := newTestOAuthAPI(t)
+	user := api.createUser(t, "test@test.com")
+	client, _ := api.registerClient(t, true)
+
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	sum := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	// Public clients have to use PKCE
+	_, body := api.authorize(t, http.MethodPost, user, gin.H{
+		"response_type": "code",
+		"client_id":     client.ClientID,
+		"redirect_uri":  testRedirectURI,
+		"approve":       true,
+	})
+	redirect, _ := url.Parse(body["redirect_to"].(string))
+	assert.Equal(t, "invalid_request", redirect.Query().Get("error"))
+
+	code := api.authorizeCode(t, user, client, challenge).Get("code")
+	exchange := func(verifier string) (*httptest.ResponseRecorder, map[string]interface{}) {
+		return api.post(t, "/oauth/token", client, "", url.Values{
+			"grant_type":    {"authorization_code"},
+			"code":          {code},
+			"redirect_uri":  {testRedirectURI},
+			"code_verifier": {verifier},
+		})
+	}
+
+	// A wrong verifier does not use the code up
+	w, body := exchange("wrong-verifier")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "invalid_grant", body["error"])
+
+	w, body = exchange(verifier)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotEmpty(t, body["access_token"])
+	assert.NotEmpty(t, body["refresh_token"])
+	assert.Equal(t, "profile", body["scope"])
+	assert.Nil(t, body["id_token"])
+
+	// Codes are redeemed once
+	w, body = exchange(verifier)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "invalid_grant", body["error"])
+}
+
+func TestOAuthRefreshToken(t *testing.T) {
+	api := newTestOAuthAPI(t)
+	user := api.createUser(t, "test@test.com")
+	client, secret := api.registerClient(t, false)
+	other, otherSecret := api.registerClient(t, false)
+
+	code := api.authorizeCode(t, user, client, "").Get("code")
+	_, tokens := api.post(t, "/oauth/token", client, secret, url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {testRedirectURI}})
+	refreshToken := tokens["refresh_token"].(string)
+
+	// Refresh tokens only work for the client they were issued to
+	w, body := api.post(t, "/oauth/token", other, otherSecret, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refreshToken}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "invalid_grant", body["error"])
+
+	// and cannot widen the granted scope, which leaves them usable
+	w, body = api.post(t, "/oauth/token", client, secret, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refreshToken}, "scope": {"profile email"}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "invalid_scope", body["error"])
+
+	w, body = api.post(t, "/oauth/token", client, secret, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refreshToken}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotEmpty(t, body["access_token"])
+	assert.Equal(t, "profile", body["scope"])
+	assert.NotEqual(t, refreshToken, body["refresh_token"])
+}
+
+func TestOAuthIntrospectAndRevoke(t *testing.T) {
+	api := newTestOAuthAPI(t)
+	user := api.createUser(t, "test@test.com")
+	client, secret := api.registerClient(t, false)
+	public, _ := api.registerClient(t, true)
+
+	code := api.authorizeCode(t, user, client, "").Get("code")
+	_, tokens := api.post(t, "/oauth/token", client, secret, url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {testRedirectURI}})
+	accessToken := tokens["access_token"].(string)
+	refreshToken := tokens["refresh_token"].(string)
+
+	w, body := api.post(t, "/oauth/introspect", client, secret, url.Values{"token": {accessToken}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, true, body["active"])
+	assert.Equal(t, client.ClientID, body["client_id"])
+	assert.Equal(t, user.ID.String(), body["sub"])
+	assert.Equal(t, "profile", body["scope"])
+
+	_, body = api.post(t, "/oauth/introspect", client, secret, url.Values{"token": {refreshToken}, "token_type_hint": {"refresh_token"}})
+	assert.Equal(t, true, body["active"])
+	assert.Equal(t, "refresh_token", body["token_type"])
+
+	// Only confidential clients may introspect
+	w, body = api.post(t, "/oauth/introspect", public, "", url.Values{"token": {accessToken}})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "invalid_client", body["error"])
+
+	// Clients cannot revoke the tokens of others
+	w, _ = api.post(t, "/oauth/revoke", public, "", url.Values{"token": {accessToken}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	_, body = api.post(t, "/oauth/introspect", client, secret, url.Values{"token": {accessToken}})
+	assert.Equal(t, true, body["active"])
+
+	// but their own
+	w, _ = api.post(t, "/oauth/revoke", client, secret, url.Values{"token": {accessToken}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	_, body = api.post(t, "/oauth/introspect", client, secret, url.Values{"token": {accessToken}})
+	assert.Equal(t, false, body["active"])
+
+	w, _ = api.post(t, "/oauth/revoke", client, secret, url.Values{"token": {refreshToken}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	_, body = api.post(t, "/oauth/introspect", client, secret, url.Values{"token": {refreshToken}, "token_type_hint": {"refresh_token"}})
+	assert.Equal(t, false, body["active"])
+	w, body = api.post(t, "/oauth/token", client, secret, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refreshToken}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "invalid_grant", body["error"])
+
+	// Unknown tokens are not an error
+	w, _ = api.post(t, "/oauth/revoke", client, secret, url.Values{"token": {"unknown"}})
+	assert.Equal(t, http.StatusOK, w.Code)
+}
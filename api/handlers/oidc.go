@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+
+	"github.com/aki-0517/go-user-management/middleware"
+	"github.com/aki-0517/go-user-management/models"
+	"github.com/aki-0517/go-user-management/util"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// oidcSessionKey holds the pending login in the session between the
+// redirect to the provider and the callback.
+const oidcSessionKey = "oidc_login"
+
+type oidcPendingLogin struct {
+	Provider string `json:"provider"`
+	// Cookie is set if the login was started in cookie mode.
+	Cookie bool `json:"cookie,omitempty"`
+	util.OIDCLoginState
+}
+
+// OIDCLoginHandler redirects to the identity provider in the path.
+func (h *AuthHandler) OIDCLoginHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		provider, ok := h.oidcProviders[c.Param("provider")]
+		if !ok {
+			c.Error(errUnknownProvider)
+			return
+		}
+
+		login, err := util.NewOIDCLoginState()
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		value, err := json.Marshal(oidcPendingLogin{Provider: provider.Name, Cookie: wantsCookie(c), OIDCLoginState: *login})
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		session := sessions.DefaultMany(c, middleware.StateSessionName)
+		session.Set(oidcSessionKey, string(value))
+		if err := session.Save(); err != nil {
+			c.Error(err)
+			return
+		}
+		c.Redirect(http.StatusFound, provider.AuthCodeURL(login))
+	}
+}
+
+// OIDCCallbackHandler finishes a login at an identity provider and responds
+// like LoginHandler.
+func (h *AuthHandler) OIDCCallbackHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		provider, ok := h.oidcProviders[c.Param("provider")]
+		if !ok {
+			c.Error(errUnknownProvider)
+			return
+		}
+
+		// The pending login is consumed whatever the outcome, so that a
+		// callback cannot be replayed.
+		session := sessions.DefaultMany(c, middleware.StateSessionName)
+		value, _ := session.Get(oidcSessionKey).(string)
+		session.Delete(oidcSessionKey)
+		if err := session.Save(); err != nil {
+			c.Error(err)
+			return
+		}
+
+		// Checking the state against the session defeats login CSRF, where
+		// a victim is made to finish a login the attacker started.
+		var login oidcPendingLogin
+		if err := json.Unmarshal([]byte(value), &login); err != nil ||
+			login.Provider != provider.Name ||
+			subtle.ConstantTimeCompare([]byte(login.State), []byte(c.Query("state"))) != 1 {
+			c.Error(models.ValidationError("invalid_login_state", "Invalid login state"))
+			return
+		}
+		if c.Query("error") != "" {
+			c.Error(models.UnauthorizedError("identity_provider_denied", "Login was denied by the identity provider"))
+			return
+		}
+
+		identity, err := provider.Exchange(c.Request.Context(), c.Query("code"), &login.OIDCLoginState)
+		if err != nil {
+			c.Error(errInvalidOIDCResponse)
+			return
+		}
+
+		user, err := models.ResolveIdentity(h.db, h.users, provider.Name, *identity, h.cfg.Password.BcryptCost)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		if user == nil {
+			c.Error(errInvalidOIDCResponse)
+			return
+		}
+
+		if h.cfg.RequireEmailVerification && !user.IsEmailVerified() {
+			c.Error(errEmailNotVerified)
+			return
+		}
+		if user.TOTPEnabled {
+			h.respondWithMFAChallenge(c, user)
+			return
+		}
+		h.completeLogin(c, user, login.Cookie)
+	}
+}
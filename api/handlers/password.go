@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/aki-0517/go-user-management/models"
+	"github.com/aki-0517/go-user-management/util"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const passwordResetTTL = time.Hour
+
+// The same answer is given whether or not the account exists.
+const passwordResetRequested = "If an account with this email exists, a password reset link has been sent"
+
+func (h *AuthHandler) ForgotPasswordHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var forgotRequest struct {
+			Email string `json:"email" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&forgotRequest); err != nil {
+			c.Error(invalidRequest(err))
+			return
+		}
+
+		// Limiting by IP reveals nothing about accounts, so it can be
+		// reported to the caller.
+		result, err := h.rateLimits.Allow("password_reset:"+util.KeyByIP(c), h.cfg.RateLimit.PasswordResetsPerIP, time.Hour)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		if !result.Allowed {
+			c.Error(models.ErrRateLimited)
+			return
+		}
+
+		email := models.NormalizeEmail(forgotRequest.Email)
+		result, err = h.rateLimits.Allow("password_reset:email:"+email, h.cfg.RateLimit.PasswordResetsPerEmail, time.Hour)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		if !result.Allowed {
+			c.JSON(http.StatusAccepted, gin.H{"message": passwordResetRequested})
+			return
+		}
+
+		user, err := h.users.GetByEmail(forgotRequest.Email)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		if user == nil {
+			c.JSON(http.StatusAccepted, gin.H{"message": passwordResetRequested})
+			return
+		}
+
+		// Storing the token and sending the email happen in the background,
+		// so that the response for existing accounts takes no longer than
+		// for unknown ones.
+		h.background.Add(1)
+		go func() {
+			defer h.background.Done()
+			h.sendPasswordReset(user.ID, user.Email)
+		}()
+		c.JSON(http.StatusAccepted, gin.H{"message": passwordResetRequested})
+	}
+}
+
+// sendPasswordReset emails the user a link to reset their password. Errors
+// are only logged, as the request has already been answered.
+func (h *AuthHandler) sendPasswordReset(userID uuid.UUID, email string) {
+	token, err := models.CreatePasswordResetToken(h.db, userID, passwordResetTTL)
+	if err != nil {
+		log.Printf("failed to create password reset token for user %s: %v", userID, err)
+		return
+	}
+	// The link opens the frontend, which posts the new password together
+	// with the token.
+	link, _ := url.Parse(h.cfg.Password.ResetURL)
+	query := link.Query()
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+	err = h.mailer.Send(util.Message{
+		To:      email,
+		Subject: "Reset your password",
+		Body: "Open the following link to choose a new password:\n\n" +
+			link.String() +
+			"\n\nThe link expires in one hour. If you did not ask to reset your password, you can ignore this email.\n",
+	})
+	if err != nil {
+		log.Printf("failed to send password reset email to user %s: %v", userID, err)
+	}
+}
+
+func (h *AuthHandler) ResetPasswordHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var resetRequest struct {
+			Token       string `json:"token" binding:"required"`
+			NewPassword string `json:"new_password" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&resetRequest); err != nil {
+			c.Error(invalidRequest(err))
+			return
+		}
+
+		hashedPassword, err := util.HashPassword(resetRequest.NewPassword, h.cfg.Password.BcryptCost)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		// The token is only used up once the password has been changed and
+		// whoever may have known the old one is no longer logged in, nor
+		// keeps the API keys they could have created with it.
+		resetToken, err := models.ResetPassword(h.db, resetRequest.Token, hashedPassword, func(tx *gorm.DB, userID uuid.UUID) error {
+			if err := models.RevokeAPIKeys(tx, userID); err != nil {
+				return err
+			}
+			return h.revokeAllTokens(tx, userID)
+		})
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		if resetToken == nil {
+			c.Error(errInvalidResetToken)
+			return
+		}
+
+		// Following the emailed link proves control of the account.
+		user, err := h.users.GetByID(resetToken.UserID)
+		if err == nil && user != nil {
+			err = h.loginGuard.Unlock(user.Email)
+		}
+		if err != nil {
+			log.Printf("failed to unlock user %s after password reset: %v", resetToken.UserID, err)
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Password has been reset"})
+	}
+}
+
+// revokeAllTokens ends every session of the user in db and invalidates all
+// their access and refresh tokens.
+func (h *AuthHandler) revokeAllTokens(db *gorm.DB, userID uuid.UUID) error {
+	if err := models.RevokeSessions(db, userID); err != nil {
+		return err
+	}
+	if err := h.blocklist.RevokeSubject(userID.String(), h.Keys.AccessTokenTTL); err != nil {
+		return err
+	}
+	return h.refreshTokens.RevokeSubject(userID.String())
+}
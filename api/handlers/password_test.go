@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"testing"
+
+	"github.com/aki-0517/go-user-management/middleware"
+	"github.com/aki-0517/go-user-management/models"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+var resetLink = regexp.MustCompile(`http://localhost:8080/reset-password\?token=([^\s&]+)`)
+
+// forgotPassword asks for a reset link and waits until it has been sent.
+func (api *testAuthAPI) forgotPassword(t *testing.T, email string) {
+	w, body := api.do(t, http.MethodPost, "/password/forgot", nil, gin.H{"email": email})
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Equal(t, passwordResetRequested, body["message"])
+	api.background.Wait()
+}
+
+func TestForgotPasswordHandler(t *testing.T) {
+	api := newTestAuthAPI(t)
+	api.createUser(t, "test@test.com")
+
+	// Unknown addresses get the same answer, but no email
+	api.forgotPassword(t, "unknown@test.com")
+	assert.Empty(t, api.mailer.Messages())
+
+	// Addresses are matched however they are written
+	api.forgotPassword(t, " Test@Test.com ")
+	messages := api.mailer.Messages()
+	assert.Len(t, messages, 1)
+	assert.Equal(t, "test@test.com", messages[0].To)
+	assert.Regexp(t, resetLink, messages[0].Body)
+
+	// Only a few emails are sent per address, without telling the caller
+	api.forgotPassword(t, "test@test.com")
+	api.forgotPassword(t, "TEST@test.com")
+	api.forgotPassword(t, "test@test.com")
+	assert.Len(t, api.mailer.Messages(), api.cfg.RateLimit.PasswordResetsPerEmail)
+
+	w, _ := api.do(t, http.MethodPost, "/password/forgot", nil, gin.H{})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestResetPasswordHandler(t *testing.T) {
+	api := newTestAuthAPI(t)
+	user := api.createUser(t, "test@test.com")
+
+	w, tokens := api.login(t, "test@test.com", "password")
+	assert.Equal(t, http.StatusOK, w.Code)
+	apiKey, err := models.CreateAPIKey(api.db, &models.APIKey{UserID: user.ID, Name: "ci", Scope: models.PermissionUsersRead})
+	assert.Nil(t, err)
+	w, _ = api.do(t, http.MethodGet, "/me/"+user.ID.String(), map[string]string{middleware.APIKeyHeader: apiKey}, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	api.forgotPassword(t, "test@test.com")
+	match := resetLink.FindStringSubmatch(api.mailer.Messages()[0].Body)
+	assert.Len(t, match, 2)
+	token, _ := url.QueryUnescape(match[1])
+
+	// Unknown tokens are rejected
+	w, body := api.do(t, http.MethodPost, "/password/reset", nil, gin.H{"token": "unknown", "new_password": "changed"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "invalid_reset_token", body["code"])
+
+	// A reset that fails leaves the password and the token as they were
+	api.redis.SetError("unavailable")
+	w, _ = api.do(t, http.MethodPost, "/password/reset", nil, gin.H{"token": token, "new_password": "changed"})
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	api.redis.SetError("")
+	w, _ = api.login(t, "test@test.com", "password")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w, _ = api.do(t, http.MethodPost, "/password/reset", nil, gin.H{"token": token, "new_password": "changed"})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w, _ = api.login(t, "test@test.com", "password")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w, _ = api.login(t, "test@test.com", "changed")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Tokens are used once
+	w, body = api.do(t, http.MethodPost, "/password/reset", nil, gin.H{"token": token, "new_password": "again"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "invalid_reset_token", body["code"])
+
+	// Everything obtained with the old password has been revoked
+	w, _ = api.do(t, http.MethodGet, "/me/"+user.ID.String(), bearer(tokens["token"]), nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w, _ = api.do(t, http.MethodPost, "/me/refresh-token", nil, gin.H{"refresh_token": tokens["refresh_token"]})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w, _ = api.do(t, http.MethodGet, "/me/"+user.ID.String(), map[string]string{middleware.APIKeyHeader: apiKey}, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
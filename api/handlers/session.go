@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/aki-0517/go-user-management/middleware"
+	"github.com/aki-0517/go-user-management/models"
+	"github.com/aki-0517/go-user-management/util"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// touchSession records that the session with sessionID was used. It writes
+// a 401 response and returns false if the session is over.
+func (h *AuthHandler) touchSession(c *gin.Context, sessionID string) bool {
+	id, err := uuid.Parse(sessionID)
+	if err != nil {
+		c.Error(errInvalidRefreshToken)
+		return false
+	}
+	session, err := models.GetActiveSession(h.db, id, h.cfg.Tokens.RefreshTokenTTL)
+	if err != nil {
+		c.Error(err)
+		return false
+	}
+	if session == nil {
+		c.Error(errInvalidRefreshToken)
+		return false
+	}
+	if err := models.TouchSession(h.db, session, c.ClientIP()); err != nil {
+		c.Error(err)
+		return false
+	}
+	return true
+}
+
+// endSession revokes a session of the user together with its tokens. It
+// returns false if there was no such session.
+func (h *AuthHandler) endSession(userID uuid.UUID, id uuid.UUID) (bool, error) {
+	revoked, err := models.RevokeSession(h.db, userID, id)
+	if err != nil || !revoked {
+		return false, err
+	}
+	if err := h.blocklist.RevokeSubject(util.SessionSubject(id.String()), h.Keys.AccessTokenTTL); err != nil {
+		return false, err
+	}
+	return true, h.refreshTokens.RevokeFamily(id.String())
+}
+
+// ListSessionsHandler lists the devices the current user is logged in on.
+func (h *AuthHandler) ListSessionsHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sessions, err := models.GetActiveSessions(h.db, middleware.CurrentUser(c).ID, h.cfg.Tokens.RefreshTokenTTL)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		currentID := middleware.CurrentSessionID(c)
+		response := make([]gin.H, 0, len(sessions))
+		for _, session := range sessions {
+			response = append(response, gin.H{
+				"id":           session.ID,
+				"user_agent":   session.UserAgent,
+				"ip":           session.IP,
+				"created_at":   session.CreatedAt,
+				"last_seen_at": session.LastSeenAt,
+				"current":      session.ID.String() == currentID,
+			})
+		}
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+// RevokeSessionHandler logs the current user out on one device.
+func (h *AuthHandler) RevokeSessionHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := uuidParam(c, "session_id")
+		if !ok {
+			return
+		}
+		revoked, err := h.endSession(middleware.CurrentUser(c).ID, id)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		if !revoked {
+			c.Error(models.NotFoundError("session_not_found", "Session not found"))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Session revoked"})
+	}
+}
+
+// LogOutEverywhereHandler ends every session of the current user and
+// invalidates all their tokens, including the one of this request, and
+// their API keys.
+func (h *AuthHandler) LogOutEverywhereHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := middleware.CurrentUser(c).ID
+		err := h.db.Transaction(func(tx *gorm.DB) error {
+			if err := models.RevokeAPIKeys(tx, userID); err != nil {
+				return err
+			}
+			return h.revokeAllTokens(tx, userID)
+		})
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		if middleware.IsCookieAuthenticated(c) && h.cookieOptions != nil {
+			if err := middleware.EndCookieSession(c, *h.cookieOptions); err != nil {
+				c.Error(err)
+				return
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Logged out everywhere"})
+	}
+}
+
+// endCookieSession ends the session of a cookie authenticated request and
+// removes the cookie.
+func (h *AuthHandler) endCookieSession(c *gin.Context) error {
+	id, err := uuid.Parse(middleware.CurrentSessionID(c))
+	if err != nil {
+		return err
+	}
+	if _, err := h.endSession(middleware.CurrentUser(c).ID, id); err != nil {
+		return err
+	}
+	if h.cookieOptions == nil {
+		return errCookieAuthDisabled
+	}
+	return middleware.EndCookieSession(c, *h.cookieOptions)
+}
+
+// CSRFTokenHandler returns the CSRF token of a cookie session again, e.g.
+// after the page that logged in was reloaded.
+func (h *AuthHandler) CSRFTokenHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !middleware.IsCookieAuthenticated(c) {
+			c.Error(models.ValidationError("not_cookie_authenticated", "Not authenticated by cookie"))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"csrf_token": middleware.CSRFToken(c)})
+	}
+}
@@ -1,9 +1,15 @@
 package handlers
 
 import (
+	"errors"
+	"log"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/aki-0517/go-user-management/config"
+	"github.com/aki-0517/go-user-management/middleware"
 	"github.com/aki-0517/go-user-management/models"
 	"github.com/aki-0517/go-user-management/util"
 
@@ -12,32 +18,71 @@ import (
 )
 
 type Handler struct {
-	db     *gorm.DB
-	JWTKey []byte
+	cfg      *config.Config
+	db       *gorm.DB
+	users    models.UserRepository
+	Keys     *util.KeySet
+	verifier *util.EmailVerifier
+	// background tracks the verification emails still being sent.
+	background *sync.WaitGroup
 }
 
-func UserHandler(db *gorm.DB, jwtKey []byte) *Handler {
+func UserHandler(cfg *config.Config, db *gorm.DB, users models.UserRepository, keys *util.KeySet, verifier *util.EmailVerifier, background *sync.WaitGroup) *Handler {
 	return &Handler{
-		db:     db,
-		JWTKey: jwtKey,
+		cfg:        cfg,
+		db:         db,
+		users:      users,
+		Keys:       keys,
+		verifier:   verifier,
+		background: background,
 	}
 }
 
-func getUUIDFromRequest(c *gin.Context) uuid.UUID {
-	id := c.Param("id")
-	uid, err := uuid.Parse(id)
+// sendVerification emails the user a link to verify their address in the
+// background, as the password reset flow does. Errors are only logged, as
+// the request has already been answered.
+func (h *Handler) sendVerification(userID uuid.UUID, email string) {
+	h.background.Add(1)
+	go func() {
+		defer h.background.Done()
+		if err := h.verifier.SendVerification(userID.String(), email); err != nil {
+			log.Printf("failed to send verification email to user %s: %v", userID, err)
+		}
+	}()
+}
 
+// uuidParam returns the path parameter name as a UUID. If it is not one,
+// the request fails with a validation error and ok is false.
+func uuidParam(c *gin.Context, name string) (id uuid.UUID, ok bool) {
+	id, err := uuid.Parse(c.Param(name))
 	if err != nil {
-		panic(err)
+		c.Error(models.ValidationError("invalid_path_parameter", name+" must be a UUID"))
+		return uuid.Nil, false
+	}
+	return id, true
+}
+
+// authorizeTarget lets callers act on their own account, and on other accounts
+// only if one of their roles grants permission. API keys need permission in
+// their scope either way. It records a 403 error and returns false otherwise.
+func authorizeTarget(c *gin.Context, id uuid.UUID, permission string) bool {
+	caller := middleware.CurrentUser(c)
+	allowed := caller != nil && middleware.APIKeyAllows(c, permission)
+	if caller != nil && caller.ID != id {
+		allowed = middleware.HasPermission(c, permission)
+	}
+	if !allowed {
+		c.Error(errForbidden)
+		return false
 	}
-	return uid
+	return true
 }
 
 func (h *Handler) ListUsersHandler() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		users, err := models.GetAllUsers(h.db)
+		users, err := h.users.List()
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			c.Error(err)
 			return
 		}
 		c.JSON(http.StatusOK, users)
@@ -46,14 +91,17 @@ func (h *Handler) ListUsersHandler() gin.HandlerFunc {
 
 func (h *Handler) GetUserHandler() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		id := getUUIDFromRequest(c)
-		user, err := models.GetUserById(h.db, id)
+		id, ok := uuidParam(c, "id")
+		if !ok || !authorizeTarget(c, id, models.PermissionUsersRead) {
+			return
+		}
+		user, err := h.users.GetByID(id)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			c.Error(err)
 			return
 		}
 		if user == nil {
-			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			c.Error(models.ErrUserNotFound)
 			return
 		}
 		c.JSON(http.StatusOK, user)
@@ -66,60 +114,76 @@ func (h *Handler) CreateUserHandler() gin.HandlerFunc {
 		var user models.User
 
 		if err := c.ShouldBind(&user); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			c.Error(invalidRequest(err))
 			return
 		}
 
 		if user.Name == "" || user.Email == "" || user.Password == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Missing required fields"})
+			c.Error(models.ValidationError("missing_fields", "Missing required fields"))
 			return
 		}
 
-		newUser, err := models.CreateUser(h.db, user)
-
+		newUser, err := h.users.Create(user, h.cfg.Password.BcryptCost)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			c.Error(err)
 			return
 		}
+		// The account exists either way; a failed mail must not fail signup.
+		h.sendVerification(newUser.ID, newUser.Email)
 		c.JSON(http.StatusOK, gin.H{"message": "user created" + newUser.Name})
 	}
 }
 
 func (h *Handler) UpdateUserHandler() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		id := getUUIDFromRequest(c)
+		id, ok := uuidParam(c, "id")
+		if !ok || !authorizeTarget(c, id, models.PermissionUsersUpdate) {
+			return
+		}
 
-		currentUser, err := models.GetUserById(h.db, id)
+		currentUser, err := h.users.GetByID(id)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			c.Error(err)
+			return
+		}
+		if currentUser == nil {
+			c.Error(models.ErrUserNotFound)
 			return
 		}
 		var updatedInfo models.User
 		if err := c.ShouldBind(&updatedInfo); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			c.Error(invalidRequest(err))
 			return
 		}
 
+		var changes models.UserChanges
 		if updatedInfo.Name != "" {
-			currentUser.Name = updatedInfo.Name
+			changes.Name = &updatedInfo.Name
 		}
-		if updatedInfo.Email != "" {
-			currentUser.Email = updatedInfo.Email
+		emailChanged := updatedInfo.Email != "" && models.NormalizeEmail(updatedInfo.Email) != currentUser.Email
+		// Password resets go to the email address, so changing it would
+		// hand whoever holds the key the whole account.
+		if emailChanged && middleware.CurrentAPIKey(c) != nil {
+			c.Error(errAPIKeyEmailChange)
+			return
+		}
+		if emailChanged {
+			changes.Email = &updatedInfo.Email
 		}
 
-		updatedUser, err := models.UpdateUser(h.db, *currentUser)
-
+		updatedUser, err := h.users.Update(currentUser.ID, changes)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			c.Error(err)
 			return
 		}
-		tokenString, err := util.GenerateToken(h.JWTKey, updatedUser.Email)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating token"})
+		if updatedUser == nil {
+			c.Error(models.ErrUserNotFound)
 			return
 		}
+		if emailChanged {
+			h.sendVerification(updatedUser.ID, updatedUser.Email)
+		}
 		c.JSON(http.StatusOK, gin.H{
-			"token":   tokenString,
 			"user":    updatedUser,
 			"message": "User updated successfully",
 		})
@@ -128,24 +192,69 @@ func (h *Handler) UpdateUserHandler() gin.HandlerFunc {
 
 func (h *Handler) DeleteUserHandler() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		id := getUUIDFromRequest(c)
+		id, ok := uuidParam(c, "id")
+		if !ok || !authorizeTarget(c, id, models.PermissionUsersDelete) {
+			return
+		}
 
-		user, err := models.GetUserById(h.db, id)
+		user, err := h.users.GetByID(id)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			c.Error(err)
+			return
+		}
+		if user == nil {
+			c.Error(models.ErrUserNotFound)
 			return
 		}
 
-		isDeleted, err := models.DeleteUser(h.db, user)
+		isDeleted, err := h.users.Delete(user)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			c.Error(err)
 			return
 		}
 		if !isDeleted {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "User not found"})
+			c.Error(models.ErrUserNotFound)
 			return
 		}
 
 		c.JSON(http.StatusOK, gin.H{"message": "user deleted"})
 	}
 }
+
+func (h *Handler) VerifyEmailHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, email, err := h.verifier.Verify(c.Query("token"))
+		if errors.Is(err, util.ErrInvalidVerificationToken) {
+			c.Error(errInvalidVerificationToken)
+			return
+		} else if err != nil {
+			c.Error(err)
+			return
+		}
+
+		id, err := uuid.Parse(userID)
+		if err != nil {
+			c.Error(errInvalidVerificationToken)
+			return
+		}
+		user, err := h.users.GetByID(id)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		// Links sent to an address the user has since changed are void.
+		if user == nil || user.Email != email {
+			c.Error(errInvalidVerificationToken)
+			return
+		}
+
+		if !user.IsEmailVerified() {
+			now := time.Now()
+			if _, err := h.users.Update(user.ID, models.UserChanges{EmailVerifiedAt: &now}); err != nil {
+				c.Error(err)
+				return
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Email verified"})
+	}
+}
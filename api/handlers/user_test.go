@@ -0,0 +1,257 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aki-0517/go-user-management/config"
+	"github.com/aki-0517/go-user-management/middleware"
+	"github.com/aki-0517/go-user-management/models"
+	"github.com/aki-0517/go-user-management/util"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type testUserAPI struct {
+	router  *gin.Engine
+	users   *models.MemoryUserRepository
+	keys    *util.KeySet
+	mailer  *util.MemoryMailer
+	apiKeys map[string]*models.APIKey
+	// background is waited for before emails are looked at.
+	background *sync.WaitGroup
+}
+
+// newTestUserAPI serves the user, password and passkey login routes from
+// memory, with Redis replaced by miniredis.
+func newTestUserAPI(t *testing.T) *testUserAPI {
+	gin.SetMode(gin.TestMode)
+
+	cfg := config.Default()
+	cfg.Password.BcryptCost = bcrypt.MinCost
+	rdb := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	keys := util.NewKeySet(util.NewHMACSigner("test", []byte("test_key")), util.DefaultKeyGracePeriod)
+	users := models.NewMemoryUserRepository()
+	mailer := util.NewMemoryMailer()
+	apiKeys := map[string]*models.APIKey{}
+	background := &sync.WaitGroup{}
+	h := UserHandler(cfg, nil, users, keys, util.NewEmailVerifier(rdb, mailer, cfg.BaseURL), background)
+	loginGuard := util.NewLoginGuard(rdb, cfg.Login.MaxFailures, cfg.Login.FailureWindow, cfg.Login.LockoutDuration)
+	webAuthn, err := webauthn.New(&webauthn.Config{RPID: "localhost", RPDisplayName: cfg.AppName, RPOrigins: []string{cfg.BaseURL}})
+	assert.Nil(t, err)
+	ah := AuthHandlerInit(cfg, nil, users, keys, rdb, loginGuard, mailer, background, webAuthn, nil, nil)
+
+	m := middleware.NewMiddleware(keys, util.NewRedisTokenBlocklist(rdb), false, false, func(subject string) (*models.User, error) {
+		id, err := uuid.Parse(subject)
+		if err != nil {
+			return nil, nil
+		}
+		return users.GetByID(id)
+	}, func(key string) (*models.APIKey, error) {
+		return apiKeys[key], nil
+	}, func(sessionID string) (bool, error) {
+		return true, nil
+	})
+
+	r := gin.New()
+	r.Use(middleware.Errors())
+	r.POST("/user", h.CreateUserHandler())
+	r.GET("/verify-email", h.VerifyEmailHandler())
+	r.POST("/login/webauthn/begin", ah.BeginWebAuthnLoginHandler())
+	r.POST("/login/webauthn/finish", ah.FinishWebAuthnLoginHandler())
+	authorized := r.Group("/me", m.AuthenticateMiddleware())
+	authorized.GET("/:id", h.GetUserHandler())
+	authorized.PUT("/:id", h.UpdateUserHandler())
+	authorized.DELETE("/:id", h.DeleteUserHandler())
+	authorized.PUT("/:id/password", ah.ChangePasswordHandler())
+	return &testUserAPI{router: r, users: users, keys: keys, mailer: mailer, apiKeys: apiKeys, background: background}
+}
+
+func (api *testUserAPI) do(t *testing.T, method string, path string, user *models.User, body interface{}) *httptest.ResponseRecorder {
+	token := ""
+	if user != nil {
+		var err error
+		token, err = util.GenerateToken(api.keys, user.ID.String(), user.RoleNames())
+		assert.Nil(t, err)
+	}
+	return api.doWithToken(t, method, path, token, body)
+}
+
+// doWithToken sends a request authenticated by the access token, if any.
+func (api *testUserAPI) doWithToken(t *testing.T, method string, path string, token string, body interface{}) *httptest.ResponseRecorder {
+	var payload bytes.Buffer
+	if body != nil {
+		assert.Nil(t, json.NewEncoder(&payload).Encode(body))
+	}
+	req, _ := http.NewRequest(method, path, &payload)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	api.router.ServeHTTP(w, req)
+	return w
+}
+
+// doWithAPIKey sends a request authenticated by a new API key of user with
+// scope.
+func (api *testUserAPI) doWithAPIKey(t *testing.T, method string, path string, user *models.User, scope string, body interface{}) *httptest.ResponseRecorder {
+	key := &models.APIKey{ID: uuid.New(), UserID: user.ID, Prefix: "gum_" + uuid.NewString(), Scope: scope}
+	api.apiKeys[key.Prefix] = key
+
+	var payload bytes.Buffer
+	if body != nil {
+		assert.Nil(t, json.NewEncoder(&payload).Encode(body))
+	}
+	req, _ := http.NewRequest(method, path, &payload)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(middleware.APIKeyHeader, key.Prefix)
+	w := httptest.NewRecorder()
+	api.router.ServeHTTP(w, req)
+	return w
+}
+
+func (api *testUserAPI) createUser(t *testing.T, email string) *models.User {
+	user, err := api.users.Create(models.User{Name: "test", Email: email, Password: "password"}, bcrypt.MinCost)
+	assert.Nil(t, err)
+	return user
+}
+
+func TestCreateUserHandler(t *testing.T) {
+	api := newTestUserAPI(t)
+
+	w := api.do(t, http.MethodPost, "/user", nil, gin.H{"name": "test", "email": "test@test.com", "password": "password"})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	user, _ := api.users.GetByEmail("test@test.com")
+	assert.NotNil(t, user)
+	assert.True(t, util.CheckPasswordHash("password", user.Password))
+	// The verification email is sent in the background
+	api.background.Wait()
+	messages := api.mailer.Messages()
+	assert.Len(t, messages, 1)
+	assert.Equal(t, "test@test.com", messages[0].To)
+
+	w = api.do(t, http.MethodPost, "/user", nil, gin.H{"name": "test", "email": "other@test.com"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = api.do(t, http.MethodPost, "/user", nil, gin.H{"name": "test", "email": "Test@Test.com", "password": "password"})
+	assert.Equal(t, http.StatusConflict, w.Code)
+	var problem middleware.Problem
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &problem))
+	assert.Equal(t, "email_taken", problem.Code)
+}
+
+func TestVerifyEmailHandler(t *testing.T) {
+	api := newTestUserAPI(t)
+	api.do(t, http.MethodPost, "/user", nil, gin.H{"name": "test", "email": "test@test.com", "password": "password"})
+	api.background.Wait()
+
+	body := api.mailer.Messages()[0].Body
+	link, err := url.Parse(strings.Fields(body[strings.Index(body, "http"):])[0])
+	assert.Nil(t, err)
+
+	w := api.do(t, http.MethodGet, "/verify-email?"+link.RawQuery, nil, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	user, _ := api.users.GetByEmail("test@test.com")
+	assert.True(t, user.IsEmailVerified())
+
+	w = api.do(t, http.MethodGet, "/verify-email?"+link.RawQuery, nil, nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestGetUserHandler(t *testing.T) {
+	api := newTestUserAPI(t)
+	user := api.createUser(t, "test@test.com")
+	other := api.createUser(t, "other@test.com")
+
+	w := api.do(t, http.MethodGet, "/me/"+user.ID.String(), user, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var got models.User
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &got))
+	assert.Equal(t, "test@test.com", got.Email)
+
+	// Users without the users:read permission only see themselves
+	w = api.do(t, http.MethodGet, "/me/"+other.ID.String(), user, nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = api.do(t, http.MethodGet, "/me/"+user.ID.String(), nil, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = api.do(t, http.MethodGet, "/me/not-a-uuid", user, nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	var problem middleware.Problem
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &problem))
+	assert.Equal(t, "invalid_path_parameter", problem.Code)
+}
+
+func TestUpdateUserHandler(t *testing.T) {
+	api := newTestUserAPI(t)
+	user := api.createUser(t, "test@test.com")
+
+	w := api.do(t, http.MethodPut, "/me/"+user.ID.String(), user, gin.H{"name": "renamed", "email": "new@test.com"})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	updated, _ := api.users.GetByID(user.ID)
+	assert.Equal(t, "renamed", updated.Name)
+	assert.Equal(t, "new@test.com", updated.Email)
+	assert.False(t, updated.IsEmailVerified())
+	// The new address has to be verified
+	api.background.Wait()
+	messages := api.mailer.Messages()
+	assert.Len(t, messages, 1)
+	assert.Equal(t, "new@test.com", messages[0].To)
+
+	other := api.createUser(t, "other@test.com")
+	w = api.do(t, http.MethodPut, "/me/"+user.ID.String(), user, gin.H{"email": other.Email})
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	// API keys may rename the account but not move it to another address
+	w = api.doWithAPIKey(t, http.MethodPut, "/me/"+user.ID.String(), user, models.PermissionUsersUpdate, gin.H{"name": "scripted"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = api.doWithAPIKey(t, http.MethodPut, "/me/"+user.ID.String(), user, models.PermissionUsersUpdate, gin.H{"email": "attacker@test.com"})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	updated, _ = api.users.GetByID(user.ID)
+	assert.Equal(t, "scripted", updated.Name)
+	assert.Equal(t, "new@test.com", updated.Email)
+}
+
+func TestDeleteUserHandler(t *testing.T) {
+	api := newTestUserAPI(t)
+	user := api.createUser(t, "test@test.com")
+	other := api.createUser(t, "other@test.com")
+
+	w := api.do(t, http.MethodDelete, "/me/"+other.ID.String(), user, nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// API keys need the permission in their scope even for their own user
+	w = api.doWithAPIKey(t, http.MethodDelete, "/me/"+user.ID.String(), user, models.PermissionUsersRead, nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = api.doWithAPIKey(t, http.MethodPut, "/me/"+user.ID.String(), user, models.PermissionUsersRead, gin.H{"email": "stolen@test.com"})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = api.doWithAPIKey(t, http.MethodGet, "/me/"+user.ID.String(), user, models.PermissionUsersRead, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	kept, _ := api.users.GetByID(user.ID)
+	assert.Equal(t, "test@test.com", kept.Email)
+
+	w = api.do(t, http.MethodDelete, "/me/"+user.ID.String(), user, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	deleted, _ := api.users.GetByID(user.ID)
+	assert.Nil(t, deleted)
+
+	// Tokens of deleted users no longer authenticate
+	w = api.do(t, http.MethodDelete, "/me/"+user.ID.String(), user, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, middleware.ProblemContentType, w.Header().Get("Content-Type"))
+}
@@ -0,0 +1,183 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/aki-0517/go-user-management/middleware"
+	"github.com/aki-0517/go-user-management/models"
+	"github.com/aki-0517/go-user-management/util"
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// BeginWebAuthnRegistrationHandler starts registering a passkey for the
+// current user. The client passes the options to
+// navigator.credentials.create() and posts the result together with the
+// session ID to FinishWebAuthnRegistrationHandler.
+func (h *AuthHandler) BeginWebAuthnRegistrationHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, err := models.GetWebAuthnUser(h.db, middleware.CurrentUser(c))
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		// Passkeys are resident so that login works without an email.
+		options, session, err := h.webAuthn.BeginRegistration(user,
+			webauthn.WithExclusions(user.CredentialDescriptors()),
+			webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
+		)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		sessionID, err := h.webAuthnSessions.Save(session)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"session_id": sessionID,
+			"options":    options,
+		})
+	}
+}
+
+// FinishWebAuthnRegistrationHandler verifies the authenticator response and
+// stores the new credential.
+func (h *AuthHandler) FinishWebAuthnRegistrationHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, err := h.webAuthnSessions.Load(c.Query("session_id"))
+		if errors.Is(err, util.ErrWebAuthnSessionNotFound) {
+			c.Error(errInvalidWebAuthnSession)
+			return
+		} else if err != nil {
+			c.Error(err)
+			return
+		}
+
+		user, err := models.GetWebAuthnUser(h.db, middleware.CurrentUser(c))
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		// The session is bound to the user who started the ceremony.
+		credential, err := h.webAuthn.FinishRegistration(user, *session, c.Request)
+		if err != nil {
+			c.Error(models.ValidationError("passkey_registration_failed", "Passkey registration failed"))
+			return
+		}
+
+		stored := models.NewWebAuthnCredential(user.ID, credential)
+		if err := models.CreateWebAuthnCredential(h.db, &stored); err != nil {
+			c.Error(err)
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{
+			"message": "Passkey registered",
+			"id":      stored.ID,
+		})
+	}
+}
+
+// BeginWebAuthnLoginHandler starts a passwordless login. No account is
+// named up front; the authenticator picks a passkey for this site. The
+// passkey replaces both password and second factor, so the authenticator has
+// to verify the user, e.g. by PIN or biometrics; a touch is not enough.
+func (h *AuthHandler) BeginWebAuthnLoginHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		options, session, err := h.webAuthn.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		sessionID, err := h.webAuthnSessions.Save(session)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"session_id": sessionID,
+			"options":    options,
+		})
+	}
+}
+
+// FinishWebAuthnLoginHandler verifies the assertion of a passkey and responds
+// like LoginHandler. A passkey already proves possession of a device, so no
+// TOTP code is asked for.
+func (h *AuthHandler) FinishWebAuthnLoginHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, err := h.webAuthnSessions.Load(c.Query("session_id"))
+		if errors.Is(err, util.ErrWebAuthnSessionNotFound) {
+			c.Error(errInvalidWebAuthnSession)
+			return
+		} else if err != nil {
+			c.Error(err)
+			return
+		}
+
+		response, err := protocol.ParseCredentialRequestResponse(c.Request)
+		if err != nil {
+			c.Error(models.ValidationError("invalid_passkey_response", "Invalid passkey response"))
+			return
+		}
+		// Checked here as well as by the library, whatever the session asked
+		// for.
+		if !response.Response.AuthenticatorData.Flags.UserVerified() {
+			c.Error(errPasskeyAuthenticationFailed)
+			return
+		}
+
+		var owner *models.WebAuthnUser
+		var stored *models.WebAuthnCredential
+		credential, err := h.webAuthn.ValidateDiscoverableLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+			var err error
+			stored, err = models.GetWebAuthnCredential(h.db, rawID)
+			if err != nil {
+				return nil, err
+			}
+			if stored == nil {
+				return nil, errors.New("unknown credential")
+			}
+			user, err := h.users.GetByID(stored.UserID)
+			if err != nil {
+				return nil, err
+			}
+			if user == nil {
+				return nil, errors.New("unknown user")
+			}
+			owner, err = models.GetWebAuthnUser(h.db, user)
+			return owner, err
+		}, *session, response)
+		if err != nil {
+			c.Error(errPasskeyAuthenticationFailed)
+			return
+		}
+
+		if credential.Authenticator.CloneWarning {
+			if !stored.CloneWarning {
+				log.Printf("sign count of passkey %s of user %s did not increase, disabling it", stored.ID, owner.ID)
+				if err := models.RecordWebAuthnCredentialUse(h.db, stored, stored.SignCount, true); err != nil {
+					c.Error(err)
+					return
+				}
+			}
+			c.Error(errPasskeyAuthenticationFailed)
+			return
+		}
+		if err := models.RecordWebAuthnCredentialUse(h.db, stored, credential.Authenticator.SignCount, false); err != nil {
+			c.Error(err)
+			return
+		}
+
+		if h.cfg.RequireEmailVerification && !owner.IsEmailVerified() {
+			c.Error(errEmailNotVerified)
+			return
+		}
+		h.completeLogin(c, owner.User, wantsCookie(c))
+	}
+}
@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/aki-0517/go-user-management/config"
+	"github.com/aki-0517/go-user-management/middleware"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebAuthnLoginRequiresUserVerification(t *testing.T) {
+	api := newTestUserAPI(t)
+
+	w := api.do(t, http.MethodPost, "/login/webauthn/begin", nil, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var begin struct {
+		SessionID string `json:"session_id"`
+		Options   struct {
+			PublicKey struct {
+				Challenge        string `json:"challenge"`
+				UserVerification string `json:"userVerification"`
+			} `json:"publicKey"`
+		} `json:"options"`
+	}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &begin))
+	assert.Equal(t, "required", begin.Options.PublicKey.UserVerification)
+
+	// The authenticator only saw a touch: user present, not verified
+	clientData, _ := json.Marshal(gin.H{
+		"type":      "webauthn.get",
+		"challenge": begin.Options.PublicKey.Challenge,
+		"origin":    config.Default().BaseURL,
+	})
+	rpIDHash := sha256.Sum256([]byte("localhost"))
+	authData := append(rpIDHash[:], 0x01, 0, 0, 0, 1)
+	encode := base64.RawURLEncoding.EncodeToString
+	w = api.do(t, http.MethodPost, "/login/webauthn/finish?session_id="+begin.SessionID, nil, gin.H{
+		"id":    encode([]byte("credential")),
+		"rawId": encode([]byte("credential")),
+		"type":  "public-key",
+		"response": gin.H{
+			"clientDataJSON":    encode(clientData),
+			"authenticatorData": encode(authData),
+			"signature":         encode([]byte("signature")),
+			"userHandle":        encode([]byte("user")),
+		},
+	})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	var problem middleware.Problem
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &problem))
+	assert.Equal(t, "passkey_authentication_failed", problem.Code)
+}
@@ -1,73 +1,41 @@
 package main
 
 import (
-	"net/http"
+	"context"
+	"log"
 	"os"
+	"os/signal"
+	"syscall"
 
-	"github.com/gin-contrib/sessions"
-	"github.com/gin-contrib/sessions/cookie"
-	"github.com/gin-gonic/gin"
-	"github.com/go-redis/redis/v8"
-	"gorm.io/gorm"
-
-	"github.com/aki-0517/go-user-management/handlers"
-	"github.com/aki-0517/go-user-management/middleware"
-	"github.com/aki-0517/go-user-management/util"
+	"github.com/aki-0517/go-user-management/config"
+	"github.com/aki-0517/go-user-management/server"
 )
 
-type App struct {
-	DB     *gorm.DB
-	JWTKey []byte
-	RDB    *redis.Client
-}
-
 func main() {
-	var app App
+	if err := run(); err != nil {
+		log.Fatal(err)
+	}
+}
 
-	app.JWTKey = []byte(os.Getenv("JWT_KEY"))
+// run serves the API until SIGINT or SIGTERM, after which in-flight requests
+// are drained before the process exits. With "migrate" as the first argument
+// it manages the database schema instead.
+func run() error {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		return migrate(os.Args[2:])
+	}
 
-	app.DB = util.DBConnect()
-	sqlDB, err := app.DB.DB()
+	cfg, err := config.Load(os.Args[1:])
 	if err != nil {
-		panic("Failed to retrieve the database connection")
+		return err
 	}
-	defer sqlDB.Close()
-
-	app.RDB = util.RedisClient()
 
-	uh := handlers.UserHandler(app.DB, app.JWTKey)
-	ah := handlers.AuthHandlerInit(app.DB, app.JWTKey, app.RDB)
-	m := middleware.NewMiddleware(app.JWTKey)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	r := gin.Default()
-
-	store := cookie.NewStore([]byte("secret"))
-	r.Use(sessions.Sessions("mysession", store))
-
-	rl := util.NewRateLimiter(5)
-	r.Use(func(c *gin.Context) {
-		rl.MiddleWare()
-		c.Next()
-	})
-
-	authorized := r.Group("/me")
-	authorized.Use(m.AuthenticateMiddleware())
-	{
-		authorized.PUT("/:id", uh.UpdateUserHandler())
-		authorized.PUT("/:id/password", ah.ChangePasswordHandler())
-		authorized.DELETE("/:id", uh.DeleteUserHandler())
-		authorized.POST("/refresh-token", ah.RefreshTokenHandler())
-		authorized.GET("/:id", uh.GetUserHandler())
-		authorized.POST("/logout", ah.LogOutHandler())
+	s, err := server.New(ctx, cfg)
+	if err != nil {
+		return err
 	}
-
-	r.GET("/", func(c *gin.Context) {
-		c.String(http.StatusOK, "Hello World!")
-	})
-	r.GET("/users", uh.ListUsersHandler())
-	r.GET("/user/:id", uh.GetUserHandler())
-	r.POST("/user", uh.CreateUserHandler())
-	r.POST("/login", ah.LoginHandler())
-
-	r.Run(":8080")
+	return s.Run(ctx)
 }
@@ -1,52 +1,242 @@
 package middleware
 
 import (
-	"net/http"
+	"log"
 
-	"github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
+	"github.com/aki-0517/go-user-management/models"
 	"github.com/aki-0517/go-user-management/util"
 )
 
+const (
+	userContextKey    = "user"
+	apiKeyContextKey  = "api_key"
+	sessionContextKey = "session"
+)
+
+var (
+	errInvalidToken  = models.UnauthorizedError("invalid_token", "Invalid token")
+	errInvalidAPIKey = models.UnauthorizedError("invalid_api_key", "Invalid API key")
+)
+
+// APIKeyHeader carries API keys, as an alternative to a Bearer token in the
+// Authorization header.
+const APIKeyHeader = "X-API-Key"
+
+// UserResolver loads the user identified by a token subject. It returns nil
+// without an error when no such user exists.
+type UserResolver func(subject string) (*models.User, error)
+
+// APIKeyResolver looks up an API key. It returns nil without an error for
+// unknown or expired keys.
+type APIKeyResolver func(key string) (*models.APIKey, error)
+
 type MiddleWare struct {
-	jwtkey []byte
+	keys      *util.KeySet
+	blocklist util.TokenBlocklist
+	// failOpen lets requests through when the blocklist cannot be reached.
+	// By default such requests are rejected.
+	failOpen bool
+	// cookieAuth accepts the auth cookie in place of a token.
+	cookieAuth bool
+	users      UserResolver
+	apiKeys    APIKeyResolver
+	sessions   SessionResolver
+}
+
+func NewMiddleware(keys *util.KeySet, blocklist util.TokenBlocklist, failOpen bool, cookieAuth bool, users UserResolver, apiKeys APIKeyResolver, sessions SessionResolver) *MiddleWare {
+	return &MiddleWare{
+		keys:       keys,
+		blocklist:  blocklist,
+		failOpen:   failOpen,
+		cookieAuth: cookieAuth,
+		users:      users,
+		apiKeys:    apiKeys,
+		sessions:   sessions,
+	}
+}
+
+// CurrentUser returns the user authenticated by AuthenticateMiddleware, or
+// nil on routes that are not behind it.
+func CurrentUser(c *gin.Context) *models.User {
+	value, ok := c.Get(userContextKey)
+	if !ok {
+		return nil
+	}
+	user, _ := value.(*models.User)
+	return user
+}
+
+// CurrentAPIKey returns the API key the request was authenticated with, or
+// nil if it was authenticated otherwise.
+func CurrentAPIKey(c *gin.Context) *models.APIKey {
+	value, ok := c.Get(apiKeyContextKey)
+	if !ok {
+		return nil
+	}
+	apiKey, _ := value.(*models.APIKey)
+	return apiKey
 }
 
-func NewMiddleware(jwtkey []byte) *MiddleWare {
-	return &MiddleWare{jwtkey}
+// CurrentSessionID returns the login session the request's access token
+// belongs to, or "" if there is none.
+func CurrentSessionID(c *gin.Context) string {
+	return c.GetString(sessionContextKey)
 }
 
+// HasPermission reports whether the authenticated user holds permission and,
+// for requests made with an API key, the key's scope includes it.
+func HasPermission(c *gin.Context, permission string) bool {
+	user := CurrentUser(c)
+	if user == nil || !user.HasPermission(permission) {
+		return false
+	}
+	return APIKeyAllows(c, permission)
+}
+
+// APIKeyAllows reports whether the request was not made with an API key, or
+// with one whose scope includes permission. Unlike HasPermission it ignores
+// the user's roles, for actions users may take on their own account.
+func APIKeyAllows(c *gin.Context, permission string) bool {
+	apiKey := CurrentAPIKey(c)
+	return apiKey == nil || apiKey.Allows(permission)
+}
+
+// AuthenticateMiddleware authenticates requests by a Bearer access token, an
+// API key in the APIKeyHeader or, for browsers in cookie mode, the auth
+// cookie. The cookie is ignored unless cookie auth is enabled.
 func (m *MiddleWare) AuthenticateMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		if key := c.Request.Header.Get(APIKeyHeader); key != "" {
+			m.authenticateAPIKey(c, key)
+			return
+		}
+
 		authHader := c.Request.Header.Get("Authorization")
+		if authHader == "" && m.cookieAuth && hasAuthCookie(c) {
+			m.authenticateCookie(c)
+			return
+		}
 		if authHader == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header required"})
-			c.Abort()
+			abortWithError(c, models.UnauthorizedError("authorization_required", "Authorization header required"))
 			return
 		}
 		tokenString, err := util.ExtractBearerToken(authHader)
 		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
-			c.Abort()
+			abortWithError(c, models.UnauthorizedError("invalid_token", err.Error()))
 			return
 		}
 
-		token, err := jwt.ParseWithClaims(tokenString, &jwt.StandardClaims{}, func(token *jwt.Token) (interface{}, error) {
-			return m.jwtkey, nil
-		})
+		claims, err := util.ParseToken(m.keys, tokenString)
+		if err != nil {
+			abortWithError(c, errInvalidToken)
+			return
+		}
 
+		revoked, err := m.isRevoked(tokenString, claims)
 		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Error parsing token"})
-			c.Abort()
+			if !m.failOpen {
+				abortWithError(c, models.UnavailableError("token_verification_unavailable", "Unable to verify token"))
+				return
+			}
+			log.Printf("token blocklist unavailable, allowing request: %v", err)
+		} else if revoked {
+			abortWithError(c, models.UnauthorizedError("token_revoked", "Token has been revoked"))
 			return
 		}
 
-		if !token.Valid {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
-			c.Abort()
+		user, err := m.users(claims.Subject)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		if user == nil {
+			abortWithError(c, errInvalidToken)
 			return
 		}
+		c.Set(userContextKey, user)
+		c.Set(util.SubjectContextKey, claims.Subject)
+		if claims.SessionID != "" {
+			c.Set(sessionContextKey, claims.SessionID)
+		}
+
+		c.Next()
+	}
+}
+
+func (m *MiddleWare) authenticateAPIKey(c *gin.Context, key string) {
+	apiKey, err := m.apiKeys(key)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	if apiKey == nil {
+		abortWithError(c, errInvalidAPIKey)
+		return
+	}
 
+	user, err := m.users(apiKey.UserID.String())
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	if user == nil {
+		abortWithError(c, errInvalidAPIKey)
+		return
+	}
+	c.Set(userContextKey, user)
+	c.Set(apiKeyContextKey, apiKey)
+	c.Set(util.SubjectContextKey, user.ID.String())
+
+	c.Next()
+}
+
+// isRevoked reports whether the token was revoked on its own, with its
+// session or together with all other tokens of its subject.
+func (m *MiddleWare) isRevoked(tokenString string, claims *util.Claims) (bool, error) {
+	blocklisted, err := m.blocklist.IsBlocklisted(tokenString)
+	if err != nil || blocklisted {
+		return blocklisted, err
+	}
+	subjects := []string{claims.Subject}
+	if claims.SessionID != "" {
+		subjects = append(subjects, util.SessionSubject(claims.SessionID))
+	}
+	for _, subject := range subjects {
+		revokedAt, err := m.blocklist.SubjectRevokedAt(subject)
+		if err != nil {
+			return false, err
+		}
+		if util.RevokedBy(claims.IssuedAtNano, revokedAt) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// RejectAPIKeys aborts with 403 for requests made with an API key. Keys are
+// for scripts acting within their scope; managing the account itself, its
+// credentials and sessions is left to its owner. It must run after
+// AuthenticateMiddleware.
+func (m *MiddleWare) RejectAPIKeys() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if CurrentAPIKey(c) != nil {
+			abortWithError(c, models.ForbiddenError("api_key_not_allowed", "API keys cannot manage the account"))
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequirePermission aborts with 403 unless the authenticated user holds
+// permission through one of their roles, and their API key if they used one
+// allows it. It must run after AuthenticateMiddleware.
+func (m *MiddleWare) RequirePermission(permission string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !HasPermission(c, permission) {
+			abortWithError(c, models.ForbiddenError("forbidden", "Forbidden"))
+			return
+		}
 		c.Next()
 	}
 }
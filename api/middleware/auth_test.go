@@ -1,38 +1,143 @@
 package middleware
 
 import (
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 	"time"
 
-	"github.com/dgrijalva/jwt-go"
+	"github.com/golang-jwt/jwt/v4"
 	"github.com/gin-gonic/gin"
+	"github.com/aki-0517/go-user-management/models"
+	"github.com/aki-0517/go-user-management/util"
+	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 )
 
+type fakeBlocklist struct {
+	tokens   map[string]bool
+	subjects map[string]time.Time
+	err      error
+}
+
+func newFakeBlocklist() *fakeBlocklist {
+	return &fakeBlocklist{tokens: map[string]bool{}, subjects: map[string]time.Time{}}
+}
+
+func (b *fakeBlocklist) Add(token string, expiration time.Duration) error {
+	if b.err != nil {
+		return b.err
+	}
+	b.tokens[token] = true
+	return nil
+}
+
+func (b *fakeBlocklist) IsBlocklisted(token string) (bool, error) {
+	if b.err != nil {
+		return false, b.err
+	}
+	return b.tokens[token], nil
+}
+
+func (b *fakeBlocklist) RevokeSubject(subject string, expiration time.Duration) error {
+	if b.err != nil {
+		return b.err
+	}
+	b.subjects[subject] = time.Now()
+	return nil
+}
+
+func (b *fakeBlocklist) SubjectRevokedAt(subject string) (time.Time, error) {
+	if b.err != nil {
+		return time.Time{}, b.err
+	}
+	return b.subjects[subject], nil
+}
+
+func fakeUsers(users ...*models.User) UserResolver {
+	return func(subject string) (*models.User, error) {
+		for _, user := range users {
+			if user.ID.String() == subject {
+				return user, nil
+			}
+		}
+		return nil, nil
+	}
+}
+
+// fakeAPIKeys resolves keys by their prefix.
+func fakeAPIKeys(apiKeys ...*models.APIKey) APIKeyResolver {
+	return func(key string) (*models.APIKey, error) {
+		for _, apiKey := range apiKeys {
+			if apiKey.Prefix == key {
+				return apiKey, nil
+			}
+		}
+		return nil, nil
+	}
+}
+
+// fakeSessions treats the given sessions as active.
+func fakeSessions(sessionIDs ...string) SessionResolver {
+	return func(sessionID string) (bool, error) {
+		for _, id := range sessionIDs {
+			if id == sessionID {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+}
+
+var testUser = &models.User{ID: uuid.New(), Name: "test", Email: "test@test.com"}
+
+func newTestKeys() *util.KeySet {
+	return util.NewKeySet(util.NewHMACSigner("test", []byte("test_key")), util.DefaultKeyGracePeriod)
+}
+
+func newTestToken(keys *util.KeySet, user *models.User) string {
+	tokenString, _ := util.GenerateToken(keys, user.ID.String(), user.RoleNames())
+	return tokenString
+}
+
 func TestAuthenticateMiddleware(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
-	jwtKey := []byte("test_key")
+	keys := newTestKeys()
 	r := gin.Default()
-	m := NewMiddleware(jwtKey)
+	r.Use(Errors())
+	m := NewMiddleware(keys, newFakeBlocklist(), false, false, fakeUsers(testUser), fakeAPIKeys(), fakeSessions())
 	r.Use(m.AuthenticateMiddleware())
 	r.GET("/test", func(c *gin.Context) {
 		c.String(http.StatusOK, "success")
 	})
 
 	// Valid token test
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.StandardClaims{
+	req := httptest.NewRequest(http.MethodGet, "/test", nil)
+	req.Header.Set("Authorization", "Bearer "+newTestToken(keys, testUser))
+	resp := httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	// Token for a user that no longer exists test
+	req = httptest.NewRequest(http.MethodGet, "/test", nil)
+	req.Header.Set("Authorization", "Bearer "+newTestToken(keys, &models.User{ID: uuid.New()}))
+	resp = httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+
+	// Token without issuer and audience test
+	tokenString, _ := keys.Sign(jwt.StandardClaims{
+		Subject:   testUser.ID.String(),
 		ExpiresAt: time.Now().Add(time.Hour * 1).Unix(),
 	})
-	tokenString, _ := token.SignedString(jwtKey)
 
-	req := httptest.NewRequest(http.MethodGet, "/test", nil)
+	req = httptest.NewRequest(http.MethodGet, "/test", nil)
 	req.Header.Set("Authorization", "Bearer "+tokenString)
-	resp := httptest.NewRecorder()
+	resp = httptest.NewRecorder()
 	r.ServeHTTP(resp, req)
-	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
 
 	// Invalid token test
 	req = httptest.NewRequest(http.MethodGet, "/test", nil)
@@ -47,3 +152,216 @@ func TestAuthenticateMiddleware(t *testing.T) {
 	r.ServeHTTP(resp, req)
 	assert.Equal(t, http.StatusUnauthorized, resp.Code)
 }
+
+func TestAuthenticateMiddlewareBlocklist(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	keys := newTestKeys()
+	blocklist := newFakeBlocklist()
+	r := gin.Default()
+	r.Use(Errors())
+	m := NewMiddleware(keys, blocklist, false, false, fakeUsers(testUser), fakeAPIKeys(), fakeSessions())
+	r.Use(m.AuthenticateMiddleware())
+	r.GET("/test", func(c *gin.Context) {
+		c.String(http.StatusOK, "success")
+	})
+
+	tokenString := newTestToken(keys, testUser)
+	blocklist.Add(tokenString, time.Hour)
+
+	// Revoked token test
+	req := httptest.NewRequest(http.MethodGet, "/test", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenString)
+	resp := httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+
+	// Token issued before all tokens of the user were revoked test
+	tokenString = newTestToken(keys, testUser)
+	blocklist.subjects[testUser.ID.String()] = time.Now().Add(time.Second)
+	req = httptest.NewRequest(http.MethodGet, "/test", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenString)
+	resp = httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+
+	// Token revoked within the second it was issued test
+	delete(blocklist.subjects, testUser.ID.String())
+	tokenString = newTestToken(keys, testUser)
+	blocklist.RevokeSubject(testUser.ID.String(), time.Hour)
+	req = httptest.NewRequest(http.MethodGet, "/test", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenString)
+	resp = httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+
+	// Token issued right after a revocation, within the same second test
+	tokenString = newTestToken(keys, testUser)
+	req = httptest.NewRequest(http.MethodGet, "/test", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenString)
+	resp = httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	// Token of a revoked session test
+	delete(blocklist.subjects, testUser.ID.String())
+	tokenString, _ = util.GenerateSessionToken(keys, testUser.ID.String(), nil, "session")
+	blocklist.subjects[util.SessionSubject("session")] = time.Now().Add(time.Second)
+	req = httptest.NewRequest(http.MethodGet, "/test", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenString)
+	resp = httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+
+	// Store unavailable test
+	blocklist.err = errors.New("connection refused")
+	req = httptest.NewRequest(http.MethodGet, "/test", nil)
+	req.Header.Set("Authorization", "Bearer "+newTestToken(keys, testUser))
+	resp = httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.Code)
+}
+
+func TestAuthenticateMiddlewareFailOpen(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	keys := newTestKeys()
+	blocklist := newFakeBlocklist()
+	blocklist.err = errors.New("connection refused")
+	r := gin.Default()
+	r.Use(Errors())
+	m := NewMiddleware(keys, blocklist, true, false, fakeUsers(testUser), fakeAPIKeys(), fakeSessions())
+	r.Use(m.AuthenticateMiddleware())
+	r.GET("/test", func(c *gin.Context) {
+		c.String(http.StatusOK, "success")
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/test", nil)
+	req.Header.Set("Authorization", "Bearer "+newTestToken(keys, testUser))
+	resp := httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+}
+
+func TestCurrentUser(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	keys := newTestKeys()
+	r := gin.Default()
+	r.Use(Errors())
+	m := NewMiddleware(keys, newFakeBlocklist(), false, false, fakeUsers(testUser), fakeAPIKeys(), fakeSessions())
+	r.GET("/public", func(c *gin.Context) {
+		assert.Nil(t, CurrentUser(c))
+		c.String(http.StatusOK, "success")
+	})
+	r.GET("/test", m.AuthenticateMiddleware(), func(c *gin.Context) {
+		assert.Equal(t, testUser, CurrentUser(c))
+		c.String(http.StatusOK, "success")
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/public", nil)
+	resp := httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/test", nil)
+	req.Header.Set("Authorization", "Bearer "+newTestToken(keys, testUser))
+	resp = httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+}
+
+func TestRequirePermission(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	keys := newTestKeys()
+	admin := &models.User{
+		ID:    uuid.New(),
+		Email: "admin@test.com",
+		Roles: []models.Role{{
+			Name:        models.RoleAdmin,
+			Permissions: []models.Permission{{Name: models.PermissionUsersList}},
+		}},
+	}
+	scopedKey := &models.APIKey{UserID: admin.ID, Prefix: "gum_scoped", Scope: models.PermissionUsersRead}
+	r := gin.Default()
+	r.Use(Errors())
+	m := NewMiddleware(keys, newFakeBlocklist(), false, false, fakeUsers(testUser, admin), fakeAPIKeys(scopedKey), fakeSessions())
+	r.GET("/users", m.AuthenticateMiddleware(), m.RequirePermission(models.PermissionUsersList), func(c *gin.Context) {
+		c.String(http.StatusOK, "success")
+	})
+
+	// User without the permission test
+	req := httptest.NewRequest(http.MethodGet, "/users", nil)
+	req.Header.Set("Authorization", "Bearer "+newTestToken(keys, testUser))
+	resp := httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+
+	// User with the permission test
+	req = httptest.NewRequest(http.MethodGet, "/users", nil)
+	req.Header.Set("Authorization", "Bearer "+newTestToken(keys, admin))
+	resp = httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	// API key without the permission in its scope test
+	req = httptest.NewRequest(http.MethodGet, "/users", nil)
+	req.Header.Set(APIKeyHeader, scopedKey.Prefix)
+	resp = httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+}
+
+func TestAuthenticateMiddlewareAPIKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	keys := newTestKeys()
+	apiKey := &models.APIKey{UserID: testUser.ID, Prefix: "gum_key"}
+	orphanKey := &models.APIKey{UserID: uuid.New(), Prefix: "gum_orphan"}
+	r := gin.Default()
+	r.Use(Errors())
+	m := NewMiddleware(keys, newFakeBlocklist(), false, false, fakeUsers(testUser), fakeAPIKeys(apiKey, orphanKey), fakeSessions())
+	r.GET("/test", m.AuthenticateMiddleware(), func(c *gin.Context) {
+		assert.Equal(t, testUser, CurrentUser(c))
+		assert.Equal(t, apiKey, CurrentAPIKey(c))
+		c.String(http.StatusOK, "success")
+	})
+
+	// Valid key test
+	req := httptest.NewRequest(http.MethodGet, "/test", nil)
+	req.Header.Set(APIKeyHeader, apiKey.Prefix)
+	resp := httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	// Unknown key test
+	req = httptest.NewRequest(http.MethodGet, "/test", nil)
+	req.Header.Set(APIKeyHeader, "gum_unknown")
+	resp = httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+
+	// Key of a user that no longer exists test
+	req = httptest.NewRequest(http.MethodGet, "/test", nil)
+	req.Header.Set(APIKeyHeader, orphanKey.Prefix)
+	resp = httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+
+	// Routes for the account owner only test
+	r.DELETE("/sessions", m.AuthenticateMiddleware(), m.RejectAPIKeys(), func(c *gin.Context) {
+		c.String(http.StatusOK, "success")
+	})
+	req = httptest.NewRequest(http.MethodDelete, "/sessions", nil)
+	req.Header.Set(APIKeyHeader, apiKey.Prefix)
+	resp = httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+
+	req = httptest.NewRequest(http.MethodDelete, "/sessions", nil)
+	req.Header.Set("Authorization", "Bearer "+newTestToken(keys, testUser))
+	resp = httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+}
@@ -0,0 +1,140 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/aki-0517/go-user-management/models"
+	"github.com/aki-0517/go-user-management/util"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// Cookie sessions. StateSessionName holds short-lived login state such as
+// pending logins at identity providers; AuthSessionName authenticates
+// browsers that logged in in cookie mode.
+const (
+	StateSessionName = "mysession"
+	AuthSessionName  = "auth"
+)
+
+// CSRFHeader carries the CSRF token of cookie authenticated requests.
+const CSRFHeader = "X-CSRF-Token"
+
+var errSessionEnded = models.UnauthorizedError("session_ended", "Session has ended")
+
+const (
+	cookieUserKey    = "user_id"
+	cookieSessionKey = "session_id"
+	cookieCSRFKey    = "csrf_token"
+
+	cookieAuthContextKey = "cookie_auth"
+)
+
+// SessionResolver reports whether a login session is still active.
+type SessionResolver func(sessionID string) (bool, error)
+
+// authSession returns the auth cookie session, or nil on routes without
+// session support.
+func authSession(c *gin.Context) sessions.Session {
+	value, ok := c.Get(sessions.DefaultKey)
+	if !ok {
+		return nil
+	}
+	many, ok := value.(map[string]sessions.Session)
+	if !ok {
+		return nil
+	}
+	return many[AuthSessionName]
+}
+
+// StartCookieSession authenticates the browser by cookie as userID in the
+// login session sessionID. It returns the CSRF token the browser has to send
+// with state-changing requests.
+func StartCookieSession(c *gin.Context, options sessions.Options, userID string, sessionID string) (string, error) {
+	csrfToken, err := util.RandomToken(32)
+	if err != nil {
+		return "", err
+	}
+	session := sessions.DefaultMany(c, AuthSessionName)
+	session.Options(options)
+	session.Set(cookieUserKey, userID)
+	session.Set(cookieSessionKey, sessionID)
+	session.Set(cookieCSRFKey, csrfToken)
+	return csrfToken, session.Save()
+}
+
+// EndCookieSession removes the auth cookie set with options.
+func EndCookieSession(c *gin.Context, options sessions.Options) error {
+	session := sessions.DefaultMany(c, AuthSessionName)
+	session.Clear()
+	options.MaxAge = -1
+	session.Options(options)
+	return session.Save()
+}
+
+// IsCookieAuthenticated reports whether the request was authenticated by the
+// auth cookie rather than a token or API key.
+func IsCookieAuthenticated(c *gin.Context) bool {
+	return c.GetBool(cookieAuthContextKey)
+}
+
+// CSRFToken returns the CSRF token of a cookie authenticated request.
+func CSRFToken(c *gin.Context) string {
+	session := authSession(c)
+	if session == nil {
+		return ""
+	}
+	csrfToken, _ := session.Get(cookieCSRFKey).(string)
+	return csrfToken
+}
+
+// hasAuthCookie reports whether the request carries an auth cookie session.
+func hasAuthCookie(c *gin.Context) bool {
+	session := authSession(c)
+	return session != nil && session.Get(cookieSessionKey) != nil
+}
+
+func (m *MiddleWare) authenticateCookie(c *gin.Context) {
+	session := authSession(c)
+	userID, _ := session.Get(cookieUserKey).(string)
+	sessionID, _ := session.Get(cookieSessionKey).(string)
+
+	// Browsers attach cookies to requests other sites trigger, so anything
+	// but reading needs the token only our own pages know.
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		csrfToken := CSRFToken(c)
+		if csrfToken == "" || subtle.ConstantTimeCompare([]byte(csrfToken), []byte(c.Request.Header.Get(CSRFHeader))) != 1 {
+			abortWithError(c, models.ForbiddenError("invalid_csrf_token", "Invalid CSRF token"))
+			return
+		}
+	}
+
+	active, err := m.sessions(sessionID)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	if !active {
+		abortWithError(c, errSessionEnded)
+		return
+	}
+
+	user, err := m.users(userID)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	if user == nil {
+		abortWithError(c, errSessionEnded)
+		return
+	}
+	c.Set(userContextKey, user)
+	c.Set(sessionContextKey, sessionID)
+	c.Set(cookieAuthContextKey, true)
+	c.Set(util.SubjectContextKey, userID)
+
+	c.Next()
+}
@@ -0,0 +1,95 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aki-0517/go-user-management/util"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthenticateMiddlewareCookie(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	options := sessions.Options{Path: "/", MaxAge: 3600, HttpOnly: true}
+	store := cookie.NewStore(util.SessionKeyPairs("secret")...)
+	r := gin.Default()
+	r.Use(Errors())
+	r.Use(sessions.SessionsMany([]string{StateSessionName, AuthSessionName}, store))
+	m := NewMiddleware(newTestKeys(), newFakeBlocklist(), false, true, fakeUsers(testUser), fakeAPIKeys(), fakeSessions("session"))
+
+	var csrfToken string
+	r.POST("/login", func(c *gin.Context) {
+		var err error
+		csrfToken, err = StartCookieSession(c, options, testUser.ID.String(), c.Query("session"))
+		assert.Nil(t, err)
+		c.String(http.StatusOK, "success")
+	})
+	handler := func(c *gin.Context) {
+		assert.Equal(t, testUser, CurrentUser(c))
+		assert.True(t, IsCookieAuthenticated(c))
+		assert.Equal(t, "session", CurrentSessionID(c))
+		c.String(http.StatusOK, "success")
+	}
+	r.GET("/test", m.AuthenticateMiddleware(), handler)
+	r.POST("/test", m.AuthenticateMiddleware(), handler)
+	disabled := NewMiddleware(newTestKeys(), newFakeBlocklist(), false, false, fakeUsers(testUser), fakeAPIKeys(), fakeSessions("session"))
+	r.GET("/disabled", disabled.AuthenticateMiddleware(), handler)
+
+	login := func(session string) *http.Cookie {
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, httptest.NewRequest(http.MethodPost, "/login?session="+session, nil))
+		cookies := resp.Result().Cookies()
+		assert.Len(t, cookies, 1)
+		assert.True(t, cookies[0].HttpOnly)
+		return cookies[0]
+	}
+	authCookie := login("session")
+
+	// Reading needs only the cookie
+	req := httptest.NewRequest(http.MethodGet, "/test", nil)
+	req.AddCookie(authCookie)
+	resp := httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	// Changing state without the CSRF token test
+	req = httptest.NewRequest(http.MethodPost, "/test", nil)
+	req.AddCookie(authCookie)
+	resp = httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+
+	// Changing state with the CSRF token test
+	req = httptest.NewRequest(http.MethodPost, "/test", nil)
+	req.AddCookie(authCookie)
+	req.Header.Set(CSRFHeader, csrfToken)
+	resp = httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	// Cookie of a session that has ended test
+	req = httptest.NewRequest(http.MethodGet, "/test", nil)
+	req.AddCookie(login("ended"))
+	resp = httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+
+	// Cookie with cookie auth disabled test
+	req = httptest.NewRequest(http.MethodGet, "/disabled", nil)
+	req.AddCookie(authCookie)
+	resp = httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+
+	// Forged cookie test
+	req = httptest.NewRequest(http.MethodGet, "/test", nil)
+	req.AddCookie(&http.Cookie{Name: AuthSessionName, Value: "forged"})
+	resp = httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+}
@@ -0,0 +1,43 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CORS lets browsers on allowedOrigins call the API, including with cookies
+// and the Authorization header. Requests from other origins are served as
+// usual but without CORS headers, so browsers keep their responses from the
+// calling page.
+func CORS(allowedOrigins []string) gin.HandlerFunc {
+	allowed := map[string]bool{}
+	for _, origin := range allowedOrigins {
+		allowed[origin] = true
+	}
+	allowedHeaders := strings.Join([]string{"Authorization", "Content-Type", APIKeyHeader, CSRFHeader}, ", ")
+
+	return func(c *gin.Context) {
+		// Responses differ by origin, so caches must not share them.
+		c.Writer.Header().Add("Vary", "Origin")
+		origin := c.Request.Header.Get("Origin")
+		if !allowed[origin] {
+			c.Next()
+			return
+		}
+
+		header := c.Writer.Header()
+		header.Set("Access-Control-Allow-Origin", origin)
+		header.Set("Access-Control-Allow-Credentials", "true")
+		header.Set("Access-Control-Expose-Headers", RequestIDHeader)
+		if c.Request.Method == http.MethodOptions && c.Request.Header.Get("Access-Control-Request-Method") != "" {
+			header.Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+			header.Set("Access-Control-Allow-Headers", allowedHeaders)
+			header.Set("Access-Control-Max-Age", "600")
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,101 @@
+package middleware
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/aki-0517/go-user-management/models"
+	"github.com/gin-gonic/gin"
+)
+
+// ProblemContentType is the media type of problem details (RFC 7807).
+const ProblemContentType = "application/problem+json"
+
+// Problem describes an error response as problem details (RFC 7807). Code
+// identifies the error for programs and does not change between releases.
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	Code     string `json:"code"`
+	// RequestID is set behind RequestID, for clients to report.
+	RequestID string `json:"request_id,omitempty"`
+}
+
+var kindStatus = map[models.ErrorKind]int{
+	models.KindNotFound:     http.StatusNotFound,
+	models.KindConflict:     http.StatusConflict,
+	models.KindValidation:   http.StatusBadRequest,
+	models.KindUnauthorized: http.StatusUnauthorized,
+	models.KindForbidden:    http.StatusForbidden,
+	models.KindRateLimited:  http.StatusTooManyRequests,
+	models.KindUnavailable:  http.StatusServiceUnavailable,
+}
+
+// NewProblem describes err for clients. A *models.Error anywhere in the
+// chain decides status and code, and the message of err is shown in full, so
+// it may only wrap it with details meant for clients. Any other error is
+// internal: it is logged, and clients only learn that something went wrong.
+func NewProblem(c *gin.Context, err error) Problem {
+	var appErr *models.Error
+	if !errors.As(err, &appErr) {
+		log.Printf("%s %s (request %s): %v", c.Request.Method, c.Request.URL.Path, CurrentRequestID(c), err)
+		return internalProblem(c)
+	}
+
+	status, ok := kindStatus[appErr.Kind]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+	return Problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    err.Error(),
+		Instance:  c.Request.URL.Path,
+		Code:      appErr.Code,
+		RequestID: CurrentRequestID(c),
+	}
+}
+
+// internalProblem tells clients that something went wrong, and nothing else.
+func internalProblem(c *gin.Context) Problem {
+	return Problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(http.StatusInternalServerError),
+		Status:    http.StatusInternalServerError,
+		Instance:  c.Request.URL.Path,
+		Code:      "internal_error",
+		RequestID: CurrentRequestID(c),
+	}
+}
+
+// WriteProblem aborts the request with problem as response.
+func WriteProblem(c *gin.Context, problem Problem) {
+	c.Header("Content-Type", ProblemContentType)
+	c.AbortWithStatusJSON(problem.Status, problem)
+}
+
+// Errors renders the last error a handler recorded with c.Error as problem
+// details, unless the handler has already written a response. It has to come
+// before every handler whose errors it renders.
+func Errors() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		err := c.Errors.Last()
+		if err == nil || c.Writer.Written() {
+			return
+		}
+		WriteProblem(c, NewProblem(c, err.Err))
+	}
+}
+
+// abortWithError stops the handler chain and records err for Errors.
+func abortWithError(c *gin.Context, err error) {
+	c.Abort()
+	c.Error(err)
+}
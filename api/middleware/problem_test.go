@@ -0,0 +1,72 @@
+package middleware
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aki-0517/go-user-management/models"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrors(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	r := gin.Default()
+	r.Use(Errors())
+	r.GET("/missing", func(c *gin.Context) {
+		c.Error(models.ErrUserNotFound)
+	})
+	r.GET("/wrapped", func(c *gin.Context) {
+		c.Error(fmt.Errorf("%w: name is required", models.ErrInvalidAPIKey))
+	})
+	r.GET("/internal", func(c *gin.Context) {
+		c.Error(errors.New(`pq: relation "users" does not exist`))
+	})
+	r.GET("/written", func(c *gin.Context) {
+		c.Error(errors.New("logged only"))
+		c.String(http.StatusOK, "success")
+	})
+
+	request := func(path string) (*httptest.ResponseRecorder, Problem) {
+		req, _ := http.NewRequest(http.MethodGet, path, nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		var problem Problem
+		json.Unmarshal(w.Body.Bytes(), &problem)
+		return w, problem
+	}
+
+	w, problem := request("/missing")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, ProblemContentType, w.Header().Get("Content-Type"))
+	assert.Equal(t, Problem{
+		Type:     "about:blank",
+		Title:    "Not Found",
+		Status:   http.StatusNotFound,
+		Detail:   "User not found",
+		Instance: "/missing",
+		Code:     "user_not_found",
+	}, problem)
+
+	// Details wrapped around a client error are shown
+	w, problem = request("/wrapped")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "invalid_api_key_request", problem.Code)
+	assert.Equal(t, "Invalid API key: name is required", problem.Detail)
+
+	// Internal errors are not
+	w, problem = request("/internal")
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, "internal_error", problem.Code)
+	assert.Empty(t, problem.Detail)
+	assert.NotContains(t, w.Body.String(), "relation")
+
+	w, _ = request("/written")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "success", w.Body.String())
+}
@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// RequestIDHeader carries the ID of a request, so that log lines and error
+// responses can be matched.
+const RequestIDHeader = "X-Request-ID"
+
+const requestIDContextKey = "request_id"
+
+// validRequestID limits the IDs accepted from clients and proxies to what is
+// safe to log.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// RequestID gives every request an ID and returns it in the X-Request-ID
+// header. An ID set by a proxy in front of the API is kept.
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Request.Header.Get(RequestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = uuid.NewString()
+		}
+		c.Set(requestIDContextKey, id)
+		c.Header(RequestIDHeader, id)
+		c.Next()
+	}
+}
+
+// CurrentRequestID returns the ID RequestID gave the request, or "" on
+// routes that are not behind it.
+func CurrentRequestID(c *gin.Context) string {
+	return c.GetString(requestIDContextKey)
+}
+
+// Recovery turns a panic in a later handler into an internal server error.
+// The panic is logged with its stack trace; clients only get the request ID
+// to report.
+func Recovery() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			// net/http uses this panic to abort a response on purpose.
+			if err, ok := recovered.(error); ok && errors.Is(err, http.ErrAbortHandler) {
+				panic(recovered)
+			}
+
+			log.Printf("panic serving %s %s (request %s): %v\n%s", c.Request.Method, c.Request.URL.Path, CurrentRequestID(c), recovered, debug.Stack())
+			if c.Writer.Written() {
+				c.Abort()
+				return
+			}
+			WriteProblem(c, internalProblem(c))
+		}()
+		c.Next()
+	}
+}
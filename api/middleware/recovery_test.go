@@ -0,0 +1,78 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestID(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	r := gin.New()
+	r.Use(RequestID())
+	r.GET("/test", func(c *gin.Context) {
+		c.String(http.StatusOK, CurrentRequestID(c))
+	})
+
+	request := func(id string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(http.MethodGet, "/test", nil)
+		if id != "" {
+			req.Header.Set(RequestIDHeader, id)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request("")
+	assert.Len(t, w.Header().Get(RequestIDHeader), 36)
+	assert.Equal(t, w.Header().Get(RequestIDHeader), w.Body.String())
+
+	// IDs from a proxy are kept, unless they are unsafe to log
+	w = request("proxy-1234")
+	assert.Equal(t, "proxy-1234", w.Body.String())
+	w = request("bad\nid")
+	assert.NotEqual(t, "bad\nid", w.Body.String())
+	assert.Len(t, w.Body.String(), 36)
+}
+
+func TestRecovery(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	r := gin.New()
+	r.Use(RequestID(), Recovery(), Errors())
+	r.GET("/panic", func(c *gin.Context) {
+		var user map[string]string
+		user["name"] = "secret"
+	})
+
+	req, _ := http.NewRequest(http.MethodGet, "/panic", nil)
+	req.Header.Set(RequestIDHeader, "req-1")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, ProblemContentType, w.Header().Get("Content-Type"))
+	var problem Problem
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &problem))
+	assert.Equal(t, "internal_error", problem.Code)
+	assert.Equal(t, "req-1", problem.RequestID)
+	assert.NotContains(t, w.Body.String(), "nil map")
+
+	// The log has what the response leaves out
+	assert.Contains(t, logs.String(), "request req-1")
+	assert.Contains(t, logs.String(), "assignment to entry in nil map")
+	assert.Contains(t, logs.String(), "recovery_test.go")
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/aki-0517/go-user-management/config"
+	"github.com/aki-0517/go-user-management/migrations"
+	"github.com/aki-0517/go-user-management/util"
+)
+
+const migrateUsage = "usage: migrate up|down|status [flags]"
+
+// migrate runs the migrate command: up applies pending migrations, down
+// reverts the last one and status lists them.
+func migrate(args []string) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+	command := args[0]
+	switch command {
+	case "up", "down", "status":
+	default:
+		return errors.New(migrateUsage)
+	}
+	// Migrations only need the database, so the settings of the API, such
+	// as its signing keys, need not be in place.
+	cfg, err := config.LoadDatabase(args[1:])
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.StartupTimeout)
+	defer cancel()
+	db, err := util.DBConnect(ctx, cfg.Database.DSN())
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %w", err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	defer sqlDB.Close()
+
+	m, err := migrations.New(db)
+	if err != nil {
+		return err
+	}
+
+	switch command {
+	case "up":
+		applied, err := m.Up()
+		for _, migration := range applied {
+			fmt.Println("applied", migration)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Println("no pending migrations")
+		}
+		return err
+	case "down":
+		reverted, err := m.Down()
+		if err != nil {
+			return err
+		}
+		if reverted == nil {
+			fmt.Println("no applied migrations")
+		} else {
+			fmt.Println("reverted", reverted)
+		}
+		return nil
+	case "status":
+		statuses, err := m.Status()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "MIGRATION\tAPPLIED\tNOTE")
+		for _, status := range statuses {
+			applied, note := "pending", ""
+			if status.AppliedAt != nil {
+				applied = status.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			if status.Modified {
+				note = "modified since applied"
+			} else if status.Up == "" {
+				note = "unknown to this binary"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", status.Migration, applied, note)
+		}
+		return w.Flush()
+	}
+	return nil
+}
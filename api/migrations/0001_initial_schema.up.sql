@@ -0,0 +1,152 @@
+-- The schema as it was created by init-db.sql. Statements are idempotent so that
+-- databases set up from that file can adopt migrations.
+
+CREATE EXTENSION IF NOT EXISTS "uuid-ossp";
+
+CREATE TABLE IF NOT EXISTS users (
+    id uuid DEFAULT uuid_generate_v4() NOT NULL,
+    name varchar(255) NOT NULL,
+    email varchar(255) NOT NULL,
+    password varchar(255) NOT NULL,
+    email_verified_at timestamptz,
+    totp_secret varchar(255) NOT NULL DEFAULT '',
+    totp_enabled boolean NOT NULL DEFAULT false,
+    PRIMARY KEY (id)
+);
+
+-- The first version of init-db.sql created users without these columns, and
+-- CREATE TABLE IF NOT EXISTS leaves such a table alone.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified_at timestamptz;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret varchar(255) NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled boolean NOT NULL DEFAULT false;
+
+-- Roles and permissions are seeded by the API on startup (models.SeedRoles).
+CREATE TABLE IF NOT EXISTS permissions (
+    id serial NOT NULL,
+    name varchar(255) NOT NULL UNIQUE,
+    PRIMARY KEY (id)
+);
+
+CREATE TABLE IF NOT EXISTS roles (
+    id serial NOT NULL,
+    name varchar(255) NOT NULL UNIQUE,
+    PRIMARY KEY (id)
+);
+
+CREATE TABLE IF NOT EXISTS role_permissions (
+    role_id integer NOT NULL REFERENCES roles (id) ON DELETE CASCADE,
+    permission_id integer NOT NULL REFERENCES permissions (id) ON DELETE CASCADE,
+    PRIMARY KEY (role_id, permission_id)
+);
+
+CREATE TABLE IF NOT EXISTS user_roles (
+    user_id uuid NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    role_id integer NOT NULL REFERENCES roles (id) ON DELETE CASCADE,
+    PRIMARY KEY (user_id, role_id)
+);
+
+CREATE TABLE IF NOT EXISTS password_reset_tokens (
+    id uuid DEFAULT uuid_generate_v4() NOT NULL,
+    user_id uuid NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    token_hash varchar(255) NOT NULL UNIQUE,
+    expires_at timestamptz NOT NULL,
+    used_at timestamptz,
+    created_at timestamptz,
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_password_reset_tokens_user_id ON password_reset_tokens (user_id);
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    id uuid DEFAULT uuid_generate_v4() NOT NULL,
+    user_id uuid NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    code_hash varchar(255) NOT NULL,
+    used_at timestamptz,
+    created_at timestamptz,
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_recovery_codes_user_id ON recovery_codes (user_id);
+
+CREATE TABLE IF NOT EXISTS web_authn_credentials (
+    id uuid DEFAULT uuid_generate_v4() NOT NULL,
+    user_id uuid NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    credential_id bytea NOT NULL UNIQUE,
+    public_key bytea NOT NULL,
+    attestation_type varchar(255),
+    transports varchar(255),
+    aa_guid bytea,
+    sign_count bigint NOT NULL DEFAULT 0,
+    clone_warning boolean NOT NULL DEFAULT false,
+    created_at timestamptz,
+    last_used_at timestamptz,
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_web_authn_credentials_user_id ON web_authn_credentials (user_id);
+
+CREATE TABLE IF NOT EXISTS identities (
+    id uuid DEFAULT uuid_generate_v4() NOT NULL,
+    user_id uuid NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    provider varchar(255) NOT NULL,
+    subject varchar(255) NOT NULL,
+    email varchar(255),
+    created_at timestamptz,
+    PRIMARY KEY (id)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_identities_provider_subject ON identities (provider, subject);
+CREATE INDEX IF NOT EXISTS idx_identities_user_id ON identities (user_id);
+
+CREATE TABLE IF NOT EXISTS o_auth_clients (
+    id uuid DEFAULT uuid_generate_v4() NOT NULL,
+    client_id varchar(255) NOT NULL UNIQUE,
+    secret_hash varchar(255),
+    name varchar(255) NOT NULL,
+    redirect_uris text,
+    grant_types varchar(255) NOT NULL,
+    scope text,
+    created_at timestamptz,
+    PRIMARY KEY (id)
+);
+
+CREATE TABLE IF NOT EXISTS o_auth_consents (
+    id uuid DEFAULT uuid_generate_v4() NOT NULL,
+    user_id uuid NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    client_id varchar(255) NOT NULL REFERENCES o_auth_clients (client_id) ON DELETE CASCADE,
+    scope text,
+    created_at timestamptz,
+    updated_at timestamptz,
+    PRIMARY KEY (id)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_oauth_consents_user_client ON o_auth_consents (user_id, client_id);
+
+CREATE TABLE IF NOT EXISTS api_keys (
+    id uuid DEFAULT uuid_generate_v4() NOT NULL,
+    user_id uuid NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    name varchar(255) NOT NULL,
+    prefix varchar(255) NOT NULL,
+    key_hash varchar(255) NOT NULL,
+    scope text,
+    expires_at timestamptz,
+    last_used_at timestamptz,
+    created_at timestamptz,
+    PRIMARY KEY (id)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_api_keys_prefix ON api_keys (prefix);
+CREATE INDEX IF NOT EXISTS idx_api_keys_user_id ON api_keys (user_id);
+
+CREATE TABLE IF NOT EXISTS sessions (
+    id uuid DEFAULT uuid_generate_v4() NOT NULL,
+    user_id uuid NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    user_agent text,
+    ip varchar(255),
+    created_at timestamptz,
+    last_seen_at timestamptz,
+    revoked_at timestamptz,
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions (user_id);
@@ -0,0 +1,3 @@
+-- The original case of addresses is lost; only the index is removed.
+
+DROP INDEX IF EXISTS idx_users_email_lower;
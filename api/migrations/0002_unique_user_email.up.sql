@@ -0,0 +1,7 @@
+-- Email addresses are compared case-insensitively, and stored normalized so
+-- that what users see matches what is compared. Fails if two accounts only
+-- differ in the case of their address; those have to be merged by hand.
+
+UPDATE users SET email = lower(trim(email)) WHERE email <> lower(trim(email));
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email_lower ON users (lower(email));
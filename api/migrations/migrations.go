@@ -0,0 +1,293 @@
+// Package migrations versions the database schema. Migrations are pairs of
+// SQL files named <version>_<name>.up.sql and <version>_<name>.down.sql,
+// embedded in the binary and applied in order of their version. Applied
+// migrations are recorded in the schema_migrations table together with a
+// checksum, so that editing a migration after it shipped is noticed.
+package migrations
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+//go:embed *.sql
+var files embed.FS
+
+var (
+	ErrPending          = errors.New("database schema has pending migrations")
+	ErrChecksumMismatch = errors.New("applied migration differs from its file")
+	ErrUnknownVersion   = errors.New("database schema is newer than this binary")
+)
+
+// lockID serializes migrations across processes through a Postgres advisory
+// lock.
+const lockID = 7262796931
+
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Checksum identifies the content of the up migration.
+func (m Migration) Checksum() string {
+	sum := sha256.Sum256([]byte(m.Up))
+	return hex.EncodeToString(sum[:])
+}
+
+func (m Migration) String() string {
+	return fmt.Sprintf("%04d_%s", m.Version, m.Name)
+}
+
+// Status describes a migration known to the binary or recorded in the
+// database. Migrations only recorded in the database have no Up or Down.
+type Status struct {
+	Migration
+	AppliedAt *time.Time
+	// Modified is set when the applied migration no longer matches its file.
+	Modified bool
+}
+
+// appliedMigration is a row of the schema_migrations table.
+type appliedMigration struct {
+	Version   int64 `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	Checksum  string
+	AppliedAt time.Time
+}
+
+func (appliedMigration) TableName() string {
+	return "schema_migrations"
+}
+
+var fileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Load reads the migrations in fsys, ordered by version. Every migration
+// needs both an up and a down file.
+func Load(fsys fs.FS) ([]Migration, error) {
+	names, err := fs.Glob(fsys, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int64]*Migration{}
+	for _, name := range names {
+		match := fileName.FindStringSubmatch(path.Base(name))
+		if match == nil {
+			return nil, fmt.Errorf("invalid migration file name %q", name)
+		}
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version in %q: %w", name, err)
+		}
+		content, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("migration version %d is used by %q and %q", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.Up = string(content)
+		} else {
+			m.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %s needs both an up and a down file", m)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+type Migrator struct {
+	db         *gorm.DB
+	migrations []Migration
+}
+
+// New returns a migrator for the migrations embedded in the binary.
+func New(db *gorm.DB) (*Migrator, error) {
+	migrations, err := Load(files)
+	if err != nil {
+		return nil, err
+	}
+	return NewMigrator(db, migrations), nil
+}
+
+func NewMigrator(db *gorm.DB, migrations []Migration) *Migrator {
+	return &Migrator{db: db, migrations: migrations}
+}
+
+func (m *Migrator) ensureTable(db *gorm.DB) error {
+	return db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+    version bigint NOT NULL,
+    name varchar(255) NOT NULL,
+    checksum varchar(64) NOT NULL,
+    applied_at timestamptz NOT NULL,
+    PRIMARY KEY (version)
+)`).Error
+}
+
+func (m *Migrator) applied(db *gorm.DB) (map[int64]appliedMigration, error) {
+	var rows []appliedMigration
+	if err := db.Order("version").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	applied := make(map[int64]appliedMigration, len(rows))
+	for _, row := range rows {
+		applied[row.Version] = row
+	}
+	return applied, nil
+}
+
+// locked runs fn in a transaction holding the migration lock, so that
+// instances starting together do not apply the same migration twice.
+func (m *Migrator) locked(fn func(tx *gorm.DB) error) error {
+	if err := m.ensureTable(m.db); err != nil {
+		return err
+	}
+	return m.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", lockID).Error; err != nil {
+			return err
+		}
+		return fn(tx)
+	})
+}
+
+// Up applies every pending migration, each in its own transaction, and
+// returns those it applied.
+func (m *Migrator) Up() ([]Migration, error) {
+	var done []Migration
+	for _, migration := range m.migrations {
+		migration := migration
+		applied := false
+		err := m.locked(func(tx *gorm.DB) error {
+			existing, err := m.applied(tx)
+			if err != nil {
+				return err
+			}
+			if _, ok := existing[migration.Version]; ok {
+				return nil
+			}
+			if err := tx.Exec(migration.Up).Error; err != nil {
+				return fmt.Errorf("migration %s: %w", migration, err)
+			}
+			applied = true
+			return tx.Create(&appliedMigration{
+				Version:   migration.Version,
+				Name:      migration.Name,
+				Checksum:  migration.Checksum(),
+				AppliedAt: time.Now(),
+			}).Error
+		})
+		if err != nil {
+			return done, err
+		}
+		if applied {
+			done = append(done, migration)
+		}
+	}
+	return done, nil
+}
+
+// Down reverts the most recently applied migration and returns it, or nil if
+// none is applied.
+func (m *Migrator) Down() (*Migration, error) {
+	var reverted *Migration
+	err := m.locked(func(tx *gorm.DB) error {
+		var last appliedMigration
+		result := tx.Order("version DESC").Limit(1).Find(&last)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		for _, migration := range m.migrations {
+			if migration.Version == last.Version {
+				if err := tx.Exec(migration.Down).Error; err != nil {
+					return fmt.Errorf("migration %s: %w", migration, err)
+				}
+				reverted = &migration
+				return tx.Delete(&last).Error
+			}
+		}
+		return fmt.Errorf("%w: migration %d is not known", ErrUnknownVersion, last.Version)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reverted, nil
+}
+
+// Status lists the migrations known to the binary and those recorded in the
+// database, ordered by version.
+func (m *Migrator) Status() ([]Status, error) {
+	if err := m.ensureTable(m.db); err != nil {
+		return nil, err
+	}
+	applied, err := m.applied(m.db)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]Status, 0, len(m.migrations))
+	for _, migration := range m.migrations {
+		status := Status{Migration: migration}
+		if row, ok := applied[migration.Version]; ok {
+			appliedAt := row.AppliedAt
+			status.AppliedAt = &appliedAt
+			status.Modified = row.Checksum != migration.Checksum()
+			delete(applied, migration.Version)
+		}
+		statuses = append(statuses, status)
+	}
+	for _, row := range applied {
+		appliedAt := row.AppliedAt
+		statuses = append(statuses, Status{
+			Migration: Migration{Version: row.Version, Name: row.Name},
+			AppliedAt: &appliedAt,
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+	return statuses, nil
+}
+
+// Check returns an error unless the database schema is exactly the one the
+// migrations of the binary describe.
+func (m *Migrator) Check() error {
+	statuses, err := m.Status()
+	if err != nil {
+		return err
+	}
+	for _, status := range statuses {
+		switch {
+		case status.Up == "":
+			return fmt.Errorf("%w: migration %s is not known", ErrUnknownVersion, status.Migration)
+		case status.Modified:
+			return fmt.Errorf("%w: %s", ErrChecksumMismatch, status.Migration)
+		case status.AppliedAt == nil:
+			return fmt.Errorf("%w: %s", ErrPending, status.Migration)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package migrations
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+func TestLoad(t *testing.T) {
+	migrations, err := Load(fstest.MapFS{
+		"0002_add_index.up.sql":   {Data: []byte("CREATE INDEX")},
+		"0002_add_index.down.sql": {Data: []byte("DROP INDEX")},
+		"0001_create.up.sql":      {Data: []byte("CREATE TABLE")},
+		"0001_create.down.sql":    {Data: []byte("DROP TABLE")},
+	})
+	assert.Nil(t, err)
+	assert.Len(t, migrations, 2)
+	assert.Equal(t, Migration{Version: 1, Name: "create", Up: "CREATE TABLE", Down: "DROP TABLE"}, migrations[0])
+	assert.Equal(t, "0002_add_index", migrations[1].String())
+	assert.NotEqual(t, migrations[0].Checksum(), migrations[1].Checksum())
+
+	for name, fsys := range map[string]fstest.MapFS{
+		"missing down":      {"0001_create.up.sql": {Data: []byte("CREATE TABLE")}},
+		"invalid name":      {"create.up.sql": {}},
+		"duplicate version": {"0001_a.up.sql": {}, "0001_a.down.sql": {}, "0001_b.up.sql": {}, "0001_b.down.sql": {}},
+	} {
+		_, err := Load(fsys)
+		assert.NotNil(t, err, name)
+	}
+}
+
+func TestEmbeddedMigrations(t *testing.T) {
+	migrations, err := Load(files)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, migrations)
+	assert.Equal(t, int64(1), migrations[0].Version)
+}
+
+// setupTestSchema connects to the test database with a schema of its own, so
+// that migrations do not interfere with the model tests running alongside.
+func setupTestSchema(t *testing.T) *gorm.DB {
+	connStr := "host=localhost port=5432 user=postgres password=password dbname=postgres sslmode=disable"
+	db, err := gorm.Open(postgres.Open(connStr), &gorm.Config{})
+	if err != nil {
+		t.Skip("Postgres is not available: " + err.Error())
+	}
+	assert.Nil(t, db.Exec(`CREATE EXTENSION IF NOT EXISTS "uuid-ossp"`).Error)
+	assert.Nil(t, db.Exec("DROP SCHEMA IF EXISTS migrations_test CASCADE").Error)
+	assert.Nil(t, db.Exec("CREATE SCHEMA migrations_test").Error)
+	sqlDB, _ := db.DB()
+	sqlDB.Close()
+
+	db, err = gorm.Open(postgres.Open(connStr+" search_path=migrations_test,public"), &gorm.Config{})
+	assert.Nil(t, err)
+	t.Cleanup(func() {
+		db.Exec("DROP SCHEMA IF EXISTS migrations_test CASCADE")
+		sqlDB, _ := db.DB()
+		sqlDB.Close()
+	})
+	return db
+}
+
+func TestMigrator(t *testing.T) {
+	db := setupTestSchema(t)
+	m, err := New(db)
+	assert.Nil(t, err)
+
+	assert.ErrorIs(t, m.Check(), ErrPending)
+
+	applied, err := m.Up()
+	assert.Nil(t, err)
+	assert.Len(t, applied, len(m.migrations))
+	assert.Nil(t, m.Check())
+	assert.True(t, db.Migrator().HasTable("users"))
+
+	// Nothing is left to apply
+	applied, err = m.Up()
+	assert.Nil(t, err)
+	assert.Empty(t, applied)
+
+	statuses, err := m.Status()
+	assert.Nil(t, err)
+	for _, status := range statuses {
+		assert.NotNil(t, status.AppliedAt)
+		assert.False(t, status.Modified)
+	}
+
+	// Edited migrations are noticed
+	edited := append([]Migration(nil), m.migrations...)
+	edited[0].Up += "\n-- edited"
+	assert.ErrorIs(t, NewMigrator(db, edited).Check(), ErrChecksumMismatch)
+
+	// So are migrations of a newer binary
+	assert.ErrorIs(t, NewMigrator(db, m.migrations[:0]).Check(), ErrUnknownVersion)
+
+	for range m.migrations {
+		reverted, err := m.Down()
+		assert.Nil(t, err)
+		assert.NotNil(t, reverted)
+	}
+	reverted, err := m.Down()
+	assert.Nil(t, err)
+	assert.Nil(t, reverted)
+	assert.False(t, db.Migrator().HasTable("users"))
+	assert.ErrorIs(t, m.Check(), ErrPending)
+}
+
+func TestMigrateBaselineSchema(t *testing.T) {
+	db := setupTestSchema(t)
+	// The users table as the first version of init-db.sql created it
+	assert.Nil(t, db.Exec(`CREATE TABLE users (
+		id uuid DEFAULT uuid_generate_v4() NOT NULL,
+		name varchar(255) NOT NULL,
+		email varchar(255) NOT NULL,
+		password varchar(255) NOT NULL,
+		PRIMARY KEY (id)
+	)`).Error)
+	assert.Nil(t, db.Exec(`INSERT INTO users (name, email, password) VALUES ('test', 'test@test.com', 'password')`).Error)
+
+	m, err := New(db)
+	assert.Nil(t, err)
+	_, err = m.Up()
+	assert.Nil(t, err)
+	assert.Nil(t, m.Check())
+	for _, column := range []string{"email_verified_at", "totp_secret", "totp_enabled"} {
+		assert.True(t, db.Migrator().HasColumn("users", column), column)
+	}
+
+	var enabled bool
+	assert.Nil(t, db.Raw(`SELECT totp_enabled FROM users WHERE email = 'test@test.com'`).Scan(&enabled).Error)
+	assert.False(t, enabled)
+}
@@ -0,0 +1,157 @@
+package models
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aki-0517/go-user-management/util"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// APIKeyPrefix starts every API key, so that leaked keys are easy to spot.
+const APIKeyPrefix = "gum_"
+
+// apiKeyPrefixLength is the length of the random part of the prefix that
+// identifies a key, i.e. RandomToken(6).
+const apiKeyPrefixLength = 8
+
+// apiKeyUseInterval limits how often the last use of a key is written.
+const apiKeyUseInterval = time.Minute
+
+// ErrInvalidAPIKey is returned for API keys that cannot be created.
+var ErrInvalidAPIKey = ValidationError("invalid_api_key_request", "Invalid API key")
+
+// APIKey lets scripts authenticate as a user without their password. Keys
+// look like gum_<prefix>_<secret>; only the prefix is stored in clear.
+type APIKey struct {
+	ID      uuid.UUID `gorm:"type:uuid;primary_key;default:uuid_generate_v4()" json:"id"`
+	UserID  uuid.UUID `gorm:"type:uuid;not null;index" json:"-"`
+	Name    string    `gorm:"not null" json:"name"`
+	Prefix  string    `gorm:"not null;uniqueIndex" json:"prefix"`
+	KeyHash string    `gorm:"not null" json:"-"`
+	// Scope is a space separated list of permissions the key may exercise.
+	// An empty scope allows everything the user may do.
+	Scope      string     `json:"scope"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+func (k *APIKey) IsExpired() bool {
+	return k.ExpiresAt != nil && time.Now().After(*k.ExpiresAt)
+}
+
+// Allows reports whether permission is within the scope of the key.
+func (k *APIKey) Allows(permission string) bool {
+	return k.Scope == "" || containsField(k.Scope, permission)
+}
+
+// CreateAPIKey creates a key for user and returns it. The key is not stored
+// and cannot be shown again.
+func CreateAPIKey(db *gorm.DB, key *APIKey) (string, error) {
+	if key.Name == "" {
+		return "", fmt.Errorf("%w: name is required", ErrInvalidAPIKey)
+	}
+	for _, permission := range util.ParseScope(key.Scope) {
+		if !isPermission(permission) {
+			return "", fmt.Errorf("%w: unknown permission %s", ErrInvalidAPIKey, permission)
+		}
+	}
+	if key.ExpiresAt != nil && !key.ExpiresAt.After(time.Now()) {
+		return "", fmt.Errorf("%w: expiry must be in the future", ErrInvalidAPIKey)
+	}
+
+	prefix, err := util.RandomToken(6)
+	if err != nil {
+		return "", err
+	}
+	secret, err := util.RandomToken(32)
+	if err != nil {
+		return "", err
+	}
+	plain := APIKeyPrefix + prefix + "_" + secret
+	key.Prefix = APIKeyPrefix + prefix
+	key.KeyHash = util.HashToken(plain)
+	key.LastUsedAt = nil
+
+	if err := db.Create(key).Error; err != nil {
+		return "", err
+	}
+	return plain, nil
+}
+
+func isPermission(name string) bool {
+	for _, permissions := range DefaultRoles {
+		for _, permission := range permissions {
+			if permission == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseAPIKeyPrefix returns the identifying prefix of key, or "" if key is
+// not shaped like an API key.
+func parseAPIKeyPrefix(key string) string {
+	prefixLength := len(APIKeyPrefix) + apiKeyPrefixLength
+	if !strings.HasPrefix(key, APIKeyPrefix) || len(key) <= prefixLength+1 || key[prefixLength] != '_' {
+		return ""
+	}
+	return key[:prefixLength]
+}
+
+// AuthenticateAPIKey returns the stored key matching key and records its
+// use. It returns nil without an error for unknown or expired keys.
+func AuthenticateAPIKey(db *gorm.DB, key string) (*APIKey, error) {
+	prefix := parseAPIKeyPrefix(key)
+	if prefix == "" {
+		return nil, nil
+	}
+
+	var apiKey APIKey
+	result := db.Where("prefix = ?", prefix).First(&apiKey)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, result.Error
+	}
+	if subtle.ConstantTimeCompare([]byte(util.HashToken(key)), []byte(apiKey.KeyHash)) != 1 || apiKey.IsExpired() {
+		return nil, nil
+	}
+
+	now := time.Now()
+	if apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) >= apiKeyUseInterval {
+		if err := db.Model(&apiKey).Update("last_used_at", now).Error; err != nil {
+			return nil, err
+		}
+	}
+	return &apiKey, nil
+}
+
+func GetAPIKeys(db *gorm.DB, userID uuid.UUID) ([]APIKey, error) {
+	var keys []APIKey
+	if err := db.Where("user_id = ?", userID).Order("created_at").Find(&keys).Error; err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// RevokeAPIKey deletes the key with id if it belongs to user.
+func RevokeAPIKey(db *gorm.DB, userID uuid.UUID, id uuid.UUID) (bool, error) {
+	result := db.Where("id = ? AND user_id = ?", id, userID).Delete(&APIKey{})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// RevokeAPIKeys deletes all keys of user.
+func RevokeAPIKeys(db *gorm.DB, userID uuid.UUID) error {
+	return db.Where("user_id = ?", userID).Delete(&APIKey{}).Error
+}
@@ -0,0 +1,70 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAPIKeyPrefix(t *testing.T) {
+	assert.Equal(t, "gum_abcd_-12", parseAPIKeyPrefix("gum_abcd_-12_secret"))
+	assert.Equal(t, "", parseAPIKeyPrefix("gum_abcd_-12_"))
+	assert.Equal(t, "", parseAPIKeyPrefix("gum_abcd_-12secret"))
+	assert.Equal(t, "", parseAPIKeyPrefix("eyJhbGciOiJIUzI1NiJ9"))
+}
+
+func TestAPIKeyAllows(t *testing.T) {
+	assert.True(t, (&APIKey{}).Allows(PermissionUsersList))
+	key := APIKey{Scope: PermissionUsersRead}
+	assert.True(t, key.Allows(PermissionUsersRead))
+	assert.False(t, key.Allows(PermissionUsersList))
+}
+
+func TestAPIKey(t *testing.T) {
+	db := setupTestDB()
+	defer teardownTestDB(db)
+
+	user, _ := CreateUser(db, User{Name: "test", Email: "test@test.com", Password: "test"}, testPasswordCost)
+
+	_, err := CreateAPIKey(db, &APIKey{UserID: user.ID, Name: "ci", Scope: "users:fly"})
+	assert.ErrorIs(t, err, ErrInvalidAPIKey)
+
+	key := APIKey{UserID: user.ID, Name: "ci", Scope: PermissionUsersRead}
+	plain, err := CreateAPIKey(db, &key)
+	assert.Nil(t, err)
+	assert.Equal(t, key.Prefix, parseAPIKeyPrefix(plain))
+
+	authenticated, err := AuthenticateAPIKey(db, plain)
+	assert.Nil(t, err)
+	assert.Equal(t, key.ID, authenticated.ID)
+	assert.NotNil(t, authenticated.LastUsedAt)
+
+	// The prefix alone does not authenticate
+	authenticated, err = AuthenticateAPIKey(db, key.Prefix+"_guess")
+	assert.Nil(t, err)
+	assert.Nil(t, authenticated)
+
+	// Expired keys do not authenticate
+	expired := time.Now().Add(-time.Hour)
+	db.Model(&key).Update("expires_at", expired)
+	authenticated, _ = AuthenticateAPIKey(db, plain)
+	assert.Nil(t, authenticated)
+
+	keys, err := GetAPIKeys(db, user.ID)
+	assert.Nil(t, err)
+	assert.Len(t, keys, 1)
+
+	revoked, err := RevokeAPIKey(db, user.ID, key.ID)
+	assert.Nil(t, err)
+	assert.True(t, revoked)
+	revoked, _ = RevokeAPIKey(db, user.ID, key.ID)
+	assert.False(t, revoked)
+
+	// All keys of a user can be revoked at once
+	CreateAPIKey(db, &APIKey{UserID: user.ID, Name: "first", Scope: PermissionUsersRead})
+	CreateAPIKey(db, &APIKey{UserID: user.ID, Name: "second", Scope: PermissionUsersRead})
+	assert.Nil(t, RevokeAPIKeys(db, user.ID))
+	keys, _ = GetAPIKeys(db, user.ID)
+	assert.Empty(t, keys)
+}
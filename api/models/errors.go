@@ -0,0 +1,76 @@
+package models
+
+import "errors"
+
+// ErrorKind says what went wrong in terms a client can act on; it decides the
+// HTTP status of the response.
+type ErrorKind int
+
+const (
+	KindNotFound ErrorKind = iota + 1
+	KindConflict
+	KindValidation
+	KindUnauthorized
+	KindForbidden
+	KindRateLimited
+	KindUnavailable
+)
+
+// Error is an error meant for clients. Any other error is internal, and its
+// message is not shown to them.
+type Error struct {
+	Kind ErrorKind
+	// Code identifies the error for programs and does not change between
+	// releases.
+	Code string
+	// Message explains the error to people.
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func NotFoundError(code string, message string) *Error {
+	return &Error{Kind: KindNotFound, Code: code, Message: message}
+}
+
+func ConflictError(code string, message string) *Error {
+	return &Error{Kind: KindConflict, Code: code, Message: message}
+}
+
+func ValidationError(code string, message string) *Error {
+	return &Error{Kind: KindValidation, Code: code, Message: message}
+}
+
+func UnauthorizedError(code string, message string) *Error {
+	return &Error{Kind: KindUnauthorized, Code: code, Message: message}
+}
+
+func ForbiddenError(code string, message string) *Error {
+	return &Error{Kind: KindForbidden, Code: code, Message: message}
+}
+
+func RateLimitedError(code string, message string) *Error {
+	return &Error{Kind: KindRateLimited, Code: code, Message: message}
+}
+
+func UnavailableError(code string, message string) *Error {
+	return &Error{Kind: KindUnavailable, Code: code, Message: message}
+}
+
+// KindOf returns the kind of the first Error in err's chain, or 0 if err is
+// internal.
+func KindOf(err error) ErrorKind {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+	return 0
+}
+
+// ErrUserNotFound is returned for users that do not exist.
+var ErrUserNotFound = NotFoundError("user_not_found", "User not found")
+
+// ErrRateLimited is returned for requests over a rate limit.
+var ErrRateLimited = RateLimitedError("rate_limited", "Too many requests")
@@ -0,0 +1,172 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"github.com/aki-0517/go-user-management/util"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/gorm"
+)
+
+// ErrIdentityConflict is returned when an external identity claims the email
+// of an existing account that cannot safely be linked to it.
+var ErrIdentityConflict = ConflictError("identity_conflict", "An account with this email already exists and cannot be linked until its address is verified")
+
+// ErrIdentityEmailMissing is returned when an external identity comes
+// without the email address every account needs.
+var ErrIdentityEmailMissing = ValidationError("identity_email_missing", "The identity provider did not share an email address")
+
+// Identity links an account at an external identity provider to a user.
+type Identity struct {
+	ID        uuid.UUID `gorm:"type:uuid;primary_key;default:uuid_generate_v4()"`
+	UserID    uuid.UUID `gorm:"type:uuid;not null;index"`
+	Provider  string    `gorm:"not null;uniqueIndex:idx_identities_provider_subject"`
+	Subject   string    `gorm:"not null;uniqueIndex:idx_identities_provider_subject"`
+	Email     string
+	CreatedAt time.Time
+}
+
+// GetIdentity returns the identity of subject at provider, or nil if it has
+// not been seen before.
+func GetIdentity(db *gorm.DB, provider string, subject string) (*Identity, error) {
+	var identity Identity
+	result := db.Where("provider = ? AND subject = ?", provider, subject).First(&identity)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, result.Error
+	}
+	return &identity, nil
+}
+
+// identityIndex is the unique index on the provider and subject of
+// identities.
+const identityIndex = "idx_identities_provider_subject"
+
+// errIdentityLinked is returned by linkIdentity when the identity has been
+// linked since it was looked up.
+var errIdentityLinked = errors.New("identity is already linked")
+
+// ResolveIdentity returns the user an external identity logs in as.
+//
+// Known identities map to their user. Otherwise the identity is linked to
+// the account with the same email, but only if both the provider and this
+// service have verified that address; linking to an unverified account would
+// hand it to whoever registered it first. If there is no such account, a
+// new one is created, its random password hashed at passwordCost.
+//
+// Concurrent first logins with the same identity resolve to the same user:
+// the unique indexes on identities and email addresses decide which of them
+// links or creates it, and the others read it back.
+func ResolveIdentity(db *gorm.DB, users UserRepository, provider string, external util.OIDCIdentity, passwordCost int) (*User, error) {
+	user, err := identityUser(db, users, provider, external.Subject)
+	if err != nil || user != nil {
+		return user, err
+	}
+
+	if external.Email == "" {
+		return nil, ErrIdentityEmailMissing
+	}
+	user, err = users.GetByEmail(external.Email)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		user, err = createUserFromIdentity(db, users, provider, external, passwordCost)
+		if !errors.Is(err, ErrEmailTaken) {
+			return user, err
+		}
+		// An account with the address was created since it was looked up,
+		// possibly by another login with the identity
+		user, err = identityUser(db, users, provider, external.Subject)
+		if err != nil || user != nil {
+			return user, err
+		}
+		user, err = users.GetByEmail(external.Email)
+		if err != nil {
+			return nil, err
+		}
+		if user == nil {
+			return nil, ErrIdentityConflict
+		}
+	}
+
+	if !external.EmailVerified || !user.IsEmailVerified() {
+		return nil, ErrIdentityConflict
+	}
+	err = linkIdentity(db, user.ID, provider, external)
+	if errors.Is(err, errIdentityLinked) {
+		return identityUser(db, users, provider, external.Subject)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// identityUser returns the user the identity of subject at provider is
+// linked to, or nil if it is not linked.
+func identityUser(db *gorm.DB, users UserRepository, provider string, subject string) (*User, error) {
+	identity, err := GetIdentity(db, provider, subject)
+	if err != nil || identity == nil {
+		return nil, err
+	}
+	return users.GetByID(identity.UserID)
+}
+
+func linkIdentity(db *gorm.DB, userID uuid.UUID, provider string, external util.OIDCIdentity) error {
+	err := db.Create(&Identity{
+		UserID:   userID,
+		Provider: provider,
+		Subject:  external.Subject,
+		Email:    external.Email,
+	}).Error
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation && pgErr.ConstraintName == identityIndex {
+		return errIdentityLinked
+	}
+	return err
+}
+
+// createUserFromIdentity signs up a user who has no password; they can set
+// one through the password reset flow. It returns ErrEmailTaken if an
+// account with the address exists.
+func createUserFromIdentity(db *gorm.DB, users UserRepository, provider string, external util.OIDCIdentity, passwordCost int) (*User, error) {
+	password, err := util.RandomToken(32)
+	if err != nil {
+		return nil, err
+	}
+	name := external.Name
+	if name == "" {
+		name = external.Email
+	}
+
+	user, err := users.Create(User{Name: name, Email: external.Email, Password: password}, passwordCost)
+	if err != nil {
+		return nil, err
+	}
+	if external.EmailVerified {
+		now := time.Now()
+		verified, err := users.Update(user.ID, UserChanges{EmailVerifiedAt: &now})
+		if err != nil {
+			users.Delete(user)
+			return nil, err
+		}
+		user = verified
+	}
+	err = linkIdentity(db, user.ID, provider, external)
+	if errors.Is(err, errIdentityLinked) {
+		// Another login with the identity linked it to this account, the
+		// only one with the address.
+		return identityUser(db, users, provider, external.Subject)
+	}
+	if err != nil {
+		// Nobody could log in to the account without the identity
+		users.Delete(user)
+		return nil, err
+	}
+	return user, nil
+}
@@ -0,0 +1,122 @@
+package models
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aki-0517/go-user-management/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveIdentityCreatesUser(t *testing.T) {
+	db := setupTestDB()
+	defer teardownTestDB(db)
+
+	external := util.OIDCIdentity{Subject: "subject", Email: "test@test.com", EmailVerified: true, Name: "test"}
+	user, err := ResolveIdentity(db, NewGormUserRepository(db), "mock", external, testPasswordCost)
+	assert.Nil(t, err)
+	assert.Equal(t, "test@test.com", user.Email)
+	assert.True(t, user.IsEmailVerified())
+
+	// Logging in again finds the same user
+	again, err := ResolveIdentity(db, NewGormUserRepository(db), "mock", external, testPasswordCost)
+	assert.Nil(t, err)
+	assert.Equal(t, user.ID, again.ID)
+
+	// Every account needs an email address
+	_, err = ResolveIdentity(db, NewGormUserRepository(db), "mock", util.OIDCIdentity{Subject: "other"}, testPasswordCost)
+	assert.ErrorIs(t, err, ErrIdentityEmailMissing)
+}
+
+func TestResolveIdentityLinksVerifiedEmail(t *testing.T) {
+	db := setupTestDB()
+	defer teardownTestDB(db)
+
+	user, _ := CreateUser(db, User{Name: "test", Email: "test@test.com", Password: "test"}, testPasswordCost)
+	external := util.OIDCIdentity{Subject: "subject", Email: "test@test.com", EmailVerified: true}
+
+	// Accounts whose owner has not proven the address are not linked
+	_, err := ResolveIdentity(db, NewGormUserRepository(db), "mock", external, testPasswordCost)
+	assert.ErrorIs(t, err, ErrIdentityConflict)
+
+	now := time.Now()
+	UpdateUser(db, user.ID, UserChanges{EmailVerifiedAt: &now})
+
+	// and neither are addresses the provider has not verified
+	_, err = ResolveIdentity(db, NewGormUserRepository(db), "mock", util.OIDCIdentity{Subject: "subject", Email: "test@test.com"}, testPasswordCost)
+	assert.ErrorIs(t, err, ErrIdentityConflict)
+
+	linked, err := ResolveIdentity(db, NewGormUserRepository(db), "mock", external, testPasswordCost)
+	assert.Nil(t, err)
+	assert.Equal(t, user.ID, linked.ID)
+
+	identity, err := GetIdentity(db, "mock", "subject")
+	assert.Nil(t, err)
+	assert.Equal(t, user.ID, identity.UserID)
+}
+
+func TestResolveIdentityConcurrentFirstLogins(t *testing.T) {
+	db := setupTestDB()
+	defer teardownTestDB(db)
+	users := NewGormUserRepository(db)
+
+	user, _ := CreateUser(db, User{Name: "test", Email: "test@test.com", Password: "test"}, testPasswordCost)
+	now := time.Now()
+	UpdateUser(db, user.ID, UserChanges{EmailVerifiedAt: &now})
+
+	// Every login gets the account, whichever of them links it
+	external := util.OIDCIdentity{Subject: "subject", Email: "test@test.com", EmailVerified: true}
+	results := make(chan *User, 5)
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resolved, err := ResolveIdentity(db, users, "mock", external, testPasswordCost)
+			assert.Nil(t, err)
+			results <- resolved
+		}()
+	}
+	wg.Wait()
+	close(results)
+	for resolved := range results {
+		if assert.NotNil(t, resolved) {
+			assert.Equal(t, user.ID, resolved.ID)
+		}
+	}
+}
+
+// racingUserRepository lets another login create the user just before its
+// own Create.
+type racingUserRepository struct {
+	UserRepository
+	race func()
+}
+
+func (r *racingUserRepository) Create(user User, passwordCost int) (*User, error) {
+	r.race()
+	return r.UserRepository.Create(user, passwordCost)
+}
+
+func TestResolveIdentityConcurrentUnverifiedFirstLogins(t *testing.T) {
+	db := setupTestDB()
+	defer teardownTestDB(db)
+	users := NewGormUserRepository(db)
+
+	// The account the other login creates is not verified, but it is linked
+	// to the identity, so this login gets it too
+	external := util.OIDCIdentity{Subject: "subject", Email: "test@test.com"}
+	var created *User
+	racing := &racingUserRepository{UserRepository: users, race: func() {
+		var err error
+		created, err = ResolveIdentity(db, users, "mock", external, testPasswordCost)
+		assert.Nil(t, err)
+	}}
+	resolved, err := ResolveIdentity(db, racing, "mock", external, testPasswordCost)
+	assert.Nil(t, err)
+	if assert.NotNil(t, created) && assert.NotNil(t, resolved) {
+		assert.Equal(t, created.ID, resolved.ID)
+		assert.False(t, resolved.IsEmailVerified())
+	}
+}
@@ -0,0 +1,119 @@
+package models
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// MemoryUserRepository keeps users in memory, for tests and local
+// development. It is safe for concurrent use.
+type MemoryUserRepository struct {
+	mu    sync.RWMutex
+	users map[uuid.UUID]User
+}
+
+func NewMemoryUserRepository() *MemoryUserRepository {
+	return &MemoryUserRepository{users: map[uuid.UUID]User{}}
+}
+
+// defaultRole is the role new users get, as SeedRoles would store it.
+func defaultRole() Role {
+	role := Role{Name: RoleUser}
+	for _, name := range DefaultRoles[RoleUser] {
+		role.Permissions = append(role.Permissions, Permission{Name: name})
+	}
+	return role
+}
+
+// copyUser returns user with its own roles, so that callers cannot change
+// what is stored.
+func copyUser(user User) *User {
+	user.Roles = append([]Role(nil), user.Roles...)
+	return &user
+}
+
+// emailTaken reports whether an account other than user has its email
+// address, like the unique index of the database does. r.mu must be held.
+func (r *MemoryUserRepository) emailTaken(user User) bool {
+	for _, existing := range r.users {
+		if existing.ID != user.ID && existing.Email == user.Email {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *MemoryUserRepository) Create(user User, passwordCost int) (*User, error) {
+	if err := prepareNewUser(&user, passwordCost); err != nil {
+		return nil, err
+	}
+	user.ID = uuid.New()
+	user.Roles = []Role{defaultRole()}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.emailTaken(user) {
+		return nil, ErrEmailTaken
+	}
+	r.users[user.ID] = user
+	return copyUser(user), nil
+}
+
+func (r *MemoryUserRepository) List() ([]User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	users := make([]User, 0, len(r.users))
+	for _, user := range r.users {
+		users = append(users, *copyUser(user))
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Email < users[j].Email })
+	return users, nil
+}
+
+func (r *MemoryUserRepository) GetByID(id uuid.UUID) (*User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	user, ok := r.users[id]
+	if !ok {
+		return nil, nil
+	}
+	return copyUser(user), nil
+}
+
+func (r *MemoryUserRepository) GetByEmail(email string) (*User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, user := range r.users {
+		if user.Email == NormalizeEmail(email) {
+			return copyUser(user), nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *MemoryUserRepository) Update(id uuid.UUID, changes UserChanges) (*User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	user, ok := r.users[id]
+	if !ok {
+		return nil, nil
+	}
+	changes.apply(&user)
+	if r.emailTaken(user) {
+		return nil, ErrEmailTaken
+	}
+	r.users[id] = user
+	return copyUser(user), nil
+}
+
+func (r *MemoryUserRepository) Delete(user *User) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.users[user.ID]; !ok {
+		return false, nil
+	}
+	delete(r.users, user.ID)
+	return true, nil
+}
@@ -0,0 +1,154 @@
+package models
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aki-0517/go-user-management/util"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// OAuth grant types a client can be registered for.
+const (
+	GrantAuthorizationCode = "authorization_code"
+	GrantClientCredentials = "client_credentials"
+	GrantRefreshToken      = "refresh_token"
+)
+
+// ErrInvalidOAuthClient is returned for client registrations that cannot be
+// accepted.
+var ErrInvalidOAuthClient = ValidationError("invalid_client_metadata", "Invalid client registration")
+
+// OAuthClient is an application that obtains tokens from this service.
+// Clients without a secret are public, e.g. single page or mobile apps, and
+// have to use PKCE.
+type OAuthClient struct {
+	ID         uuid.UUID `gorm:"type:uuid;primary_key;default:uuid_generate_v4()"`
+	ClientID   string    `gorm:"not null;uniqueIndex"`
+	SecretHash string
+	Name       string `gorm:"not null"`
+	// RedirectURIs, GrantTypes and Scope are space separated lists.
+	RedirectURIs string
+	GrantTypes   string `gorm:"not null"`
+	Scope        string
+	CreatedAt    time.Time
+}
+
+func (c *OAuthClient) IsPublic() bool {
+	return c.SecretHash == ""
+}
+
+func (c *OAuthClient) CheckSecret(secret string) bool {
+	if c.IsPublic() {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(util.HashToken(secret)), []byte(c.SecretHash)) == 1
+}
+
+// HasRedirectURI reports whether uri is registered. Redirect URIs are
+// compared exactly.
+func (c *OAuthClient) HasRedirectURI(uri string) bool {
+	return containsField(c.RedirectURIs, uri)
+}
+
+func (c *OAuthClient) AllowsGrant(grantType string) bool {
+	return containsField(c.GrantTypes, grantType)
+}
+
+func containsField(list string, value string) bool {
+	for _, field := range strings.Fields(list) {
+		if field == value {
+			return true
+		}
+	}
+	return false
+}
+
+// validRedirectURI reports whether codes may be sent to uri. Plain http is
+// only accepted for loopback addresses, where native apps listen (RFC 8252
+// section 7.3); anywhere else it would expose codes on the network.
+func validRedirectURI(uri string) bool {
+	parsed, err := url.Parse(uri)
+	if err != nil || parsed.Host == "" || parsed.Fragment != "" {
+		return false
+	}
+	switch parsed.Scheme {
+	case "https":
+		return true
+	case "http":
+		host := parsed.Hostname()
+		if host == "localhost" {
+			return true
+		}
+		ip := net.ParseIP(host)
+		return ip != nil && ip.IsLoopback()
+	}
+	return false
+}
+
+// CreateOAuthClient registers client and returns its secret, which is not
+// stored and cannot be shown again. Public clients get no secret.
+func CreateOAuthClient(db *gorm.DB, client *OAuthClient, public bool) (string, error) {
+	if client.Name == "" || client.GrantTypes == "" {
+		return "", fmt.Errorf("%w: name and grant types are required", ErrInvalidOAuthClient)
+	}
+	for _, grantType := range util.ParseScope(client.GrantTypes) {
+		switch grantType {
+		case GrantAuthorizationCode, GrantRefreshToken:
+		case GrantClientCredentials:
+			if public {
+				return "", fmt.Errorf("%w: public clients cannot use the client credentials grant", ErrInvalidOAuthClient)
+			}
+		default:
+			return "", fmt.Errorf("%w: unsupported grant type %s", ErrInvalidOAuthClient, grantType)
+		}
+	}
+	for _, uri := range strings.Fields(client.RedirectURIs) {
+		if !validRedirectURI(uri) {
+			return "", fmt.Errorf("%w: invalid redirect URI %s", ErrInvalidOAuthClient, uri)
+		}
+	}
+	if client.AllowsGrant(GrantAuthorizationCode) && client.RedirectURIs == "" {
+		return "", fmt.Errorf("%w: redirect URIs are required for the authorization code grant", ErrInvalidOAuthClient)
+	}
+
+	clientID, err := util.RandomToken(16)
+	if err != nil {
+		return "", err
+	}
+	client.ClientID = clientID
+
+	var secret string
+	client.SecretHash = ""
+	if !public {
+		secret, err = util.RandomToken(32)
+		if err != nil {
+			return "", err
+		}
+		client.SecretHash = util.HashToken(secret)
+	}
+
+	if err := db.Create(client).Error; err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// GetOAuthClient returns the client with clientID, or nil if there is none.
+func GetOAuthClient(db *gorm.DB, clientID string) (*OAuthClient, error) {
+	var client OAuthClient
+	result := db.Where("client_id = ?", clientID).First(&client)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, result.Error
+	}
+	return &client, nil
+}
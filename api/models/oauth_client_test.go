@@ -0,0 +1,70 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOAuthClient(t *testing.T) {
+	db := setupTestDB()
+	defer teardownTestDB(db)
+
+	client := OAuthClient{
+		Name:         "app",
+		RedirectURIs: "https://app.example.com/callback",
+		GrantTypes:   GrantAuthorizationCode + " " + GrantRefreshToken,
+		Scope:        "openid profile",
+	}
+	secret, err := CreateOAuthClient(db, &client, false)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, secret)
+
+	found, err := GetOAuthClient(db, client.ClientID)
+	assert.Nil(t, err)
+	assert.False(t, found.IsPublic())
+	assert.True(t, found.CheckSecret(secret))
+	assert.False(t, found.CheckSecret("wrong"))
+	assert.True(t, found.HasRedirectURI("https://app.example.com/callback"))
+	assert.False(t, found.HasRedirectURI("https://app.example.com/callback/other"))
+	assert.True(t, found.AllowsGrant(GrantRefreshToken))
+	assert.False(t, found.AllowsGrant(GrantClientCredentials))
+
+	found, err = GetOAuthClient(db, "unknown")
+	assert.Nil(t, err)
+	assert.Nil(t, found)
+}
+
+func TestCreateOAuthClientValidation(t *testing.T) {
+	db := setupTestDB()
+	defer teardownTestDB(db)
+
+	for _, client := range []OAuthClient{
+		{Name: "app", GrantTypes: "implicit"},
+		{Name: "app", GrantTypes: GrantAuthorizationCode},
+		{Name: "app", GrantTypes: GrantAuthorizationCode, RedirectURIs: "/relative"},
+		{Name: "app", GrantTypes: GrantAuthorizationCode, RedirectURIs: "http://app.example.com/callback"},
+		{Name: "app", GrantTypes: GrantAuthorizationCode, RedirectURIs: "javascript:alert(1)"},
+		{Name: "app", GrantTypes: GrantAuthorizationCode, RedirectURIs: "https://app.example.com/callback#fragment"},
+	} {
+		_, err := CreateOAuthClient(db, &client, false)
+		assert.ErrorIs(t, err, ErrInvalidOAuthClient)
+	}
+
+	// Public clients cannot keep a secret, so they cannot act on their own
+	_, err := CreateOAuthClient(db, &OAuthClient{Name: "spa", GrantTypes: GrantClientCredentials}, true)
+	assert.ErrorIs(t, err, ErrInvalidOAuthClient)
+
+	// Native apps may listen on loopback addresses over plain http
+	for _, uri := range []string{"http://127.0.0.1:8080/callback", "http://[::1]/callback", "http://localhost:3000/"} {
+		_, err = CreateOAuthClient(db, &OAuthClient{Name: "cli", GrantTypes: GrantAuthorizationCode, RedirectURIs: uri}, true)
+		assert.Nil(t, err)
+	}
+
+	public := OAuthClient{Name: "spa", GrantTypes: GrantAuthorizationCode, RedirectURIs: "https://spa.example.com/"}
+	secret, err := CreateOAuthClient(db, &public, true)
+	assert.Nil(t, err)
+	assert.Empty(t, secret)
+	assert.True(t, public.IsPublic())
+	assert.False(t, public.CheckSecret(""))
+}
@@ -0,0 +1,86 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/aki-0517/go-user-management/util"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// OAuthConsent records the scopes a user has allowed a client, so that they
+// are only asked again when a client wants more.
+type OAuthConsent struct {
+	ID        uuid.UUID `gorm:"type:uuid;primary_key;default:uuid_generate_v4()" json:"-"`
+	UserID    uuid.UUID `gorm:"type:uuid;not null;uniqueIndex:idx_oauth_consents_user_client" json:"-"`
+	ClientID  string    `gorm:"not null;uniqueIndex:idx_oauth_consents_user_client" json:"client_id"`
+	Scope     string    `json:"scope"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// GetOAuthConsent returns the consent of user for clientID, or nil if there
+// is none.
+func GetOAuthConsent(db *gorm.DB, userID uuid.UUID, clientID string) (*OAuthConsent, error) {
+	var consent OAuthConsent
+	result := db.Where("user_id = ? AND client_id = ?", userID, clientID).First(&consent)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, result.Error
+	}
+	return &consent, nil
+}
+
+// HasOAuthConsent reports whether user has allowed clientID every scope in
+// scope.
+func HasOAuthConsent(db *gorm.DB, userID uuid.UUID, clientID string, scope string) (bool, error) {
+	consent, err := GetOAuthConsent(db, userID, clientID)
+	if err != nil || consent == nil {
+		return false, err
+	}
+	return util.ScopeIncludes(consent.Scope, scope), nil
+}
+
+// GrantOAuthConsent adds scope to what user has allowed clientID.
+func GrantOAuthConsent(db *gorm.DB, userID uuid.UUID, clientID string, scope string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		consent, err := GetOAuthConsent(tx, userID, clientID)
+		if err != nil {
+			return err
+		}
+		if consent == nil {
+			return tx.Create(&OAuthConsent{UserID: userID, ClientID: clientID, Scope: scope}).Error
+		}
+
+		scopes := util.ParseScope(consent.Scope)
+		for _, s := range util.ParseScope(scope) {
+			if !util.ScopeIncludes(consent.Scope, s) {
+				scopes = append(scopes, s)
+			}
+		}
+		consent.Scope = strings.Join(scopes, " ")
+		return tx.Save(consent).Error
+	})
+}
+
+func GetOAuthConsents(db *gorm.DB, userID uuid.UUID) ([]OAuthConsent, error) {
+	var consents []OAuthConsent
+	if err := db.Where("user_id = ?", userID).Order("created_at").Find(&consents).Error; err != nil {
+		return nil, err
+	}
+	return consents, nil
+}
+
+// RevokeOAuthConsent forgets what user has allowed clientID. Since refreshing
+// requires consent, refresh tokens the client holds stop working as well.
+func RevokeOAuthConsent(db *gorm.DB, userID uuid.UUID, clientID string) (bool, error) {
+	result := db.Where("user_id = ? AND client_id = ?", userID, clientID).Delete(&OAuthConsent{})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
@@ -0,0 +1,37 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOAuthConsent(t *testing.T) {
+	db := setupTestDB()
+	defer teardownTestDB(db)
+
+	user, _ := CreateUser(db, User{Name: "test", Email: "test@test.com", Password: "test"}, testPasswordCost)
+
+	consented, err := HasOAuthConsent(db, user.ID, "client", "openid")
+	assert.Nil(t, err)
+	assert.False(t, consented)
+
+	assert.Nil(t, GrantOAuthConsent(db, user.ID, "client", "openid profile"))
+	assert.Nil(t, GrantOAuthConsent(db, user.ID, "client", "profile email"))
+
+	// Consents accumulate
+	consented, err = HasOAuthConsent(db, user.ID, "client", "openid email")
+	assert.Nil(t, err)
+	assert.True(t, consented)
+
+	consents, err := GetOAuthConsents(db, user.ID)
+	assert.Nil(t, err)
+	assert.Len(t, consents, 1)
+	assert.Equal(t, "openid profile email", consents[0].Scope)
+
+	revoked, err := RevokeOAuthConsent(db, user.ID, "client")
+	assert.Nil(t, err)
+	assert.True(t, revoked)
+	consented, _ = HasOAuthConsent(db, user.ID, "client", "openid")
+	assert.False(t, consented)
+}
@@ -0,0 +1,92 @@
+package models
+
+import (
+	"time"
+
+	"github.com/aki-0517/go-user-management/util"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// PasswordResetToken is a one-time token emailed to a user who forgot their
+// password. Only the hash of the token is stored.
+type PasswordResetToken struct {
+	ID        uuid.UUID `gorm:"type:uuid;primary_key;default:uuid_generate_v4()"`
+	UserID    uuid.UUID `gorm:"type:uuid;not null;index"`
+	TokenHash string    `gorm:"not null;uniqueIndex"`
+	ExpiresAt time.Time `gorm:"not null"`
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+// CreatePasswordResetToken issues a reset token for userID and returns it in
+// plain text. Tokens issued earlier and not yet used stop working.
+func CreatePasswordResetToken(db *gorm.DB, userID uuid.UUID, ttl time.Duration) (string, error) {
+	token, err := util.RandomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ? AND used_at IS NULL", userID).Delete(&PasswordResetToken{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&PasswordResetToken{
+			UserID:    userID,
+			TokenHash: util.HashToken(token),
+			ExpiresAt: time.Now().Add(ttl),
+		}).Error
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// ConsumePasswordResetToken marks token as used and returns it. It returns
+// nil without an error if the token is unknown, expired or already used.
+func ConsumePasswordResetToken(db *gorm.DB, token string) (*PasswordResetToken, error) {
+	var resetToken PasswordResetToken
+	now := time.Now()
+
+	// The conditional update makes redeeming atomic: of two concurrent
+	// requests with the same token only one affects a row.
+	result := db.Model(&PasswordResetToken{}).
+		Where("token_hash = ? AND used_at IS NULL AND expires_at > ?", util.HashToken(token), now).
+		Update("used_at", now)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, nil
+	}
+
+	if err := db.Where("token_hash = ?", util.HashToken(token)).First(&resetToken).Error; err != nil {
+		return nil, err
+	}
+	return &resetToken, nil
+}
+
+// ResetPassword redeems token and, in the same transaction, sets the password
+// of the user it was issued to and calls revoke to end whatever the old
+// password gave access to. If any of it fails the token stays usable. It
+// returns nil without an error if the token is unknown, expired or already
+// used.
+func ResetPassword(db *gorm.DB, token string, hashedPassword string, revoke func(tx *gorm.DB, userID uuid.UUID) error) (*PasswordResetToken, error) {
+	var resetToken *PasswordResetToken
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		resetToken, err = ConsumePasswordResetToken(tx, token)
+		if err != nil || resetToken == nil {
+			return err
+		}
+		if err := tx.Model(&User{}).Where("id = ?", resetToken.UserID).Update("password", hashedPassword).Error; err != nil {
+			return err
+		}
+		return revoke(tx, resetToken.UserID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resetToken, nil
+}
@@ -0,0 +1,55 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPasswordResetToken(t *testing.T) {
+	db := setupTestDB()
+	defer teardownTestDB(db)
+
+	user, _ := CreateUser(db, User{Name: "test", Email: "test@test.com", Password: "test"}, testPasswordCost)
+
+	token, err := CreatePasswordResetToken(db, user.ID, time.Hour)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, token)
+
+	resetToken, err := ConsumePasswordResetToken(db, token)
+	assert.Nil(t, err)
+	assert.NotNil(t, resetToken)
+	assert.Equal(t, user.ID, resetToken.UserID)
+	assert.NotNil(t, resetToken.UsedAt)
+
+	// Tokens are single-use
+	resetToken, err = ConsumePasswordResetToken(db, token)
+	assert.Nil(t, err)
+	assert.Nil(t, resetToken)
+
+	resetToken, err = ConsumePasswordResetToken(db, "unknown")
+	assert.Nil(t, err)
+	assert.Nil(t, resetToken)
+}
+
+func TestPasswordResetTokenExpiryAndReplacement(t *testing.T) {
+	db := setupTestDB()
+	defer teardownTestDB(db)
+
+	user, _ := CreateUser(db, User{Name: "test", Email: "test@test.com", Password: "test"}, testPasswordCost)
+
+	expired, _ := CreatePasswordResetToken(db, user.ID, -time.Minute)
+	resetToken, err := ConsumePasswordResetToken(db, expired)
+	assert.Nil(t, err)
+	assert.Nil(t, resetToken)
+
+	// Requesting a new token invalidates the previous one
+	first, _ := CreatePasswordResetToken(db, user.ID, time.Hour)
+	second, _ := CreatePasswordResetToken(db, user.ID, time.Hour)
+
+	resetToken, _ = ConsumePasswordResetToken(db, first)
+	assert.Nil(t, resetToken)
+	resetToken, _ = ConsumePasswordResetToken(db, second)
+	assert.NotNil(t, resetToken)
+}
@@ -0,0 +1,89 @@
+package models
+
+import (
+	"crypto/rand"
+	"strings"
+	"time"
+
+	"github.com/aki-0517/go-user-management/util"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// RecoveryCodeCount is the number of recovery codes issued at once.
+const RecoveryCodeCount = 10
+
+const recoveryCodeAlphabet = "abcdefghijkmnpqrstuvwxyz23456789"
+
+// RecoveryCode is a one-time code that stands in for a TOTP code when the
+// user has lost their authenticator. Only the hash of the code is stored.
+type RecoveryCode struct {
+	ID        uuid.UUID `gorm:"type:uuid;primary_key;default:uuid_generate_v4()"`
+	UserID    uuid.UUID `gorm:"type:uuid;not null;index"`
+	CodeHash  string    `gorm:"not null"`
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+// ReplaceRecoveryCodes issues a new set of recovery codes for userID and
+// returns them in plain text. Codes issued earlier stop working.
+func ReplaceRecoveryCodes(db *gorm.DB, userID uuid.UUID) ([]string, error) {
+	codes := make([]string, RecoveryCodeCount)
+	records := make([]RecoveryCode, RecoveryCodeCount)
+	for i := range codes {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = code
+		records[i] = RecoveryCode{UserID: userID, CodeHash: util.HashToken(normalizeRecoveryCode(code))}
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := DeleteRecoveryCodes(tx, userID); err != nil {
+			return err
+		}
+		return tx.Create(&records).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// UseRecoveryCode redeems code for userID. It returns false without an error
+// if the code is unknown or has already been used.
+func UseRecoveryCode(db *gorm.DB, userID uuid.UUID, code string) (bool, error) {
+	// As with password reset tokens, the conditional update makes
+	// redeeming atomic.
+	result := db.Model(&RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, util.HashToken(normalizeRecoveryCode(code))).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+func DeleteRecoveryCodes(db *gorm.DB, userID uuid.UUID) error {
+	return db.Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error
+}
+
+// generateRecoveryCode returns a code like "k7xq2-9mfwa" made of characters
+// that are hard to confuse when written down.
+func generateRecoveryCode() (string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = recoveryCodeAlphabet[int(b[i])%len(recoveryCodeAlphabet)]
+	}
+	return string(b[:5]) + "-" + string(b[5:]), nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.ReplaceAll(code, "-", "")
+	return strings.ReplaceAll(code, " ", "")
+}
@@ -0,0 +1,36 @@
+package models
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecoveryCodes(t *testing.T) {
+	db := setupTestDB()
+	defer teardownTestDB(db)
+
+	user, _ := CreateUser(db, User{Name: "test", Email: "test@test.com", Password: "test"}, testPasswordCost)
+
+	codes, err := ReplaceRecoveryCodes(db, user.ID)
+	assert.Nil(t, err)
+	assert.Len(t, codes, RecoveryCodeCount)
+
+	// Codes are accepted regardless of case and separators
+	ok, err := UseRecoveryCode(db, user.ID, strings.ToUpper(strings.ReplaceAll(codes[0], "-", "")))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	// and only once
+	ok, err = UseRecoveryCode(db, user.ID, codes[0])
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	// Issuing new codes invalidates the old ones
+	_, err = ReplaceRecoveryCodes(db, user.ID)
+	assert.Nil(t, err)
+	ok, err = UseRecoveryCode(db, user.ID, codes[1])
+	assert.Nil(t, err)
+	assert.False(t, ok)
+}
@@ -0,0 +1,116 @@
+package models
+
+import (
+	"errors"
+
+	"gorm.io/gorm"
+)
+
+const (
+	RoleAdmin = "admin"
+	RoleUser  = "user"
+)
+
+const (
+	PermissionUsersList   = "users:list"
+	PermissionUsersRead   = "users:read"
+	PermissionUsersUpdate = "users:update"
+	PermissionUsersDelete = "users:delete"
+	// PermissionClientsManage allows registering OAuth clients.
+	PermissionClientsManage = "clients:manage"
+)
+
+// DefaultRoles is the set of roles and permissions SeedRoles makes sure
+// exist. Users acting on their own account need no permission at all, so
+// the user role starts out empty.
+var DefaultRoles = map[string][]string{
+	RoleAdmin: {
+		PermissionUsersList,
+		PermissionUsersRead,
+		PermissionUsersUpdate,
+		PermissionUsersDelete,
+		PermissionClientsManage,
+	},
+	RoleUser: {},
+}
+
+type Permission struct {
+	ID   uint   `gorm:"primaryKey" json:"-"`
+	Name string `gorm:"uniqueIndex;not null" json:"name"`
+}
+
+type Role struct {
+	ID          uint         `gorm:"primaryKey" json:"-"`
+	Name        string       `gorm:"uniqueIndex;not null" json:"name"`
+	Permissions []Permission `gorm:"many2many:role_permissions;" json:"permissions"`
+}
+
+// SeedRoles creates the roles and permissions in DefaultRoles and brings the
+// permissions of existing roles in line with it.
+func SeedRoles(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		for roleName, permissionNames := range DefaultRoles {
+			permissions := make([]Permission, 0, len(permissionNames))
+			for _, name := range permissionNames {
+				permission := Permission{Name: name}
+				if err := tx.Where(Permission{Name: name}).FirstOrCreate(&permission).Error; err != nil {
+					return err
+				}
+				permissions = append(permissions, permission)
+			}
+
+			role := Role{Name: roleName}
+			if err := tx.Where(Role{Name: roleName}).FirstOrCreate(&role).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&role).Association("Permissions").Replace(permissions); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func GetRoleByName(db *gorm.DB, name string) (*Role, error) {
+	var role Role
+	result := db.Where("name = ?", name).First(&role)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, result.Error
+	}
+	return &role, nil
+}
+
+func AssignRole(db *gorm.DB, user *User, roleName string) error {
+	role, err := GetRoleByName(db, roleName)
+	if err != nil {
+		return err
+	}
+	if role == nil {
+		return errors.New("role " + roleName + " does not exist")
+	}
+	return db.Model(user).Association("Roles").Append(role)
+}
+
+func (u *User) RoleNames() []string {
+	names := make([]string, 0, len(u.Roles))
+	for _, role := range u.Roles {
+		names = append(names, role.Name)
+	}
+	return names
+}
+
+// HasPermission reports whether any of the user's roles grants permission.
+// Roles have to be loaded together with their permissions.
+func (u *User) HasPermission(permission string) bool {
+	for _, role := range u.Roles {
+		for _, p := range role.Permissions {
+			if p.Name == permission {
+				return true
+			}
+		}
+	}
+	return false
+}
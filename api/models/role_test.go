@@ -0,0 +1,55 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHasPermission(t *testing.T) {
+	user := User{
+		Roles: []Role{
+			{Name: RoleUser},
+			{Name: RoleAdmin, Permissions: []Permission{{Name: PermissionUsersList}}},
+		},
+	}
+	assert.True(t, user.HasPermission(PermissionUsersList))
+	assert.False(t, user.HasPermission(PermissionUsersDelete))
+	assert.Equal(t, []string{RoleUser, RoleAdmin}, user.RoleNames())
+
+	assert.False(t, (&User{}).HasPermission(PermissionUsersList))
+}
+
+func TestSeedRoles(t *testing.T) {
+	db := setupTestDB()
+	defer teardownTestDB(db)
+
+	// Seeding is idempotent
+	assert.Nil(t, SeedRoles(db))
+
+	admin, err := GetRoleByName(db, RoleAdmin)
+	assert.Nil(t, err)
+	assert.NotNil(t, admin)
+
+	user := User{
+		Name:     "test",
+		Email:    "test@test.com",
+		Password: "test",
+		Roles:    []Role{*admin},
+	}
+	createdUser, err := CreateUser(db, user, testPasswordCost)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{RoleUser}, createdUser.RoleNames())
+
+	gotUser, err := GetUserById(db, createdUser.ID)
+	assert.Nil(t, err)
+	assert.False(t, gotUser.HasPermission(PermissionUsersList))
+
+	err = AssignRole(db, gotUser, RoleAdmin)
+	assert.Nil(t, err)
+
+	gotUser, err = GetUserById(db, createdUser.ID)
+	assert.Nil(t, err)
+	assert.True(t, gotUser.HasPermission(PermissionUsersList))
+	assert.True(t, gotUser.HasPermission(PermissionUsersDelete))
+}
@@ -0,0 +1,78 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Session records a login on one device. Its ID is carried by the tokens
+// issued for the login, which stop working once the session is revoked.
+type Session struct {
+	ID         uuid.UUID  `gorm:"type:uuid;primary_key;default:uuid_generate_v4()" json:"id"`
+	UserID     uuid.UUID  `gorm:"type:uuid;not null;index" json:"-"`
+	UserAgent  string     `json:"user_agent"`
+	IP         string     `json:"ip"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastSeenAt time.Time  `json:"last_seen_at"`
+	RevokedAt  *time.Time `json:"-"`
+}
+
+func CreateSession(db *gorm.DB, userID uuid.UUID, userAgent string, ip string) (*Session, error) {
+	session := Session{UserID: userID, UserAgent: userAgent, IP: ip, LastSeenAt: time.Now()}
+	if err := db.Create(&session).Error; err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// GetActiveSession returns the session with id unless it has been revoked or
+// its refresh tokens, which last refreshTokenTTL, have expired, or nil.
+func GetActiveSession(db *gorm.DB, id uuid.UUID, refreshTokenTTL time.Duration) (*Session, error) {
+	var session Session
+	result := activeSessions(db, refreshTokenTTL).Where("id = ?", id).First(&session)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, result.Error
+	}
+	return &session, nil
+}
+
+// GetActiveSessions lists the sessions of user that can still be used, most
+// recently seen first.
+func GetActiveSessions(db *gorm.DB, userID uuid.UUID, refreshTokenTTL time.Duration) ([]Session, error) {
+	var sessions []Session
+	if err := activeSessions(db, refreshTokenTTL).Where("user_id = ?", userID).Order("last_seen_at DESC").Find(&sessions).Error; err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// Sessions are seen at least whenever their refresh token is rotated, so one
+// unseen for longer than a refresh token lives is over.
+func activeSessions(db *gorm.DB, refreshTokenTTL time.Duration) *gorm.DB {
+	return db.Where("revoked_at IS NULL AND last_seen_at > ?", time.Now().Add(-refreshTokenTTL))
+}
+
+// TouchSession records that session was used from ip.
+func TouchSession(db *gorm.DB, session *Session, ip string) error {
+	return db.Model(session).Updates(map[string]interface{}{"last_seen_at": time.Now(), "ip": ip}).Error
+}
+
+// RevokeSession ends the session with id if it belongs to user.
+func RevokeSession(db *gorm.DB, userID uuid.UUID, id uuid.UUID) (bool, error) {
+	result := db.Model(&Session{}).Where("id = ? AND user_id = ? AND revoked_at IS NULL", id, userID).Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// RevokeSessions ends every session of user.
+func RevokeSessions(db *gorm.DB, userID uuid.UUID) error {
+	return db.Model(&Session{}).Where("user_id = ? AND revoked_at IS NULL", userID).Update("revoked_at", time.Now()).Error
+}
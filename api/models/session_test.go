@@ -0,0 +1,48 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aki-0517/go-user-management/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessions(t *testing.T) {
+	db := setupTestDB()
+	defer teardownTestDB(db)
+
+	user, _ := CreateUser(db, User{Name: "test", Email: "test@test.com", Password: "test"}, testPasswordCost)
+
+	session, err := CreateSession(db, user.ID, "curl/8.0", "127.0.0.1")
+	assert.Nil(t, err)
+	other, _ := CreateSession(db, user.ID, "Firefox", "127.0.0.2")
+
+	assert.Nil(t, TouchSession(db, session, "127.0.0.3"))
+	active, err := GetActiveSession(db, session.ID, util.DefaultRefreshTokenTTL)
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.3", active.IP)
+
+	sessions, err := GetActiveSessions(db, user.ID, util.DefaultRefreshTokenTTL)
+	assert.Nil(t, err)
+	assert.Len(t, sessions, 2)
+	assert.Equal(t, session.ID, sessions[0].ID)
+
+	revoked, err := RevokeSession(db, user.ID, session.ID)
+	assert.Nil(t, err)
+	assert.True(t, revoked)
+	revoked, _ = RevokeSession(db, user.ID, session.ID)
+	assert.False(t, revoked)
+	active, _ = GetActiveSession(db, session.ID, util.DefaultRefreshTokenTTL)
+	assert.Nil(t, active)
+
+	// Sessions whose refresh tokens have expired are over
+	db.Model(other).Update("last_seen_at", time.Now().Add(-util.DefaultRefreshTokenTTL-time.Minute))
+	sessions, _ = GetActiveSessions(db, user.ID, util.DefaultRefreshTokenTTL)
+	assert.Empty(t, sessions)
+
+	third, _ := CreateSession(db, user.ID, "Safari", "127.0.0.4")
+	assert.Nil(t, RevokeSessions(db, user.ID))
+	active, _ = GetActiveSession(db, third.ID, util.DefaultRefreshTokenTTL)
+	assert.Nil(t, active)
+}
@@ -2,8 +2,11 @@ package models
 
 import (
 	"errors"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/aki-0517/go-user-management/util"
 	"gorm.io/gorm"
 )
@@ -13,6 +16,14 @@ type User struct {
 	Name     string    `json:"name"`
 	Email    string    `json:"email"`
 	Password string    `json:"password"`
+	Roles    []Role    `gorm:"many2many:user_roles;" json:"roles,omitempty"`
+	// EmailVerifiedAt is nil until the user has followed the link sent to
+	// their current email address.
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+	// TOTPSecret is set when enrollment starts; TOTPEnabled only once the
+	// user has confirmed it with a code.
+	TOTPSecret  string `json:"-"`
+	TOTPEnabled bool   `json:"totp_enabled"`
 }
 
 type DBConfig struct {
@@ -39,40 +50,99 @@ func (u *User) IsEqual(user *User) bool {
 	return true
 }
 
-func isEmailUnique(db *gorm.DB, email string) bool {
-	isUserUnique, err := GetUserByEmail(db, email)
-	if err != nil || isUserUnique == nil {
-		return false
+func (u *User) IsEmailVerified() bool {
+	return u.EmailVerifiedAt != nil
+}
+
+// UserInfo returns the OpenID Connect claims about u that scope releases:
+// the name for "profile" and the email address for "email".
+func (u *User) UserInfo(scope string) util.UserInfo {
+	info := util.UserInfo{Subject: u.ID.String()}
+	if util.ScopeIncludes(scope, "profile") {
+		info.Name = u.Name
 	}
-	return true
+	if util.ScopeIncludes(scope, "email") {
+		verified := u.IsEmailVerified()
+		info.Email = u.Email
+		info.EmailVerified = &verified
+	}
+	return info
 }
 
-func CreateUser(db *gorm.DB, user User) (*User, error) {
+// ErrEmailTaken is returned when another account already uses an email
+// address.
+var ErrEmailTaken = ConflictError("email_taken", "Email is already used")
+
+const (
+	// emailIndex is the unique index on normalized email addresses.
+	emailIndex = "idx_users_email_lower"
+	// uniqueViolation is the Postgres error code for unique_violation.
+	uniqueViolation = "23505"
+)
 
+// NormalizeEmail returns the form email addresses are stored and compared in.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// translateUserError turns a violation of the email index into ErrEmailTaken.
+// The index, not a lookup beforehand, decides which of two concurrent
+// signups with the same address wins.
+func translateUserError(err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation && pgErr.ConstraintName == emailIndex {
+		return ErrEmailTaken
+	}
+	return err
+}
+
+// prepareNewUser checks a signup and hashes its password with bcrypt at
+// passwordCost. Roles, verification and two-factor state are never taken from
+// the input; every new account starts unverified, and without roles until the
+// store assigns the default one.
+func prepareNewUser(user *User, passwordCost int) error {
 	if user.Name == "" || user.Email == "" || user.Password == "" {
-		return nil, errors.New("name, email and password are required")
+		return ValidationError("missing_fields", "Name, email and password are required")
+	}
+
+	hashedPassword, err := util.HashPassword(user.Password, passwordCost)
+	if err != nil {
+		return err
 	}
+	user.Email = NormalizeEmail(user.Email)
+	user.Password = hashedPassword
+	user.EmailVerifiedAt = nil
+	user.TOTPSecret = ""
+	user.TOTPEnabled = false
+	user.Roles = nil
+	return nil
+}
 
-	if isEmailUnique(db, user.Email) {
-		return nil, errors.New("email is already used")
+// CreateUser signs user up, hashing the password with bcrypt at passwordCost.
+func CreateUser(db *gorm.DB, user User, passwordCost int) (*User, error) {
+	if err := prepareNewUser(&user, passwordCost); err != nil {
+		return nil, err
 	}
 
-	hashedPassword, err := util.HashPassword(user.Password)
+	role, err := GetRoleByName(db, RoleUser)
 	if err != nil {
 		return nil, err
 	}
-	user.Password = hashedPassword
+	if role == nil {
+		return nil, errors.New("default role is missing")
+	}
+	user.Roles = []Role{*role}
 
 	result := db.Create(&user)
 	if result.Error != nil {
-		return nil, result.Error
+		return nil, translateUserError(result.Error)
 	}
 	return &user, nil
 }
 
 func GetAllUsers(db *gorm.DB) ([]User, error) {
 	var users []User
-	result := db.Find(&users)
+	result := db.Preload("Roles").Find(&users)
 	if result.Error != nil {
 		return nil, result.Error
 	}
@@ -81,7 +151,7 @@ func GetAllUsers(db *gorm.DB) ([]User, error) {
 
 func GetUserById(db *gorm.DB, id uuid.UUID) (*User, error) {
 	var user User
-	result := db.Where("id = ?", id).First(&user)
+	result := db.Preload("Roles.Permissions").Where("id = ?", id).First(&user)
 	if result.Error != nil {
 		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
 			return nil, nil
@@ -93,7 +163,7 @@ func GetUserById(db *gorm.DB, id uuid.UUID) (*User, error) {
 
 func GetUserByEmail(db *gorm.DB, email string) (*User, error) {
 	var user User
-	result := db.Where("email = ?", email).First(&user)
+	result := db.Preload("Roles.Permissions").Where("lower(email) = ?", NormalizeEmail(email)).First(&user)
 	if result.Error != nil {
 		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
 			return nil, nil
@@ -103,16 +173,75 @@ func GetUserByEmail(db *gorm.DB, email string) (*User, error) {
 	return &user, nil
 }
 
-func UpdateUser(db *gorm.DB, user User) (*User, error) {
-	result := db.Save(user)
-	if result.Error != nil {
-		return nil, result.Error
+// UserChanges lists the fields an update writes; nil fields are left as
+// stored, so that concurrent updates of other fields are not undone.
+type UserChanges struct {
+	Name *string
+	// Email changes the address, which then has to be verified again.
+	Email *string
+	// Password is the bcrypt hash of the new password.
+	Password        *string
+	EmailVerifiedAt *time.Time
+	TOTPSecret      *string
+}
+
+// columns returns the columns changes writes, by name.
+func (changes UserChanges) columns() map[string]interface{} {
+	columns := map[string]interface{}{}
+	if changes.Name != nil {
+		columns["name"] = *changes.Name
 	}
-	return &user, nil
+	if changes.Email != nil {
+		columns["email"] = NormalizeEmail(*changes.Email)
+		columns["email_verified_at"] = nil
+	}
+	if changes.Password != nil {
+		columns["password"] = *changes.Password
+	}
+	if changes.EmailVerifiedAt != nil {
+		columns["email_verified_at"] = *changes.EmailVerifiedAt
+	}
+	if changes.TOTPSecret != nil {
+		columns["totp_secret"] = *changes.TOTPSecret
+	}
+	return columns
+}
+
+// apply makes changes to user as the database would.
+func (changes UserChanges) apply(user *User) {
+	if changes.Name != nil {
+		user.Name = *changes.Name
+	}
+	if changes.Email != nil {
+		user.Email = NormalizeEmail(*changes.Email)
+		user.EmailVerifiedAt = nil
+	}
+	if changes.Password != nil {
+		user.Password = *changes.Password
+	}
+	if changes.EmailVerifiedAt != nil {
+		verifiedAt := *changes.EmailVerifiedAt
+		user.EmailVerifiedAt = &verifiedAt
+	}
+	if changes.TOTPSecret != nil {
+		user.TOTPSecret = *changes.TOTPSecret
+	}
+}
+
+// UpdateUser writes changes to the user with id and returns it as stored, or
+// nil if there is no such user.
+func UpdateUser(db *gorm.DB, id uuid.UUID, changes UserChanges) (*User, error) {
+	if columns := changes.columns(); len(columns) > 0 {
+		result := db.Model(&User{}).Where("id = ?", id).Updates(columns)
+		if result.Error != nil {
+			return nil, translateUserError(result.Error)
+		}
+	}
+	return GetUserById(db, id)
 }
 
 func DeleteUser(db *gorm.DB, user *User) (bool, error) {
-	result := db.Delete(&user)
+	result := db.Select("Roles").Delete(user)
 	if result.Error != nil {
 		return false, result.Error
 	}
@@ -121,3 +250,39 @@ func DeleteUser(db *gorm.DB, user *User) (bool, error) {
 	}
 	return true, nil
 }
+
+// EnableTOTP turns on two-factor authentication for user and returns a fresh
+// set of recovery codes.
+func EnableTOTP(db *gorm.DB, user *User) ([]string, error) {
+	var codes []string
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(user).Update("totp_enabled", true).Error; err != nil {
+			return err
+		}
+		var err error
+		codes, err = ReplaceRecoveryCodes(tx, user.ID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	user.TOTPEnabled = true
+	return codes, nil
+}
+
+// DisableTOTP turns off two-factor authentication for user and discards the
+// secret and recovery codes.
+func DisableTOTP(db *gorm.DB, user *User) error {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(user).Updates(map[string]interface{}{"totp_secret": "", "totp_enabled": false}).Error; err != nil {
+			return err
+		}
+		return DeleteRecoveryCodes(tx, user.ID)
+	})
+	if err != nil {
+		return err
+	}
+	user.TOTPSecret = ""
+	user.TOTPEnabled = false
+	return nil
+}
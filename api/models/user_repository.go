@@ -0,0 +1,56 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// UserRepository stores user accounts. GetByID and GetByEmail return nil
+// without an error when no user matches; users are returned with their roles
+// and the permissions of those roles.
+type UserRepository interface {
+	// Create signs user up with the default role, hashing the password with
+	// bcrypt at passwordCost.
+	Create(user User, passwordCost int) (*User, error)
+	List() ([]User, error)
+	GetByID(id uuid.UUID) (*User, error)
+	GetByEmail(email string) (*User, error)
+	// Update writes changes to the user with id, leaving everything else
+	// as stored, and returns the user, or nil if there is no such user.
+	Update(id uuid.UUID, changes UserChanges) (*User, error)
+	// Delete removes user and reports whether it existed.
+	Delete(user *User) (bool, error)
+}
+
+// GormUserRepository keeps users in Postgres.
+type GormUserRepository struct {
+	db *gorm.DB
+}
+
+func NewGormUserRepository(db *gorm.DB) *GormUserRepository {
+	return &GormUserRepository{db}
+}
+
+func (r *GormUserRepository) Create(user User, passwordCost int) (*User, error) {
+	return CreateUser(r.db, user, passwordCost)
+}
+
+func (r *GormUserRepository) List() ([]User, error) {
+	return GetAllUsers(r.db)
+}
+
+func (r *GormUserRepository) GetByID(id uuid.UUID) (*User, error) {
+	return GetUserById(r.db, id)
+}
+
+func (r *GormUserRepository) GetByEmail(email string) (*User, error) {
+	return GetUserByEmail(r.db, email)
+}
+
+func (r *GormUserRepository) Update(id uuid.UUID, changes UserChanges) (*User, error) {
+	return UpdateUser(r.db, id, changes)
+}
+
+func (r *GormUserRepository) Delete(user *User) (bool, error) {
+	return DeleteUser(r.db, user)
+}
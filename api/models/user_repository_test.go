@@ -0,0 +1,141 @@
+package models
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aki-0517/go-user-management/util"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// testUserRepository is the behavior every UserRepository has to share.
+func testUserRepository(t *testing.T, repo UserRepository) {
+	user, err := repo.Create(User{Name: "test", Email: "test@test.com", Password: "password", TOTPEnabled: true}, testPasswordCost)
+	assert.Nil(t, err)
+	assert.NotEqual(t, uuid.Nil, user.ID)
+	assert.True(t, util.CheckPasswordHash("password", user.Password))
+	assert.False(t, user.TOTPEnabled)
+	assert.Equal(t, []string{RoleUser}, user.RoleNames())
+
+	_, err = repo.Create(User{Name: "other", Email: " Test@Test.com", Password: "password"}, testPasswordCost)
+	assert.ErrorIs(t, err, ErrEmailTaken)
+	_, err = repo.Create(User{Name: "other", Email: "other@test.com"}, testPasswordCost)
+	assert.NotNil(t, err)
+
+	found, err := repo.GetByID(user.ID)
+	assert.Nil(t, err)
+	assert.True(t, user.IsEqual(found))
+	assert.Equal(t, []string{RoleUser}, found.RoleNames())
+	found, err = repo.GetByEmail("TEST@test.com")
+	assert.Nil(t, err)
+	assert.Equal(t, user.ID, found.ID)
+
+	missing, err := repo.GetByID(uuid.New())
+	assert.Nil(t, err)
+	assert.Nil(t, missing)
+	missing, err = repo.GetByEmail("missing@test.com")
+	assert.Nil(t, err)
+	assert.Nil(t, missing)
+
+	// Roles are not changed by updates
+	name := "renamed"
+	updated, err := repo.Update(user.ID, UserChanges{Name: &name})
+	assert.Nil(t, err)
+	assert.Equal(t, "renamed", updated.Name)
+	assert.Equal(t, []string{RoleUser}, updated.RoleNames())
+	found, _ = repo.GetByID(user.ID)
+	assert.Equal(t, "renamed", found.Name)
+	assert.Equal(t, []string{RoleUser}, found.RoleNames())
+
+	// Only the changed fields are written, so updates made from an older
+	// copy of the user do not undo others
+	password, secret := "new hash", "secret"
+	_, err = repo.Update(user.ID, UserChanges{Password: &password})
+	assert.Nil(t, err)
+	updated, err = repo.Update(found.ID, UserChanges{TOTPSecret: &secret})
+	assert.Nil(t, err)
+	assert.Equal(t, "new hash", updated.Password)
+	assert.Equal(t, "secret", updated.TOTPSecret)
+
+	// Changed addresses have to be verified again
+	now := time.Now()
+	updated, _ = repo.Update(user.ID, UserChanges{EmailVerifiedAt: &now})
+	assert.True(t, updated.IsEmailVerified())
+	email := "Test@test.com"
+	updated, err = repo.Update(user.ID, UserChanges{Email: &email})
+	assert.Nil(t, err)
+	assert.Equal(t, "test@test.com", updated.Email)
+	assert.False(t, updated.IsEmailVerified())
+
+	missing, err = repo.Update(uuid.New(), UserChanges{Name: &name})
+	assert.Nil(t, err)
+	assert.Nil(t, missing)
+
+	other, _ := repo.Create(User{Name: "other", Email: "other@test.com", Password: "password"}, testPasswordCost)
+	_, err = repo.Update(other.ID, UserChanges{Email: &email})
+	assert.ErrorIs(t, err, ErrEmailTaken)
+	other, _ = repo.GetByID(other.ID)
+	assert.Equal(t, "other@test.com", other.Email)
+
+	users, err := repo.List()
+	assert.Nil(t, err)
+	assert.Len(t, users, 2)
+
+	deleted, err := repo.Delete(other)
+	assert.Nil(t, err)
+	assert.True(t, deleted)
+	deleted, err = repo.Delete(other)
+	assert.Nil(t, err)
+	assert.False(t, deleted)
+	missing, _ = repo.GetByID(other.ID)
+	assert.Nil(t, missing)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			found, err := repo.GetByID(user.ID)
+			assert.Nil(t, err)
+			_, err = repo.Update(found.ID, UserChanges{Name: &found.Name})
+			assert.Nil(t, err)
+		}()
+	}
+	wg.Wait()
+
+	// Of concurrent signups with the same address exactly one succeeds
+	var created, taken int32
+	for _, email := range []string{"race@test.com", "Race@test.com", "RACE@TEST.COM", "race@Test.com", "race@test.com "} {
+		wg.Add(1)
+		go func(email string) {
+			defer wg.Done()
+			_, err := repo.Create(User{Name: "racer", Email: email, Password: "password"}, testPasswordCost)
+			switch {
+			case err == nil:
+				atomic.AddInt32(&created, 1)
+			case errors.Is(err, ErrEmailTaken):
+				atomic.AddInt32(&taken, 1)
+			default:
+				t.Error(err)
+			}
+		}(email)
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), created)
+	assert.Equal(t, int32(4), taken)
+}
+
+func TestGormUserRepository(t *testing.T) {
+	db := setupTestDB()
+	defer teardownTestDB(db)
+
+	testUserRepository(t, NewGormUserRepository(db))
+}
+
+func TestMemoryUserRepository(t *testing.T) {
+	testUserRepository(t, NewMemoryUserRepository())
+}
@@ -4,12 +4,17 @@ import (
 	"fmt"
 	"testing"
 
+	"github.com/aki-0517/go-user-management/migrations"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
 
+// testPasswordCost keeps hashing cheap in tests.
+const testPasswordCost = bcrypt.MinCost
+
 func setupTestDB() *gorm.DB {
 	host := "localhost"
 	port := 5432
@@ -26,13 +31,32 @@ func setupTestDB() *gorm.DB {
 		panic("failed to create pgcrypto extension: " + err.Error())
 	}
 
-	db.AutoMigrate(&User{})
+	// The schema comes from the same migrations as in production.
+	m, err := migrations.New(db)
+	if err != nil {
+		panic("failed to load migrations: " + err.Error())
+	}
+	if _, err := m.Up(); err != nil {
+		panic("failed to migrate: " + err.Error())
+	}
+	if err := SeedRoles(db); err != nil {
+		panic("failed to seed roles: " + err.Error())
+	}
 
 	return db
 }
 
 func teardownTestDB(db *gorm.DB) {
-	db.Migrator().DropTable(&User{})
+	m, _ := migrations.New(db)
+	for {
+		reverted, err := m.Down()
+		if err != nil {
+			panic("failed to revert migrations: " + err.Error())
+		}
+		if reverted == nil {
+			break
+		}
+	}
 
 	sqlDB, err := db.DB()
 	if err != nil {
@@ -51,7 +75,7 @@ func TestCreateUser(t *testing.T) {
 		Password: "test",
 	}
 
-	createdUser, err := CreateUser(db, user)
+	createdUser, err := CreateUser(db, user, testPasswordCost)
 	assert.Nil(t, err)
 	assert.NotNil(t, createdUser)
 	assert.Equal(t, user.Name, createdUser.Name)
@@ -61,7 +85,7 @@ func TestCreateUser(t *testing.T) {
 		Email:    "",
 		Password: "test",
 	}
-	createdEmptyEmailUser, err := CreateUser(db, emptyEmailUser)
+	createdEmptyEmailUser, err := CreateUser(db, emptyEmailUser, testPasswordCost)
 	assert.NotNil(t, err)
 	assert.Nil(t, createdEmptyEmailUser)
 
@@ -70,7 +94,7 @@ func TestCreateUser(t *testing.T) {
 		Email:    "test1@test.com",
 		Password: "",
 	}
-	createdEmptyPasswordUser, err := CreateUser(db, emptyPasswordUser)
+	createdEmptyPasswordUser, err := CreateUser(db, emptyPasswordUser, testPasswordCost)
 	assert.NotNil(t, err)
 	assert.Nil(t, createdEmptyPasswordUser)
 
@@ -79,7 +103,7 @@ func TestCreateUser(t *testing.T) {
 		Email:    "test2@test.com",
 		Password: "test",
 	}
-	createdEmptyNameUser, err := CreateUser(db, emptyNameUser)
+	createdEmptyNameUser, err := CreateUser(db, emptyNameUser, testPasswordCost)
 	assert.NotNil(t, err)
 	assert.Nil(t, createdEmptyNameUser)
 
@@ -88,7 +112,7 @@ func TestCreateUser(t *testing.T) {
 		Email:    "test@test.com",
 		Password: "test1",
 	}
-	createdDuplicatedEmailUser, err := CreateUser(db, duplicatedEmailUser)
+	createdDuplicatedEmailUser, err := CreateUser(db, duplicatedEmailUser, testPasswordCost)
 	assert.NotNil(t, err)
 	assert.Nil(t, createdDuplicatedEmailUser)
 }
@@ -103,7 +127,7 @@ func TestGetUserById(t *testing.T) {
 		Password: "test",
 	}
 
-	createdUser, err := CreateUser(db, user)
+	createdUser, err := CreateUser(db, user, testPasswordCost)
 
 	gotUser, err := GetUserById(db, createdUser.ID)
 	assert.Nil(t, err)
@@ -125,7 +149,7 @@ func TestGetUserByEmail(t *testing.T) {
 		Password: "test",
 	}
 
-	createdUser, err := CreateUser(db, user)
+	createdUser, err := CreateUser(db, user, testPasswordCost)
 
 	gotUser, err := GetUserByEmail(db, createdUser.Email)
 	assert.Nil(t, err)
@@ -157,9 +181,9 @@ func TestGetAllUsers(t *testing.T) {
 		Password: "test2",
 	}
 
-	createdUser1, err := CreateUser(db, user1)
+	createdUser1, err := CreateUser(db, user1, testPasswordCost)
 
-	createdUser2, err := CreateUser(db, user2)
+	createdUser2, err := CreateUser(db, user2, testPasswordCost)
 
 	gotUsers, err := GetAllUsers(db)
 	assert.Nil(t, err)
@@ -179,10 +203,10 @@ func TestUpdateUser(t *testing.T) {
 		Password: "test",
 	}
 
-	createdUser, err := CreateUser(db, user)
+	createdUser, err := CreateUser(db, user, testPasswordCost)
 
 	createdUser.Name = "test2"
-	updatedUser, err := UpdateUser(db, *createdUser)
+	updatedUser, err := UpdateUser(db, createdUser.ID, UserChanges{Name: &createdUser.Name})
 	assert.Nil(t, err)
 	assert.NotNil(t, updatedUser)
 	assert.True(t, createdUser.IsEqual(updatedUser))
@@ -198,7 +222,7 @@ func TestDeleteUser(t *testing.T) {
 		Password: "test",
 	}
 
-	createdUser, err := CreateUser(db, user)
+	createdUser, err := CreateUser(db, user, testPasswordCost)
 
 	isDeleted, err := DeleteUser(db, createdUser)
 	assert.Nil(t, err)
@@ -212,3 +236,18 @@ func TestDeleteUser(t *testing.T) {
 	assert.Nil(t, err)
 	assert.False(t, deleted)
 }
+
+func TestUserInfo(t *testing.T) {
+	user := User{ID: uuid.New(), Name: "test", Email: "test@test.com"}
+
+	info := user.UserInfo("openid")
+	assert.Equal(t, user.ID.String(), info.Subject)
+	assert.Empty(t, info.Name)
+	assert.Empty(t, info.Email)
+	assert.Nil(t, info.EmailVerified)
+
+	info = user.UserInfo("openid profile email")
+	assert.Equal(t, "test", info.Name)
+	assert.Equal(t, "test@test.com", info.Email)
+	assert.False(t, *info.EmailVerified)
+}
@@ -0,0 +1,156 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// WebAuthnCredential is a passkey or security key registered by a user.
+type WebAuthnCredential struct {
+	ID              uuid.UUID `gorm:"type:uuid;primary_key;default:uuid_generate_v4()"`
+	UserID          uuid.UUID `gorm:"type:uuid;not null;index"`
+	CredentialID    []byte    `gorm:"not null;uniqueIndex"`
+	PublicKey       []byte    `gorm:"not null"`
+	AttestationType string
+	// Transports is a comma separated list of protocol.AuthenticatorTransport.
+	Transports string
+	AAGUID     []byte
+	SignCount  uint32
+	// CloneWarning is set once the authenticator reported a sign count that
+	// did not increase, which suggests it has been cloned. Such credentials
+	// are no longer accepted.
+	CloneWarning bool
+	CreatedAt    time.Time
+	LastUsedAt   *time.Time
+}
+
+// NewWebAuthnCredential converts a credential created by a registration
+// ceremony for storage.
+func NewWebAuthnCredential(userID uuid.UUID, credential *webauthn.Credential) WebAuthnCredential {
+	transports := make([]string, len(credential.Transport))
+	for i, transport := range credential.Transport {
+		transports[i] = string(transport)
+	}
+	return WebAuthnCredential{
+		UserID:          userID,
+		CredentialID:    credential.ID,
+		PublicKey:       credential.PublicKey,
+		AttestationType: credential.AttestationType,
+		Transports:      strings.Join(transports, ","),
+		AAGUID:          credential.Authenticator.AAGUID,
+		SignCount:       credential.Authenticator.SignCount,
+	}
+}
+
+// Credential converts c back for use in a ceremony.
+func (c *WebAuthnCredential) Credential() webauthn.Credential {
+	var transports []protocol.AuthenticatorTransport
+	if c.Transports != "" {
+		for _, transport := range strings.Split(c.Transports, ",") {
+			transports = append(transports, protocol.AuthenticatorTransport(transport))
+		}
+	}
+	return webauthn.Credential{
+		ID:              c.CredentialID,
+		PublicKey:       c.PublicKey,
+		AttestationType: c.AttestationType,
+		Transport:       transports,
+		Authenticator: webauthn.Authenticator{
+			AAGUID:       c.AAGUID,
+			SignCount:    c.SignCount,
+			CloneWarning: c.CloneWarning,
+		},
+	}
+}
+
+// WebAuthnUser adapts a user and their credentials to webauthn.User.
+type WebAuthnUser struct {
+	*User
+	Credentials []WebAuthnCredential
+}
+
+func (u *WebAuthnUser) WebAuthnID() []byte {
+	id := u.User.ID
+	return id[:]
+}
+
+func (u *WebAuthnUser) WebAuthnName() string {
+	return u.User.Email
+}
+
+func (u *WebAuthnUser) WebAuthnDisplayName() string {
+	return u.User.Name
+}
+
+func (u *WebAuthnUser) WebAuthnIcon() string {
+	return ""
+}
+
+func (u *WebAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := make([]webauthn.Credential, len(u.Credentials))
+	for i := range u.Credentials {
+		credentials[i] = u.Credentials[i].Credential()
+	}
+	return credentials
+}
+
+// CredentialDescriptors lists the registered credentials, e.g. so that an
+// authenticator is not registered twice.
+func (u *WebAuthnUser) CredentialDescriptors() []protocol.CredentialDescriptor {
+	descriptors := make([]protocol.CredentialDescriptor, len(u.Credentials))
+	for i := range u.Credentials {
+		descriptors[i] = u.Credentials[i].Credential().Descriptor()
+	}
+	return descriptors
+}
+
+// GetWebAuthnUser loads user together with their credentials.
+func GetWebAuthnUser(db *gorm.DB, user *User) (*WebAuthnUser, error) {
+	var credentials []WebAuthnCredential
+	if err := db.Where("user_id = ?", user.ID).Order("created_at").Find(&credentials).Error; err != nil {
+		return nil, err
+	}
+	return &WebAuthnUser{User: user, Credentials: credentials}, nil
+}
+
+func CreateWebAuthnCredential(db *gorm.DB, credential *WebAuthnCredential) error {
+	return db.Create(credential).Error
+}
+
+// GetWebAuthnCredential returns the credential with the ID an authenticator
+// reported, or nil if there is none.
+func GetWebAuthnCredential(db *gorm.DB, credentialID []byte) (*WebAuthnCredential, error) {
+	var credential WebAuthnCredential
+	result := db.Where("credential_id = ?", credentialID).First(&credential)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, result.Error
+	}
+	return &credential, nil
+}
+
+// RecordWebAuthnCredentialUse stores the state of a credential after a login
+// ceremony.
+func RecordWebAuthnCredentialUse(db *gorm.DB, credential *WebAuthnCredential, signCount uint32, cloneWarning bool) error {
+	now := time.Now()
+	err := db.Model(credential).Updates(map[string]interface{}{
+		"sign_count":    signCount,
+		"clone_warning": cloneWarning,
+		"last_used_at":  now,
+	}).Error
+	if err != nil {
+		return err
+	}
+	credential.SignCount = signCount
+	credential.CloneWarning = cloneWarning
+	credential.LastUsedAt = &now
+	return nil
+}
@@ -0,0 +1,221 @@
+package models
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testRPID     = "localhost"
+	testRPOrigin = "http://localhost:8080"
+)
+
+// softwareAuthenticator is a minimal passkey authenticator that answers
+// ceremonies with an in-memory ES256 key and "none" attestation.
+type softwareAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	userHandle   []byte
+	signCount    uint32
+}
+
+func newSoftwareAuthenticator(t *testing.T) *softwareAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	credentialID := make([]byte, 16)
+	rand.Read(credentialID)
+	return &softwareAuthenticator{key: key, credentialID: credentialID}
+}
+
+func (a *softwareAuthenticator) authenticatorData(flags protocol.AuthenticatorFlags, attestedCredentialData []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(testRPID))
+	data := append(rpIDHash[:], byte(flags))
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	return append(data, attestedCredentialData...)
+}
+
+func (a *softwareAuthenticator) clientData(t *testing.T, ceremony string, challenge protocol.URLEncodedBase64) []byte {
+	clientData, err := json.Marshal(map[string]string{
+		"type":      ceremony,
+		"challenge": base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":    testRPOrigin,
+	})
+	assert.Nil(t, err)
+	return clientData
+}
+
+// create answers a registration ceremony with a credential creation response.
+func (a *softwareAuthenticator) create(t *testing.T, options *protocol.CredentialCreation) []byte {
+	a.userHandle = options.Response.User.ID.(protocol.URLEncodedBase64)
+
+	publicKey, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  1,
+		XCoord: a.key.X.FillBytes(make([]byte, 32)),
+		YCoord: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	assert.Nil(t, err)
+
+	attested := make([]byte, 16) // AAGUID
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.credentialID)))
+	attested = append(attested, a.credentialID...)
+	attested = append(attested, publicKey...)
+
+	authData := a.authenticatorData(protocol.FlagUserPresent|protocol.FlagUserVerified|protocol.FlagAttestedCredentialData, attested)
+	attestationObject, err := webauthncbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": authData,
+	})
+	assert.Nil(t, err)
+
+	return a.response(t, map[string]string{
+		"clientDataJSON":    base64.RawURLEncoding.EncodeToString(a.clientData(t, "webauthn.create", options.Response.Challenge)),
+		"attestationObject": base64.RawURLEncoding.EncodeToString(attestationObject),
+	})
+}
+
+// get answers a login ceremony with an assertion response.
+func (a *softwareAuthenticator) get(t *testing.T, options *protocol.CredentialAssertion) []byte {
+	a.signCount++
+	authData := a.authenticatorData(protocol.FlagUserPresent|protocol.FlagUserVerified, nil)
+	clientData := a.clientData(t, "webauthn.get", options.Response.Challenge)
+
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(authData, clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	assert.Nil(t, err)
+
+	return a.response(t, map[string]string{
+		"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientData),
+		"authenticatorData": base64.RawURLEncoding.EncodeToString(authData),
+		"signature":         base64.RawURLEncoding.EncodeToString(signature),
+		"userHandle":        base64.RawURLEncoding.EncodeToString(a.userHandle),
+	})
+}
+
+func (a *softwareAuthenticator) response(t *testing.T, response map[string]string) []byte {
+	id := base64.RawURLEncoding.EncodeToString(a.credentialID)
+	body, err := json.Marshal(map[string]interface{}{
+		"id":       id,
+		"rawId":    id,
+		"type":     "public-key",
+		"response": response,
+	})
+	assert.Nil(t, err)
+	return body
+}
+
+func newTestWebAuthn(t *testing.T) *webauthn.WebAuthn {
+	w, err := webauthn.New(&webauthn.Config{
+		RPID:          testRPID,
+		RPDisplayName: "test",
+		RPOrigins:     []string{testRPOrigin},
+	})
+	assert.Nil(t, err)
+	return w
+}
+
+// login runs a discoverable login ceremony for user and returns the
+// credential it validated.
+func login(t *testing.T, w *webauthn.WebAuthn, authenticator *softwareAuthenticator, user *WebAuthnUser) (*webauthn.Credential, error) {
+	options, session, err := w.BeginDiscoverableLogin()
+	assert.Nil(t, err)
+
+	parsed, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(authenticator.get(t, options)))
+	assert.Nil(t, err)
+	return w.ValidateDiscoverableLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+		return user, nil
+	}, *session, parsed)
+}
+
+func TestWebAuthnCeremonies(t *testing.T) {
+	w := newTestWebAuthn(t)
+	authenticator := newSoftwareAuthenticator(t)
+	user := &WebAuthnUser{User: &User{ID: uuid.New(), Name: "test", Email: "test@test.com"}}
+
+	options, session, err := w.BeginRegistration(user)
+	assert.Nil(t, err)
+	parsed, err := protocol.ParseCredentialCreationResponseBody(bytes.NewReader(authenticator.create(t, options)))
+	assert.Nil(t, err)
+	created, err := w.CreateCredential(user, *session, parsed)
+	assert.Nil(t, err)
+
+	// Credentials survive the round trip through storage
+	stored := NewWebAuthnCredential(user.ID, created)
+	assert.Equal(t, authenticator.credentialID, stored.CredentialID)
+	user.Credentials = []WebAuthnCredential{stored}
+
+	credential, err := login(t, w, authenticator, user)
+	assert.Nil(t, err)
+	assert.False(t, credential.Authenticator.CloneWarning)
+	assert.Equal(t, uint32(1), credential.Authenticator.SignCount)
+	user.Credentials[0].SignCount = credential.Authenticator.SignCount
+
+	credential, err = login(t, w, authenticator, user)
+	assert.Nil(t, err)
+	assert.False(t, credential.Authenticator.CloneWarning)
+	user.Credentials[0].SignCount = credential.Authenticator.SignCount
+
+	// A copy of the authenticator lags behind in its sign count
+	clone := *authenticator
+	clone.signCount = 0
+	credential, err = login(t, w, &clone, user)
+	assert.Nil(t, err)
+	assert.True(t, credential.Authenticator.CloneWarning)
+
+	// An assertion signed by another key is refused
+	other := newSoftwareAuthenticator(t)
+	other.credentialID = authenticator.credentialID
+	other.userHandle = authenticator.userHandle
+	_, err = login(t, w, other, user)
+	assert.NotNil(t, err)
+}
+
+func TestWebAuthnCredentialStorage(t *testing.T) {
+	db := setupTestDB()
+	defer teardownTestDB(db)
+
+	user, _ := CreateUser(db, User{Name: "test", Email: "test@test.com", Password: "test"}, testPasswordCost)
+
+	credential := NewWebAuthnCredential(user.ID, &webauthn.Credential{
+		ID:        []byte("credential"),
+		PublicKey: []byte("key"),
+		Transport: []protocol.AuthenticatorTransport{protocol.USB, protocol.NFC},
+	})
+	assert.Nil(t, CreateWebAuthnCredential(db, &credential))
+
+	found, err := GetWebAuthnCredential(db, []byte("credential"))
+	assert.Nil(t, err)
+	assert.Equal(t, user.ID, found.UserID)
+	assert.Equal(t, []protocol.AuthenticatorTransport{protocol.USB, protocol.NFC}, found.Credential().Transport)
+
+	assert.Nil(t, RecordWebAuthnCredentialUse(db, found, 5, false))
+
+	webAuthnUser, err := GetWebAuthnUser(db, user)
+	assert.Nil(t, err)
+	assert.Len(t, webAuthnUser.Credentials, 1)
+	assert.Equal(t, uint32(5), webAuthnUser.Credentials[0].SignCount)
+	assert.NotNil(t, webAuthnUser.Credentials[0].LastUsedAt)
+
+	found, err = GetWebAuthnCredential(db, []byte("unknown"))
+	assert.Nil(t, err)
+	assert.Nil(t, found)
+}
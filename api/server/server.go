@@ -0,0 +1,385 @@
+// Package server assembles the API from its configuration and runs it until
+// it is asked to stop.
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/aki-0517/go-user-management/config"
+	"github.com/aki-0517/go-user-management/handlers"
+	"github.com/aki-0517/go-user-management/middleware"
+	"github.com/aki-0517/go-user-management/migrations"
+	"github.com/aki-0517/go-user-management/models"
+	"github.com/aki-0517/go-user-management/util"
+)
+
+type Server struct {
+	cfg  *config.Config
+	db   *gorm.DB
+	rdb  *redis.Client
+	keys *util.KeySet
+	// keyStore shares generated signing keys between instances, if any are
+	// used.
+	keyStore *util.KeyStore
+	http     *http.Server
+	// stop ends background work such as key rotation.
+	stop chan struct{}
+	// background tracks work started by requests that outlives them, such
+	// as sending emails.
+	background sync.WaitGroup
+}
+
+// New connects to the dependencies described by cfg and sets up the routes.
+// Connections are retried with back-off until cfg.Server.StartupTimeout has
+// passed or ctx is done.
+func New(ctx context.Context, cfg *config.Config) (*Server, error) {
+	s := &Server{cfg: cfg, stop: make(chan struct{})}
+	if err := s.setup(ctx); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Server) setup(ctx context.Context) error {
+	cfg := s.cfg
+
+	keys, err := util.LoadKeySet(cfg.Tokens.Alg, cfg.Tokens.Key, cfg.Tokens.PrivateKeyFile, cfg.Tokens.KeyGracePeriod)
+	if err != nil {
+		return fmt.Errorf("failed to load signing keys: %w", err)
+	}
+	keys.Issuer = cfg.Tokens.Issuer
+	keys.Audience = cfg.Tokens.Audience
+	keys.AccessTokenTTL = cfg.Tokens.AccessTokenTTL
+	s.keys = keys
+
+	// Postgres and Redis often start alongside the API, so they are waited
+	// for rather than given up on at the first attempt.
+	connectCtx, cancel := context.WithTimeout(ctx, cfg.Server.StartupTimeout)
+	defer cancel()
+	s.db, err = util.DBConnect(connectCtx, cfg.Database.DSN())
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %w", err)
+	}
+	// Serving from a schema the code was not written for fails in obscure
+	// ways, so an out of date database is refused.
+	migrator, err := migrations.New(s.db)
+	if err != nil {
+		return err
+	}
+	if cfg.Database.Migrate {
+		applied, err := migrator.Up()
+		if err != nil {
+			return fmt.Errorf("failed to migrate: %w", err)
+		}
+		for _, migration := range applied {
+			log.Printf("applied migration %s", migration)
+		}
+	}
+	if err := migrator.Check(); err != nil {
+		return fmt.Errorf("%w; run \"migrate up\" first", err)
+	}
+	s.rdb, err = util.RedisClient(connectCtx, cfg.Redis.Addr(), cfg.Redis.Password, cfg.Redis.DB)
+	if err != nil {
+		return fmt.Errorf("failed to connect to redis: %w", err)
+	}
+
+	// Generated keys are shared through Redis, so that every instance signs
+	// with and publishes the same ones, and restarts keep them.
+	if cfg.Tokens.SharesKeys() {
+		var base util.Signer
+		if cfg.Tokens.PrivateKeyFile != "" {
+			base = s.keys.Signer()
+		}
+		s.keyStore, err = util.NewKeyStore(s.rdb, s.keys, cfg.Tokens.Alg, base, cfg.Tokens.KeyEncryptionKey)
+		if err != nil {
+			return err
+		}
+		if err := s.keyStore.Sync(cfg.Tokens.KeyRotationInterval); err != nil {
+			return fmt.Errorf("failed to load signing keys: %w", err)
+		}
+	}
+
+	if err := models.SeedRoles(s.db); err != nil {
+		return fmt.Errorf("failed to seed roles: %w", err)
+	}
+	if cfg.AdminEmail != "" {
+		admin, err := models.GetUserByEmail(s.db, cfg.AdminEmail)
+		if err != nil {
+			return fmt.Errorf("failed to retrieve admin user: %w", err)
+		}
+		if admin != nil && !admin.HasPermission(models.PermissionUsersList) {
+			if err := models.AssignRole(s.db, admin, models.RoleAdmin); err != nil {
+				return fmt.Errorf("failed to grant admin role: %w", err)
+			}
+		}
+	}
+
+	var mailer util.Mailer = util.LogMailer{}
+	if cfg.SMTP.Host != "" {
+		mailer = util.NewSMTPMailer(cfg.SMTP.Host, cfg.SMTP.Port, cfg.SMTP.Username, cfg.SMTP.Password, cfg.SMTP.From)
+	} else {
+		log.Printf("No SMTP host set, emails are only logged, without the tokens of their links")
+	}
+	verifier := util.NewEmailVerifier(s.rdb, mailer, cfg.BaseURL)
+
+	webAuthn, err := webauthn.New(&webauthn.Config{
+		RPID:          cfg.WebAuthn.RPID,
+		RPDisplayName: cfg.AppName,
+		RPOrigins:     []string{cfg.BaseURL},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to configure WebAuthn: %w", err)
+	}
+
+	oidcProviders := map[string]*util.OIDCProvider{}
+	for _, p := range cfg.OIDC.Providers {
+		provider, err := util.NewOIDCProvider(ctx, p.Name, p.Issuer, p.ClientID, p.ClientSecret, cfg.BaseURL+"/auth/"+p.Name+"/callback")
+		if err != nil {
+			return fmt.Errorf("failed to configure identity provider: %w", err)
+		}
+		oidcProviders[p.Name] = provider
+	}
+
+	// Without session secrets a random one is used, which is enough for the
+	// state of logins at identity providers unless several instances serve
+	// the same users. Cookie auth cannot be enabled without them.
+	sessionSecrets := strings.Join(cfg.Session.Secrets, ",")
+	if sessionSecrets == "" {
+		secret, err := util.RandomToken(32)
+		if err != nil {
+			return fmt.Errorf("failed to generate session secret: %w", err)
+		}
+		sessionSecrets = secret
+	}
+	cookieOptions := sessions.Options{
+		Path:     "/",
+		MaxAge:   int((10 * time.Minute).Seconds()),
+		Secure:   cfg.Session.SecureCookies,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	store := util.NewSessionStore(sessionSecrets, cfg.Tokens.RefreshTokenTTL, cookieOptions)
+	// With cookie auth browsers can log in with ?mode=cookie and are then
+	// authenticated by an auth cookie that lasts as long as a refresh token.
+	var authCookieOptions *sessions.Options
+	if cfg.Session.CookieAuth {
+		options := cookieOptions
+		options.MaxAge = int(cfg.Tokens.RefreshTokenTTL.Seconds())
+		authCookieOptions = &options
+	}
+
+	users := models.NewGormUserRepository(s.db)
+	uh := handlers.UserHandler(cfg, s.db, users, s.keys, verifier, &s.background)
+	loginGuard := util.NewLoginGuard(s.rdb, cfg.Login.MaxFailures, cfg.Login.FailureWindow, cfg.Login.LockoutDuration)
+	ah := handlers.AuthHandlerInit(cfg, s.db, users, s.keys, s.rdb, loginGuard, mailer, &s.background, webAuthn, oidcProviders, authCookieOptions)
+	oh := handlers.OAuthHandlerInit(cfg, s.db, users, s.keys, s.rdb)
+	// Without Redis we cannot tell revoked tokens apart, so unless explicitly
+	// configured otherwise every authenticated request is refused.
+	m := middleware.NewMiddleware(s.keys, util.NewRedisTokenBlocklist(s.rdb), cfg.Tokens.BlocklistFailOpen, cfg.Session.CookieAuth, func(subject string) (*models.User, error) {
+		id, err := uuid.Parse(subject)
+		if err != nil {
+			return nil, nil
+		}
+		return users.GetByID(id)
+	}, func(key string) (*models.APIKey, error) {
+		return models.AuthenticateAPIKey(s.db, key)
+	}, func(sessionID string) (bool, error) {
+		id, err := uuid.Parse(sessionID)
+		if err != nil {
+			return false, nil
+		}
+		session, err := models.GetActiveSession(s.db, id, cfg.Tokens.RefreshTokenTTL)
+		if err != nil || session == nil {
+			return false, err
+		}
+		if time.Since(session.LastSeenAt) > time.Minute {
+			err = models.TouchSession(s.db, session, session.IP)
+		}
+		return true, err
+	})
+
+	r := gin.New()
+
+	r.Use(middleware.RequestID(), gin.Logger(), middleware.Recovery(), middleware.Errors())
+	r.Use(middleware.CORS(cfg.CORS.AllowedOrigins))
+	r.Use(sessions.SessionsMany([]string{middleware.StateSessionName, middleware.AuthSessionName}, store))
+
+	rateLimits := util.NewRedisRateLimitStore(s.rdb)
+	r.Use(util.NewRateLimiter(rateLimits, cfg.RateLimit.PerIP, time.Minute, util.KeyByIP, models.ErrRateLimited).MiddleWare())
+
+	authorized := r.Group("/me")
+	authorized.Use(m.AuthenticateMiddleware())
+	authorized.Use(util.NewRateLimiter(rateLimits, cfg.RateLimit.PerUser, time.Minute, util.KeyByUser, models.ErrRateLimited).MiddleWare())
+	{
+		authorized.PUT("/:id", uh.UpdateUserHandler())
+		authorized.DELETE("/:id", uh.DeleteUserHandler())
+		authorized.GET("/:id", uh.GetUserHandler())
+		authorized.POST("/logout", ah.LogOutHandler())
+		authorized.GET("/sessions", ah.ListSessionsHandler())
+		authorized.GET("/csrf-token", ah.CSRFTokenHandler())
+		authorized.GET("/consents", oh.ListConsentsHandler())
+		authorized.GET("/api-keys", uh.ListAPIKeysHandler())
+	}
+
+	// Credentials, sessions and grants are managed by the account owner
+	// only. Otherwise a key could e.g. hand out keys with a wider scope than
+	// its own.
+	owner := authorized.Group("", m.RejectAPIKeys())
+	{
+		owner.PUT("/:id/password", ah.ChangePasswordHandler())
+		owner.DELETE("/sessions", ah.LogOutEverywhereHandler())
+		owner.DELETE("/sessions/:session_id", ah.RevokeSessionHandler())
+		owner.POST("/mfa/totp", ah.EnrollTOTPHandler())
+		owner.POST("/mfa/totp/confirm", ah.ConfirmTOTPHandler())
+		owner.DELETE("/mfa/totp", ah.DisableTOTPHandler())
+		owner.POST("/webauthn/register/begin", ah.BeginWebAuthnRegistrationHandler())
+		owner.POST("/webauthn/register/finish", ah.FinishWebAuthnRegistrationHandler())
+		owner.DELETE("/consents/:client_id", oh.RevokeConsentHandler())
+		owner.POST("/api-keys", uh.CreateAPIKeyHandler())
+		owner.DELETE("/api-keys/:key_id", uh.RevokeAPIKeyHandler())
+	}
+
+	r.GET("/", func(c *gin.Context) {
+		c.String(http.StatusOK, "Hello World!")
+	})
+	r.GET("/users", m.AuthenticateMiddleware(), m.RequirePermission(models.PermissionUsersList), uh.ListUsersHandler())
+	r.POST("/users/:id/unlock", m.AuthenticateMiddleware(), m.RequirePermission(models.PermissionUsersUpdate), ah.UnlockUserHandler())
+	r.POST("/user", uh.CreateUserHandler())
+	r.GET("/verify-email", uh.VerifyEmailHandler())
+	r.POST("/password/forgot", ah.ForgotPasswordHandler())
+	r.POST("/password/reset", ah.ResetPasswordHandler())
+	r.POST("/login", ah.LoginHandler())
+	r.POST("/login/mfa", ah.LoginMFAHandler())
+	r.POST("/login/webauthn/begin", ah.BeginWebAuthnLoginHandler())
+	r.POST("/login/webauthn/finish", ah.FinishWebAuthnLoginHandler())
+	r.GET("/auth/:provider/login", ah.OIDCLoginHandler())
+	r.GET("/auth/:provider/callback", ah.OIDCCallbackHandler())
+
+	r.POST("/oauth/clients", m.AuthenticateMiddleware(), m.RequirePermission(models.PermissionClientsManage), oh.RegisterClientHandler())
+	// Consent is given by the user, not by scripts acting for them.
+	r.GET("/oauth/authorize", m.AuthenticateMiddleware(), m.RejectAPIKeys(), oh.AuthorizeHandler())
+	r.POST("/oauth/authorize", m.AuthenticateMiddleware(), m.RejectAPIKeys(), oh.ConsentHandler())
+	r.POST("/oauth/token", oh.TokenHandler())
+	r.POST("/oauth/introspect", oh.IntrospectHandler())
+	r.POST("/oauth/revoke", oh.RevokeHandler())
+	r.GET("/.well-known/jwks.json", ah.JWKSHandler())
+	if cfg.OIDC.Enabled {
+		r.GET("/.well-known/openid-configuration", oh.DiscoveryHandler())
+		r.GET("/userinfo", oh.UserInfoHandler())
+		r.POST("/userinfo", oh.UserInfoHandler())
+	}
+	// Refreshing must keep working after the short-lived access token has
+	// expired, so it is authenticated by the refresh token alone.
+	r.POST("/me/refresh-token", ah.RefreshTokenHandler())
+
+	s.http = &http.Server{
+		Addr:         cfg.Server.ListenAddr,
+		Handler:      r,
+		ReadTimeout:  cfg.Server.ReadTimeout,
+		WriteTimeout: cfg.Server.WriteTimeout,
+		IdleTimeout:  cfg.Server.IdleTimeout,
+	}
+	if s.keyStore != nil {
+		s.keyStore.Start(cfg.Tokens.KeyRotationInterval, s.stop)
+	}
+	return nil
+}
+
+// Handler returns the handler that serves the API.
+func (s *Server) Handler() http.Handler {
+	return s.http.Handler
+}
+
+// Run serves the API on the configured address until ctx is done, then shuts
+// down; see Serve.
+func (s *Server) Run(ctx context.Context) error {
+	ln, err := net.Listen("tcp", s.http.Addr)
+	if err != nil {
+		return errors.Join(err, s.Close())
+	}
+	return s.Serve(ctx, ln)
+}
+
+// Serve serves the API on ln until ctx is done. Then it stops accepting
+// connections, waits up to cfg.Server.ShutdownTimeout for in-flight requests
+// and the background work they started to finish and closes the connections
+// to Redis and Postgres, in that order.
+func (s *Server) Serve(ctx context.Context, ln net.Listener) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.http.Serve(ln)
+	}()
+	log.Printf("listening on %s", ln.Addr())
+
+	var err error
+	select {
+	case err = <-errs:
+		// The server failed on its own, e.g. because accepting broke.
+	case <-ctx.Done():
+		log.Print("shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), s.cfg.Server.ShutdownTimeout)
+		defer cancel()
+		err = s.http.Shutdown(shutdownCtx)
+		if serveErr := <-errs; !errors.Is(serveErr, http.ErrServerClosed) {
+			err = errors.Join(err, serveErr)
+		}
+		err = errors.Join(err, s.waitBackground(shutdownCtx))
+	}
+	return errors.Join(err, s.Close())
+}
+
+// waitBackground waits for the background work of requests until ctx is
+// done.
+func (s *Server) waitBackground(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.background.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops background work and closes the connections to the
+// dependencies. Requests still being served will fail.
+func (s *Server) Close() error {
+	select {
+	case <-s.stop:
+		return nil
+	default:
+		close(s.stop)
+	}
+
+	var errs []error
+	if s.rdb != nil {
+		errs = append(errs, s.rdb.Close())
+	}
+	if s.db != nil {
+		sqlDB, err := s.db.DB()
+		if err == nil {
+			err = sqlDB.Close()
+		}
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
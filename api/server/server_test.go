@@ -0,0 +1,112 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aki-0517/go-user-management/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestServer(handler http.Handler, shutdownTimeout time.Duration) *Server {
+	cfg := config.Default()
+	cfg.Server.ShutdownTimeout = shutdownTimeout
+	return &Server{
+		cfg:  cfg,
+		http: &http.Server{Handler: handler},
+		stop: make(chan struct{}),
+	}
+}
+
+func TestServeDrainsRequests(t *testing.T) {
+	started := make(chan struct{})
+	s := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		io.WriteString(w, "done")
+	}), time.Second)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(ctx, ln)
+	}()
+
+	responses := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String())
+		if err != nil {
+			responses <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		responses <- string(body)
+	}()
+
+	// The request in flight when the server is asked to stop completes
+	<-started
+	cancel()
+	assert.Equal(t, "done", <-responses)
+	assert.Nil(t, <-served)
+
+	// New connections are refused
+	_, err = http.Get("http://" + ln.Addr().String())
+	assert.NotNil(t, err)
+}
+
+func TestServeDrainsBackgroundWork(t *testing.T) {
+	s := newTestServer(http.NotFoundHandler(), time.Second)
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(ctx, ln)
+	}()
+
+	// Work a request left behind, e.g. sending an email, is waited for
+	finished := false
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		time.Sleep(100 * time.Millisecond)
+		finished = true
+	}()
+	cancel()
+	assert.Nil(t, <-served)
+	assert.True(t, finished)
+}
+
+func TestServeShutdownTimeout(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	s := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}), 50*time.Millisecond)
+
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(ctx, ln)
+	}()
+	go http.Get("http://" + ln.Addr().String())
+
+	<-started
+	cancel()
+	assert.ErrorIs(t, <-served, context.DeadlineExceeded)
+}
+
+func TestCloseIsIdempotent(t *testing.T) {
+	s := newTestServer(http.NotFoundHandler(), time.Second)
+	assert.Nil(t, s.Close())
+	assert.Nil(t, s.Close())
+}
@@ -0,0 +1,44 @@
+package util
+
+import (
+	"crypto/sha256"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/cookie"
+)
+
+// SessionKeyPairs derives the authentication and encryption keys of cookie
+// sessions from secrets, a comma separated list. Cookies are written with the
+// first secret and read with any of them, so a secret can be rotated by
+// putting the new one first and dropping the old one once its cookies have
+// expired.
+func SessionKeyPairs(secrets string) [][]byte {
+	var pairs [][]byte
+	for _, secret := range strings.Split(secrets, ",") {
+		secret = strings.TrimSpace(secret)
+		if secret == "" {
+			continue
+		}
+		authKey := sha256.Sum256([]byte("authentication:" + secret))
+		encryptionKey := sha256.Sum256([]byte("encryption:" + secret))
+		pairs = append(pairs, authKey[:], encryptionKey[:])
+	}
+	return pairs
+}
+
+// NewSessionStore returns a cookie session store keyed by secrets, see
+// SessionKeyPairs, that writes cookies with options. Cookies are read for up
+// to maxAge after they were written, which must cover the longest lived
+// cookie: the codecs otherwise reject them after 30 days, whatever their
+// MaxAge.
+func NewSessionStore(secrets string, maxAge time.Duration, options sessions.Options) cookie.Store {
+	store := cookie.NewStore(SessionKeyPairs(secrets)...)
+	// MaxAge also sets the MaxAge of the options, so it has to come first.
+	if codecs, ok := store.(interface{ MaxAge(int) }); ok {
+		codecs.MaxAge(int(maxAge.Seconds()))
+	}
+	store.Options(options)
+	return store
+}
@@ -0,0 +1,52 @@
+package util
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+
+	"github.com/gorilla/securecookie"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionKeyPairs(t *testing.T) {
+	assert.Empty(t, SessionKeyPairs(""))
+
+	old := securecookie.CodecsFromPairs(SessionKeyPairs("old")...)
+	rotated := securecookie.CodecsFromPairs(SessionKeyPairs("new, old")...)
+
+	// Cookies written before the rotation can still be read
+	encoded, err := securecookie.EncodeMulti("session", "value", old...)
+	assert.Nil(t, err)
+	var value string
+	assert.Nil(t, securecookie.DecodeMulti("session", encoded, &value, rotated...))
+	assert.Equal(t, "value", value)
+
+	// but new cookies use the new secret
+	encoded, _ = securecookie.EncodeMulti("session", "value", rotated...)
+	assert.NotNil(t, securecookie.DecodeMulti("session", encoded, &value, old...))
+}
+
+func TestNewSessionStore(t *testing.T) {
+	store := NewSessionStore("secret", 90*24*time.Hour, sessions.Options{Path: "/", MaxAge: 600, Secure: true})
+
+	// Cookies keep the lifetime of the options, not that of the codecs
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	session, err := store.Get(r, "session")
+	assert.Nil(t, err)
+	session.Values["key"] = "value"
+	assert.Nil(t, session.Save(r, w))
+	cookie := w.Result().Cookies()[0]
+	assert.Equal(t, 600, cookie.MaxAge)
+	assert.True(t, cookie.Secure)
+
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(cookie)
+	session, err = store.Get(r, "session")
+	assert.Nil(t, err)
+	assert.Equal(t, "value", session.Values["key"])
+}
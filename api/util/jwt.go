@@ -2,98 +2,189 @@ package util
 
 import (
 	"errors"
-	"fmt"
-	"net/http"
 	"time"
 
-	"github.com/dgrijalva/jwt-go"
-	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
 	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
 )
 
-func GenerateToken(jwtkey []byte, email string) (string, error) {
-	expirationTime := time.Now().Add(24 * time.Hour)
-	claims := &jwt.StandardClaims{
-		Subject:   email,
-		ExpiresAt: expirationTime.Unix(),
+// DefaultTokenIssuer and DefaultTokenAudience are what tokens are issued by
+// and for unless configured otherwise.
+const (
+	DefaultTokenIssuer   = "go-user-management"
+	DefaultTokenAudience = "go-user-management"
+)
+
+// Claims are the claims of an access token. Roles are informational for
+// other services; permissions are always checked against the database.
+type Claims struct {
+	Roles []string `json:"roles,omitempty"`
+	// SessionID is the login session the token was issued to.
+	SessionID string `json:"sid,omitempty"`
+	// IssuedAtNano is when the token was issued, in Unix nanoseconds. iat
+	// only has second precision.
+	IssuedAtNano int64 `json:"iat_ns,omitempty"`
+	jwt.StandardClaims
+}
+
+// GenerateToken issues an access token for subject, which is the user ID.
+// Unlike the email it never changes or gets reused by another account.
+func GenerateToken(keys *KeySet, subject string, roles []string) (string, error) {
+	return GenerateSessionToken(keys, subject, roles, "")
+}
+
+// GenerateSessionToken issues an access token for subject that belongs to
+// the login session sessionID, so that it ends with the session.
+func GenerateSessionToken(keys *KeySet, subject string, roles []string, sessionID string) (string, error) {
+	now := time.Now()
+	claims := &Claims{
+		Roles:        roles,
+		SessionID:    sessionID,
+		IssuedAtNano: now.UnixNano(),
+		StandardClaims: jwt.StandardClaims{
+			Id:        uuid.NewString(),
+			Subject:   subject,
+			Issuer:    keys.Issuer,
+			Audience:  keys.Audience,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(keys.AccessTokenTTL).Unix(),
+		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(jwtkey)
+	tokenString, err := keys.Sign(claims)
 	if err != nil {
 		return "", err
 	}
 	return tokenString, nil
 }
 
-func ParseToken(jwtKey []byte, tokenString string) (*jwt.StandardClaims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &jwt.StandardClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return jwtKey, nil
-	})
+func ParseToken(keys *KeySet, tokenString string) (*Claims, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, keys.Keyfunc)
 
 	if err != nil {
 		return nil, err
 	}
 
-	claims, ok := token.Claims.(*jwt.StandardClaims)
+	claims, ok := token.Claims.(*Claims)
 	if !ok || !token.Valid {
 		return nil, errors.New("Invalid token")
 	}
+	if !claims.VerifyIssuer(keys.Issuer, true) || !claims.VerifyAudience(keys.Audience, true) {
+		return nil, errors.New("Invalid token")
+	}
 	return claims, nil
 }
 
-func RefreshJWTToken(jwtKey []byte, oldTokenString string) (string, error) {
-	oldClaims, err := ParseToken(jwtKey, oldTokenString)
-	if err != nil {
-		return "", err
-	}
+// PurposeClaims are the claims of a single-purpose token such as an email
+// verification link. Email binds the token to the address it was sent to.
+type PurposeClaims struct {
+	Email string `json:"email,omitempty"`
+	jwt.StandardClaims
+}
 
-	expirationTime := time.Now().Add(24 * time.Hour)
-	newClaims := &jwt.StandardClaims{
-		Subject:   oldClaims.Subject,
-		ExpiresAt: expirationTime.Unix(),
-	}
+func purposeAudience(keys *KeySet, purpose string) string {
+	return keys.Audience + "/" + purpose
+}
+
+// GeneratePurposeToken issues a token that is only accepted for purpose. Its
+// audience differs from that of access tokens, so neither can be used in
+// place of the other.
+func GeneratePurposeToken(keys *KeySet, purpose string, subject string, email string, ttl time.Duration) (string, error) {
+	now := time.Now()
+	return keys.Sign(&PurposeClaims{
+		Email: email,
+		StandardClaims: jwt.StandardClaims{
+			Id:        uuid.NewString(),
+			Subject:   subject,
+			Issuer:    keys.Issuer,
+			Audience:  purposeAudience(keys, purpose),
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(ttl).Unix(),
+		},
+	})
+}
 
-	newToken := jwt.NewWithClaims(jwt.SigningMethodHS256, newClaims)
-	newTokenString, err := newToken.SignedString(jwtKey)
+func ParsePurposeToken(keys *KeySet, purpose string, tokenString string) (*PurposeClaims, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &PurposeClaims{}, keys.Keyfunc)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	return newTokenString, nil
-}
 
-func GetSubjectFromJWT(c *gin.Context, jwtkey []byte) (string, error) {
-	authHader := c.Request.Header.Get("Authorization")
-	if authHader == "" {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header required"})
-		c.Abort()
-		return "", errors.New("Authorization header required")
+	claims, ok := token.Claims.(*PurposeClaims)
+	if !ok || !token.Valid {
+		return nil, errors.New("Invalid token")
 	}
-	tokenString, err := ExtractBearerToken(authHader)
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
-		c.Abort()
-		return "", err
+	if !claims.VerifyIssuer(keys.Issuer, true) || !claims.VerifyAudience(purposeAudience(keys, purpose), true) {
+		return nil, errors.New("Invalid token")
 	}
+	return claims, nil
+}
 
-	claims := &jwt.StandardClaims{}
+// MarkTokenUsed records the ID of a single-use token until it expires. It
+// returns false if the token had already been used.
+func MarkTokenUsed(rdb *redis.Client, tokenID string, expiration time.Duration) (bool, error) {
+	return rdb.SetNX(ctx, "used_token:"+tokenID, true, expiration).Result()
+}
 
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, errors.New(fmt.Sprintf("unexpected signing method: %v", token.Header["alg"]))
-		}
-		return jwtkey, nil
-	})
+// ReleaseToken forgets that a single-use token was used, so that it can be
+// used again after what it was used for has failed.
+func ReleaseToken(rdb *redis.Client, tokenID string) error {
+	return rdb.Del(ctx, "used_token:"+tokenID).Err()
+}
 
-	if err != nil {
-		return "", err
-	}
+// TokenBlocklist records revoked access tokens until they expire. Besides
+// single tokens it can revoke every token of a subject issued before a point
+// in time, e.g. after a password reset.
+type TokenBlocklist interface {
+	Add(token string, expiration time.Duration) error
+	IsBlocklisted(token string) (bool, error)
+	RevokeSubject(subject string, expiration time.Duration) error
+	// SubjectRevokedAt returns when tokens of subject were last revoked, or
+	// the zero time if they never were.
+	SubjectRevokedAt(subject string) (time.Time, error)
+}
 
-	if claims, ok := token.Claims.(*jwt.StandardClaims); ok && token.Valid {
-		return claims.Subject, nil
-	}
+// RevokedBy reports whether a token issued at iatNano, in Unix nanoseconds,
+// was issued before revokedAt.
+func RevokedBy(iatNano int64, revokedAt time.Time) bool {
+	return !revokedAt.IsZero() && iatNano <= revokedAt.UnixNano()
+}
+
+// SessionSubject is what the tokens of a login session are revoked under
+// with RevokeSubject.
+func SessionSubject(sessionID string) string {
+	return "session:" + sessionID
+}
+
+type RedisTokenBlocklist struct {
+	rdb *redis.Client
+}
+
+func NewRedisTokenBlocklist(rdb *redis.Client) *RedisTokenBlocklist {
+	return &RedisTokenBlocklist{rdb}
+}
+
+func (b *RedisTokenBlocklist) Add(token string, expiration time.Duration) error {
+	return AddTokenToBlacklist(token, b.rdb, expiration)
+}
+
+func (b *RedisTokenBlocklist) IsBlocklisted(token string) (bool, error) {
+	return IsTokenBlocklisted(token, b.rdb)
+}
 
-	return "", errors.New("Invalid token")
+func (b *RedisTokenBlocklist) RevokeSubject(subject string, expiration time.Duration) error {
+	return b.rdb.Set(ctx, "revoked_subject:"+subject, time.Now().UnixNano(), expiration).Err()
+}
+
+func (b *RedisTokenBlocklist) SubjectRevokedAt(subject string) (time.Time, error) {
+	revokedAt, err := b.rdb.Get(ctx, "revoked_subject:"+subject).Int64()
+	if err == redis.Nil {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, revokedAt), nil
 }
 
 func AddTokenToBlacklist(token string, rdb *redis.Client, expiration time.Duration) error {
@@ -101,13 +192,15 @@ func AddTokenToBlacklist(token string, rdb *redis.Client, expiration time.Durati
 	return err
 }
 
+// IsTokenBlocklisted reports whether token has been added to the blocklist.
+// Redis stores the value written by AddTokenToBlacklist as "1", so only the
+// presence of the key counts.
 func IsTokenBlocklisted(token string, rdb *redis.Client) (bool, error) {
-	val, err := rdb.Get(ctx, token).Result()
+	_, err := rdb.Get(ctx, token).Result()
 	if err == redis.Nil {
 		return false, nil
 	} else if err != nil {
 		return false, err
 	}
-	return val == "true", nil
-
+	return true, nil
 }
@@ -0,0 +1,148 @@
+package util
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestKeySet() *KeySet {
+	return NewKeySet(NewHMACSigner("test", []byte("test_key")), DefaultKeyGracePeriod)
+}
+
+func TestGenerateAndParseToken(t *testing.T) {
+	keys := newTestKeySet()
+
+	subject := uuid.NewString()
+	tokenString, err := GenerateToken(keys, subject, []string{"admin"})
+	assert.Nil(t, err)
+
+	claims, err := ParseToken(keys, tokenString)
+	assert.Nil(t, err)
+	assert.Equal(t, subject, claims.Subject)
+	assert.Equal(t, []string{"admin"}, claims.Roles)
+	assert.Equal(t, DefaultTokenIssuer, claims.Issuer)
+	assert.Equal(t, DefaultTokenAudience, claims.Audience)
+	assert.NotEmpty(t, claims.Id)
+	assert.NotZero(t, claims.IssuedAt)
+
+	_, err = ParseToken(NewKeySet(NewHMACSigner("test", []byte("other_key")), 0), tokenString)
+	assert.NotNil(t, err)
+}
+
+func TestGenerateSessionToken(t *testing.T) {
+	keys := newTestKeySet()
+
+	tokenString, err := GenerateSessionToken(keys, uuid.NewString(), nil, "session")
+	assert.Nil(t, err)
+
+	claims, err := ParseToken(keys, tokenString)
+	assert.Nil(t, err)
+	assert.Equal(t, "session", claims.SessionID)
+}
+
+func TestParseTokenRejectsForeignIssuerAndAudience(t *testing.T) {
+	keys := newTestKeySet()
+
+	for _, claims := range []jwt.StandardClaims{
+		{Issuer: "someone-else", Audience: DefaultTokenAudience},
+		{Issuer: DefaultTokenIssuer, Audience: "someone-else"},
+		{},
+	} {
+		claims.ExpiresAt = time.Now().Add(time.Hour).Unix()
+		tokenString, _ := keys.Sign(claims)
+
+		_, err := ParseToken(keys, tokenString)
+		assert.NotNil(t, err)
+	}
+}
+
+func TestTokensUseConfiguredIssuerAndAudience(t *testing.T) {
+	keys := newTestKeySet()
+	keys.Issuer = "https://auth.example.com"
+	keys.Audience = "example"
+	keys.AccessTokenTTL = time.Minute
+
+	tokenString, err := GenerateToken(keys, uuid.NewString(), nil)
+	assert.Nil(t, err)
+
+	claims, err := ParseToken(keys, tokenString)
+	assert.Nil(t, err)
+	assert.Equal(t, "https://auth.example.com", claims.Issuer)
+	assert.Equal(t, "example", claims.Audience)
+	assert.InDelta(t, time.Now().Add(time.Minute).Unix(), claims.ExpiresAt, 2)
+
+	_, err = ParseToken(newTestKeySet(), tokenString)
+	assert.NotNil(t, err)
+}
+
+const testPurpose = "test-purpose"
+
+func TestPurposeTokensAreNotAccessTokens(t *testing.T) {
+	keys := newTestKeySet()
+
+	token, err := GeneratePurposeToken(keys, testPurpose, "user-id", "test@test.com", time.Minute)
+	assert.Nil(t, err)
+	_, err = ParseToken(keys, token)
+	assert.NotNil(t, err)
+	_, err = ParsePurposeToken(keys, "other-purpose", token)
+	assert.NotNil(t, err)
+
+	accessToken, _ := GenerateToken(keys, "user-id", nil)
+	_, err = ParsePurposeToken(keys, testPurpose, accessToken)
+	assert.NotNil(t, err)
+}
+
+func TestRedisTokenBlocklist(t *testing.T) {
+	blocklist := NewRedisTokenBlocklist(setupTestRedis(t))
+
+	blocklisted, err := blocklist.IsBlocklisted("token")
+	assert.Nil(t, err)
+	assert.False(t, blocklisted)
+
+	assert.Nil(t, blocklist.Add("token", time.Minute))
+	blocklisted, err = blocklist.IsBlocklisted("token")
+	assert.Nil(t, err)
+	assert.True(t, blocklisted)
+}
+
+func TestRedisTokenBlocklistRevokeSubject(t *testing.T) {
+	rdb := setupTestRedis(t)
+	blocklist := NewRedisTokenBlocklist(rdb)
+	keys := newTestKeySet()
+
+	revokedAt, err := blocklist.SubjectRevokedAt("user")
+	assert.Nil(t, err)
+	assert.True(t, revokedAt.IsZero())
+
+	before, _ := GenerateToken(keys, "user", nil)
+	assert.Nil(t, blocklist.RevokeSubject("user", time.Minute))
+	after, _ := GenerateToken(keys, "user", nil)
+	revokedAt, err = blocklist.SubjectRevokedAt("user")
+	assert.Nil(t, err)
+
+	// A token issued right after the revocation, e.g. on logging in again,
+	// is not revoked even within the same second
+	claims, _ := ParseToken(keys, before)
+	assert.True(t, RevokedBy(claims.IssuedAtNano, revokedAt))
+	claims, _ = ParseToken(keys, after)
+	assert.False(t, RevokedBy(claims.IssuedAtNano, revokedAt))
+}
+
+func TestMarkTokenUsed(t *testing.T) {
+	rdb := setupTestRedis(t)
+
+	first, err := MarkTokenUsed(rdb, "token-id", time.Minute)
+	assert.Nil(t, err)
+	assert.True(t, first)
+	first, _ = MarkTokenUsed(rdb, "token-id", time.Minute)
+	assert.False(t, first)
+
+	// Released tokens can be used again
+	assert.Nil(t, ReleaseToken(rdb, "token-id"))
+	first, _ = MarkTokenUsed(rdb, "token-id", time.Minute)
+	assert.True(t, first)
+}
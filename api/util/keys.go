@@ -0,0 +1,330 @@
+package util
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+	AlgES256 = "ES256"
+	AlgEdDSA = "EdDSA"
+)
+
+// DefaultKeyGracePeriod is how long a rotated-out key keeps verifying tokens.
+// It has to cover the lifetime of the longest token signed with it.
+const DefaultKeyGracePeriod = 2 * DefaultAccessTokenTTL
+
+var ErrUnknownSigningKey = errors.New("Unknown signing key")
+
+// Signer is a key that signs tokens and verifies their signatures.
+type Signer interface {
+	KeyID() string
+	Method() jwt.SigningMethod
+	SigningKey() interface{}
+	VerificationKey() interface{}
+}
+
+type signer struct {
+	kid     string
+	method  jwt.SigningMethod
+	private interface{}
+	public  interface{}
+}
+
+func (s *signer) KeyID() string                { return s.kid }
+func (s *signer) Method() jwt.SigningMethod    { return s.method }
+func (s *signer) SigningKey() interface{}      { return s.private }
+func (s *signer) VerificationKey() interface{} { return s.public }
+
+// NewHMACSigner returns a signer for a shared secret. HMAC keys are never
+// published, so only services holding the secret can verify its tokens.
+func NewHMACSigner(kid string, key []byte) Signer {
+	return &signer{kid: kid, method: jwt.SigningMethodHS256, private: key, public: key}
+}
+
+// NewSigner wraps an asymmetric private key for alg. The key ID is derived
+// from the public key so that every replica loading the same key agrees on it.
+func NewSigner(alg string, private crypto.Signer) (Signer, error) {
+	var method jwt.SigningMethod
+	switch key := private.(type) {
+	case *rsa.PrivateKey:
+		if alg != AlgRS256 {
+			return nil, fmt.Errorf("RSA key cannot be used for %s", alg)
+		}
+		method = jwt.SigningMethodRS256
+	case *ecdsa.PrivateKey:
+		if alg != AlgES256 || key.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("ECDSA key cannot be used for %s", alg)
+		}
+		method = jwt.SigningMethodES256
+	case ed25519.PrivateKey:
+		if alg != AlgEdDSA {
+			return nil, fmt.Errorf("Ed25519 key cannot be used for %s", alg)
+		}
+		method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", private)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(private.Public())
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(der)
+
+	return &signer{
+		kid:     base64.RawURLEncoding.EncodeToString(sum[:12]),
+		method:  method,
+		private: private,
+		public:  private.Public(),
+	}, nil
+}
+
+// GenerateSigner creates a signer with a fresh random key for alg.
+func GenerateSigner(alg string) (Signer, error) {
+	switch alg {
+	case AlgHS256:
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		kid, err := RandomToken(12)
+		if err != nil {
+			return nil, err
+		}
+		return NewHMACSigner(kid, key), nil
+	case AlgRS256:
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		return NewSigner(alg, key)
+	case AlgES256:
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return NewSigner(alg, key)
+	case AlgEdDSA:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return NewSigner(alg, key)
+	}
+	return nil, fmt.Errorf("unsupported signing algorithm %q", alg)
+}
+
+// ParsePrivateKeyPEM reads a PKCS#8, PKCS#1 or SEC 1 encoded private key.
+func ParsePrivateKeyPEM(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		if s, ok := key.(crypto.Signer); ok {
+			return s, nil
+		}
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("unsupported private key format")
+}
+
+type retiredKey struct {
+	signer Signer
+	until  time.Time
+}
+
+// KeySet holds the signer used for new tokens together with the keys it
+// replaced. Replaced keys keep verifying tokens until their grace period ends.
+//
+// Issuer and Audience are stamped into the tokens signed with the set and
+// required when parsing them; AccessTokenTTL is how long access tokens last.
+type KeySet struct {
+	Issuer         string
+	Audience       string
+	AccessTokenTTL time.Duration
+
+	mu      sync.RWMutex
+	active  Signer
+	retired []retiredKey
+	// pending keys are published and verify tokens, but are not signed
+	// with yet.
+	pending []Signer
+	grace   time.Duration
+	now     func() time.Time
+}
+
+func NewKeySet(active Signer, grace time.Duration) *KeySet {
+	return &KeySet{
+		Issuer:         DefaultTokenIssuer,
+		Audience:       DefaultTokenAudience,
+		AccessTokenTTL: DefaultAccessTokenTTL,
+
+		active: active,
+		grace:  grace,
+		now:    time.Now,
+	}
+}
+
+// LoadKeySet builds the key set for alg. HS256 signs with key; the
+// asymmetric algorithms read privateKeyFile or, if it is empty, generate a key
+// that only lives as long as the process. Servers replace such a key with
+// ones shared through a KeyStore.
+func LoadKeySet(alg string, key string, privateKeyFile string, grace time.Duration) (*KeySet, error) {
+	if alg == AlgHS256 {
+		if key == "" {
+			return nil, errors.New("a key is required for HS256")
+		}
+		return NewKeySet(NewHMACSigner("default", []byte(key)), grace), nil
+	}
+
+	if privateKeyFile == "" {
+		s, err := GenerateSigner(alg)
+		if err != nil {
+			return nil, err
+		}
+		return NewKeySet(s, grace), nil
+	}
+
+	data, err := os.ReadFile(privateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	private, err := ParsePrivateKeyPEM(data)
+	if err != nil {
+		return nil, err
+	}
+	s, err := NewSigner(alg, private)
+	if err != nil {
+		return nil, err
+	}
+	return NewKeySet(s, grace), nil
+}
+
+// Signer returns the key new tokens are signed with.
+func (ks *KeySet) Signer() Signer {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return ks.active
+}
+
+// replace swaps in all keys of the set at once.
+func (ks *KeySet) replace(active Signer, retired []retiredKey, pending []Signer) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.active = active
+	ks.retired = retired
+	ks.pending = pending
+}
+
+// Keys returns every key that currently verifies tokens, active key first.
+func (ks *KeySet) Keys() []Signer {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	now := ks.now()
+	keys := []Signer{ks.active}
+	keys = append(keys, ks.pending...)
+	for _, key := range ks.retired {
+		if now.Before(key.until) {
+			keys = append(keys, key.signer)
+		}
+	}
+	return keys
+}
+
+// Keyfunc resolves the verification key of token by its kid header. The
+// token's algorithm must match the key's, which rules out algorithm
+// confusion such as an HS256 token "signed" with a published RSA key.
+func (ks *KeySet) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	for _, key := range ks.Keys() {
+		if key.KeyID() != kid {
+			continue
+		}
+		if token.Method.Alg() != key.Method().Alg() {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return key.VerificationKey(), nil
+	}
+	return nil, ErrUnknownSigningKey
+}
+
+// Sign signs claims with the active key and records its kid in the header.
+func (ks *KeySet) Sign(claims jwt.Claims) (string, error) {
+	s := ks.Signer()
+	token := jwt.NewWithClaims(s.Method(), claims)
+	token.Header["kid"] = s.KeyID()
+	return token.SignedString(s.SigningKey())
+}
+
+// JWK is a public key in JSON Web Key format (RFC 7517).
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public halves of all verifying keys. HMAC keys are
+// secret and therefore left out.
+func (ks *KeySet) JWKS() JWKS {
+	set := JWKS{Keys: []JWK{}}
+	for _, key := range ks.Keys() {
+		jwk := JWK{Kid: key.KeyID(), Use: "sig", Alg: key.Method().Alg()}
+		switch public := key.VerificationKey().(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case *ecdsa.PublicKey:
+			size := (public.Curve.Params().BitSize + 7) / 8
+			jwk.Kty = "EC"
+			jwk.Crv = public.Curve.Params().Name
+			jwk.X = base64.RawURLEncoding.EncodeToString(public.X.FillBytes(make([]byte, size)))
+			jwk.Y = base64.RawURLEncoding.EncodeToString(public.Y.FillBytes(make([]byte, size)))
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		default:
+			continue
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
@@ -0,0 +1,83 @@
+package util
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeySetAlgorithms(t *testing.T) {
+	for _, alg := range []string{AlgHS256, AlgRS256, AlgES256, AlgEdDSA} {
+		s, err := GenerateSigner(alg)
+		assert.Nil(t, err, alg)
+		assert.Equal(t, alg, s.Method().Alg())
+
+		keys := NewKeySet(s, DefaultKeyGracePeriod)
+		tokenString, err := GenerateToken(keys, uuid.NewString(), nil)
+		assert.Nil(t, err, alg)
+
+		token, _, err := new(jwt.Parser).ParseUnverified(tokenString, &Claims{})
+		assert.Nil(t, err, alg)
+		assert.Equal(t, s.KeyID(), token.Header["kid"])
+
+		_, err = ParseToken(keys, tokenString)
+		assert.Nil(t, err, alg)
+	}
+}
+
+func TestKeySetRejectsAlgorithmConfusion(t *testing.T) {
+	s, _ := GenerateSigner(AlgRS256)
+	keys := NewKeySet(s, DefaultKeyGracePeriod)
+
+	// An attacker signs with HS256 using the published RSA public key
+	public, _ := x509.MarshalPKIXPublicKey(s.VerificationKey().(*rsa.PublicKey))
+	secret := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public})
+
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, &Claims{StandardClaims: jwt.StandardClaims{
+		Subject:   uuid.NewString(),
+		Issuer:    DefaultTokenIssuer,
+		Audience:  DefaultTokenAudience,
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	}})
+	forged.Header["kid"] = s.KeyID()
+	tokenString, _ := forged.SignedString(secret)
+
+	_, err := ParseToken(keys, tokenString)
+	assert.NotNil(t, err)
+}
+
+func TestJWKS(t *testing.T) {
+	hmac, _ := GenerateSigner(AlgHS256)
+	assert.Len(t, NewKeySet(hmac, 0).JWKS().Keys, 0)
+
+	for alg, kty := range map[string]string{AlgRS256: "RSA", AlgES256: "EC", AlgEdDSA: "OKP"} {
+		s, _ := GenerateSigner(alg)
+		jwks := NewKeySet(s, 0).JWKS()
+		assert.Len(t, jwks.Keys, 1)
+		assert.Equal(t, kty, jwks.Keys[0].Kty)
+		assert.Equal(t, s.KeyID(), jwks.Keys[0].Kid)
+		assert.Equal(t, alg, jwks.Keys[0].Alg)
+	}
+}
+
+func TestParsePrivateKeyPEM(t *testing.T) {
+	s, _ := GenerateSigner(AlgEdDSA)
+	der, _ := x509.MarshalPKCS8PrivateKey(s.SigningKey())
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	private, err := ParsePrivateKeyPEM(data)
+	assert.Nil(t, err)
+
+	loaded, err := NewSigner(AlgEdDSA, private)
+	assert.Nil(t, err)
+	assert.Equal(t, s.KeyID(), loaded.KeyID())
+
+	_, err = NewSigner(AlgRS256, private)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,248 @@
+package util
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// JWKSMaxAge is how long verifiers may cache the published keys.
+const JWKSMaxAge = 5 * time.Minute
+
+// KeyPublishLead is how long a new key is published before tokens are signed
+// with it, so that verifiers holding a cached JWKS already know it.
+const KeyPublishLead = 2 * JWKSMaxAge
+
+// KeySyncInterval is how often instances pick up keys created by others.
+const KeySyncInterval = time.Minute
+
+const signingKeysKey = "signing_keys"
+
+// ErrSymmetricRotation is returned when rotating HS256 keys. Generated
+// secrets could not be published for other instances to verify with.
+var ErrSymmetricRotation = errors.New("HS256 keys cannot be rotated automatically")
+
+// ErrUndecryptableKey is returned when a shared signing key was encrypted
+// with a different key encryption key.
+var ErrUndecryptableKey = errors.New("failed to decrypt shared signing key")
+
+// storedKey is a shared signing key. PrivateKey is PKCS#8 encoded and
+// sealed with the key encryption key.
+type storedKey struct {
+	PrivateKey []byte    `json:"private_key"`
+	ActiveFrom time.Time `json:"active_from"`
+}
+
+// KeyStore shares the generated signing keys of an asymmetric key set through
+// Redis, so that all instances sign with and publish the same keys and a
+// restart does not invalidate the tokens already issued. Anyone holding a
+// private key can sign tokens for any user, so the keys are encrypted with
+// AES-GCM before they are written and Redis never sees them in the clear.
+type KeyStore struct {
+	rdb  *redis.Client
+	keys *KeySet
+	alg  string
+	aead cipher.AEAD
+	// base is the configured key, which signs until the first shared key
+	// becomes active. Without one, the first shared key is active at once.
+	base Signer
+	now  func() time.Time
+}
+
+// NewKeyStore returns a KeyStore that encrypts the shared keys with a key
+// derived from secret, which every instance has to be configured with.
+func NewKeyStore(rdb *redis.Client, keys *KeySet, alg string, base Signer, secret string) (*KeyStore, error) {
+	kek := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(kek[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyStore{rdb: rdb, keys: keys, alg: alg, aead: aead, base: base, now: time.Now}, nil
+}
+
+// seal encrypts a PKCS#8 encoded private key, prefixed with its nonce.
+func (s *KeyStore) seal(der []byte) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(nonce, nonce, der, []byte(s.alg)), nil
+}
+
+func (s *KeyStore) open(sealed []byte) ([]byte, error) {
+	if len(sealed) < s.aead.NonceSize() {
+		return nil, ErrUndecryptableKey
+	}
+	nonce, ciphertext := sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():]
+	der, err := s.aead.Open(nil, nonce, ciphertext, []byte(s.alg))
+	if err != nil {
+		return nil, ErrUndecryptableKey
+	}
+	return der, nil
+}
+
+// Sync loads the shared keys into the key set. A key is created first if
+// there is none, or if interval is set and the newest one is due to be
+// replaced. Replacements are published KeyPublishLead before they sign.
+func (s *KeyStore) Sync(interval time.Duration) error {
+	if s.alg == AlgHS256 {
+		return ErrSymmetricRotation
+	}
+	for {
+		stored, err := s.update(interval)
+		// Another instance changed the keys since they were read.
+		if errors.Is(err, redis.TxFailedErr) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		return s.load(stored)
+	}
+}
+
+func (s *KeyStore) update(interval time.Duration) ([]storedKey, error) {
+	var stored []storedKey
+	err := s.rdb.Watch(ctx, func(tx *redis.Tx) error {
+		stored = nil
+		data, err := tx.Get(ctx, signingKeysKey).Bytes()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if err == nil {
+			if err := json.Unmarshal(data, &stored); err != nil {
+				return err
+			}
+		}
+
+		now := s.now()
+		if len(stored) > 0 && (interval == 0 || now.Before(stored[len(stored)-1].ActiveFrom.Add(interval-KeyPublishLead))) {
+			return nil
+		}
+		signer, err := GenerateSigner(s.alg)
+		if err != nil {
+			return err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(signer.SigningKey())
+		if err != nil {
+			return err
+		}
+		sealed, err := s.seal(der)
+		if err != nil {
+			return err
+		}
+		activeFrom := now.Add(KeyPublishLead)
+		if len(stored) == 0 && s.base == nil {
+			activeFrom = now
+		}
+		stored = append(s.prune(stored, now), storedKey{PrivateKey: sealed, ActiveFrom: activeFrom})
+
+		data, err = json.Marshal(stored)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, signingKeysKey, data, 0)
+			return nil
+		})
+		return err
+	}, signingKeysKey)
+	return stored, err
+}
+
+// prune drops the keys whose grace period ended after their successor took
+// over.
+func (s *KeyStore) prune(stored []storedKey, now time.Time) []storedKey {
+	for len(stored) > 1 && now.After(stored[1].ActiveFrom.Add(s.keys.grace)) {
+		stored = stored[1:]
+	}
+	return stored
+}
+
+// load makes the newest shared key that is due the active one. Keys it
+// replaced keep verifying for the grace period after their successor took
+// over; later keys are only published.
+func (s *KeyStore) load(stored []storedKey) error {
+	signers := make([]Signer, len(stored))
+	for i, key := range stored {
+		der, err := s.open(key.PrivateKey)
+		if err != nil {
+			return err
+		}
+		private, err := x509.ParsePKCS8PrivateKey(der)
+		if err != nil {
+			return err
+		}
+		cryptoSigner, ok := private.(crypto.Signer)
+		if !ok {
+			return errors.New("unsupported shared signing key")
+		}
+		signers[i], err = NewSigner(s.alg, cryptoSigner)
+		if err != nil {
+			return err
+		}
+	}
+
+	now := s.now()
+	active := -1
+	for i, key := range stored {
+		if !now.Before(key.ActiveFrom) {
+			active = i
+		}
+	}
+
+	var retired []retiredKey
+	var pending []Signer
+	var activeSigner Signer
+	switch {
+	case active >= 0:
+		activeSigner = signers[active]
+		if s.base != nil {
+			retired = append(retired, retiredKey{signer: s.base, until: stored[0].ActiveFrom.Add(s.keys.grace)})
+		}
+		for i := 0; i < active; i++ {
+			retired = append(retired, retiredKey{signer: signers[i], until: stored[i+1].ActiveFrom.Add(s.keys.grace)})
+		}
+		pending = signers[active+1:]
+	case s.base != nil:
+		activeSigner = s.base
+		pending = signers
+	default:
+		// The first key was created by an instance whose clock is ahead.
+		activeSigner = signers[0]
+		pending = signers[1:]
+	}
+	s.keys.replace(activeSigner, retired, pending)
+	return nil
+}
+
+// Start syncs the keys every KeySyncInterval until stop is closed, creating
+// a new one every interval if it is set.
+func (s *KeyStore) Start(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(KeySyncInterval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := s.Sync(interval); err != nil {
+					log.Printf("failed to sync signing keys: %v", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
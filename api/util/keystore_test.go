@@ -0,0 +1,103 @@
+package util
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+const testKeyEncryptionKey = "0123456789abcdef0123456789abcdef"
+
+func newTestKeyStore(t *testing.T, rdb *redis.Client, keys *KeySet, alg string, base Signer, now *time.Time) *KeyStore {
+	t.Helper()
+	store, err := NewKeyStore(rdb, keys, alg, base, testKeyEncryptionKey)
+	assert.Nil(t, err)
+	store.now = func() time.Time { return *now }
+	store.keys.now = store.now
+	return store
+}
+
+func TestKeyStoreSharesKeys(t *testing.T) {
+	rdb := setupTestRedis(t)
+	now := time.Now()
+	ephemeral := func() *KeySet {
+		s, _ := GenerateSigner(AlgES256)
+		return NewKeySet(s, time.Hour)
+	}
+
+	first := newTestKeyStore(t, rdb, ephemeral(), AlgES256, nil, &now)
+	assert.Nil(t, first.Sync(0))
+	token, err := GenerateToken(first.keys, uuid.NewString(), nil)
+	assert.Nil(t, err)
+
+	// Another instance, or the same one after a restart, uses the same key
+	second := newTestKeyStore(t, rdb, ephemeral(), AlgES256, nil, &now)
+	assert.Nil(t, second.Sync(0))
+	assert.Equal(t, first.keys.Signer().KeyID(), second.keys.Signer().KeyID())
+	_, err = ParseToken(second.keys, token)
+	assert.Nil(t, err)
+
+	// Without rotation the key is kept
+	now = now.Add(48 * time.Hour)
+	assert.Nil(t, second.Sync(0))
+	assert.Equal(t, first.keys.Signer().KeyID(), second.keys.Signer().KeyID())
+
+	// The private keys are encrypted, and only instances with the same key
+	// encryption key can use them
+	data, _ := rdb.Get(ctx, signingKeysKey).Bytes()
+	var stored []storedKey
+	assert.Nil(t, json.Unmarshal(data, &stored))
+	_, err = x509.ParsePKCS8PrivateKey(stored[0].PrivateKey)
+	assert.NotNil(t, err)
+	foreign, _ := NewKeyStore(rdb, ephemeral(), AlgES256, nil, "another key encryption key of 32+ bytes")
+	assert.ErrorIs(t, foreign.Sync(0), ErrUndecryptableKey)
+
+	symmetric, _ := NewKeyStore(rdb, ephemeral(), AlgHS256, nil, testKeyEncryptionKey)
+	assert.ErrorIs(t, symmetric.Sync(0), ErrSymmetricRotation)
+}
+
+func TestKeyStoreRotation(t *testing.T) {
+	rdb := setupTestRedis(t)
+	now := time.Now()
+	base, _ := GenerateSigner(AlgRS256)
+	store := newTestKeyStore(t, rdb, NewKeySet(base, time.Hour), AlgRS256, base, &now)
+	interval := 24 * time.Hour
+
+	// The configured key signs until the first generated key is due, which
+	// is published ahead of time
+	assert.Nil(t, store.Sync(interval))
+	assert.Equal(t, base.KeyID(), store.keys.Signer().KeyID())
+	assert.Len(t, store.keys.JWKS().Keys, 2)
+	oldToken, _ := GenerateToken(store.keys, uuid.NewString(), nil)
+
+	now = now.Add(KeyPublishLead)
+	assert.Nil(t, store.Sync(interval))
+	next := store.keys.Signer()
+	assert.NotEqual(t, base.KeyID(), next.KeyID())
+	_, err := ParseToken(store.keys, oldToken)
+	assert.Nil(t, err)
+
+	// Replacements are published before they are used as well
+	now = now.Add(interval - KeyPublishLead)
+	assert.Nil(t, store.Sync(interval))
+	assert.Equal(t, next.KeyID(), store.keys.Signer().KeyID())
+	assert.Len(t, store.keys.JWKS().Keys, 2)
+
+	// Other instances pick up the keys instead of making their own
+	other := newTestKeyStore(t, rdb, NewKeySet(base, time.Hour), AlgRS256, base, &now)
+	assert.Nil(t, other.Sync(interval))
+	assert.Equal(t, store.keys.JWKS(), other.keys.JWKS())
+
+	// Once the grace period is over only the current keys are left
+	now = now.Add(KeyPublishLead + time.Hour)
+	assert.Nil(t, store.Sync(interval))
+	assert.NotEqual(t, next.KeyID(), store.keys.Signer().KeyID())
+	assert.Len(t, store.keys.JWKS().Keys, 1)
+	_, err = ParseToken(store.keys, oldToken)
+	assert.ErrorIs(t, err, ErrUnknownSigningKey)
+}
@@ -0,0 +1,114 @@
+package util
+
+import (
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const loginBaseDelay = time.Second
+
+// loginIPFailureFactor scales the account threshold for client IPs, which
+// legitimately see failures from several users behind the same NAT.
+const loginIPFailureFactor = 4
+
+// LoginGuard tracks failed logins per account and per client IP in Redis.
+// Every failure imposes an exponentially growing delay before the next
+// attempt, and reaching the threshold within the window locks the account or
+// IP out for the lockout duration. Accounts are tracked by the submitted
+// email whether or not it exists, so the guard never reveals which do.
+type LoginGuard struct {
+	rdb         *redis.Client
+	maxFailures int
+	window      time.Duration
+	lockout     time.Duration
+}
+
+func NewLoginGuard(rdb *redis.Client, maxFailures int, window time.Duration, lockout time.Duration) *LoginGuard {
+	return &LoginGuard{
+		rdb:         rdb,
+		maxFailures: maxFailures,
+		window:      window,
+		lockout:     lockout,
+	}
+}
+
+// Check returns how long the caller has to wait before the next attempt for
+// email from ip, or zero if it may proceed.
+func (g *LoginGuard) Check(email string, ip string) (time.Duration, error) {
+	var wait time.Duration
+	for _, subject := range loginSubjects(email, ip) {
+		for _, key := range []string{"login_locked:" + subject, "login_backoff:" + subject} {
+			ttl, err := g.rdb.PTTL(ctx, key).Result()
+			if err != nil {
+				return 0, err
+			}
+			if ttl > wait {
+				wait = ttl
+			}
+		}
+	}
+	return wait, nil
+}
+
+// RecordFailure counts a failed attempt for email from ip.
+func (g *LoginGuard) RecordFailure(email string, ip string) error {
+	for i, subject := range loginSubjects(email, ip) {
+		limit := g.maxFailures
+		if i == 1 {
+			limit *= loginIPFailureFactor
+		}
+
+		key := "login_failures:" + subject
+		failures, err := g.rdb.Incr(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		if failures == 1 {
+			if err := g.rdb.Expire(ctx, key, g.window).Err(); err != nil {
+				return err
+			}
+		}
+
+		if int(failures) >= limit {
+			if err := g.rdb.Set(ctx, "login_locked:"+subject, true, g.lockout).Err(); err != nil {
+				return err
+			}
+			if err := g.rdb.Del(ctx, key).Err(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		delay := loginBaseDelay << (failures - 1)
+		if delay > g.lockout || delay <= 0 {
+			delay = g.lockout
+		}
+		if err := g.rdb.Set(ctx, "login_backoff:"+subject, true, delay).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reset clears the failures of email after a successful login. The IP keeps
+// its record so that one valid account cannot be used to mask guessing
+// against others.
+func (g *LoginGuard) Reset(email string) error {
+	subject := loginSubjects(email, "")[0]
+	return g.rdb.Del(ctx, "login_failures:"+subject, "login_backoff:"+subject).Err()
+}
+
+// Unlock lifts a lockout of email, e.g. on request of an administrator.
+func (g *LoginGuard) Unlock(email string) error {
+	subject := loginSubjects(email, "")[0]
+	return g.rdb.Del(ctx, "login_failures:"+subject, "login_backoff:"+subject, "login_locked:"+subject).Err()
+}
+
+func loginSubjects(email string, ip string) []string {
+	return []string{
+		"account:" + strings.ToLower(strings.TrimSpace(email)),
+		"ip:" + ip,
+	}
+}
@@ -0,0 +1,81 @@
+package util
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoginGuardBackoffAndLockout(t *testing.T) {
+	mr := miniredis.RunT(t)
+	guard := NewLoginGuard(redis.NewClient(&redis.Options{Addr: mr.Addr()}), 3, time.Hour, 15*time.Minute)
+
+	wait, err := guard.Check("test@test.com", "192.0.2.1")
+	assert.Nil(t, err)
+	assert.Zero(t, wait)
+
+	// Each failure doubles the delay
+	assert.Nil(t, guard.RecordFailure("test@test.com", "192.0.2.1"))
+	wait, _ = guard.Check("test@test.com", "192.0.2.1")
+	assert.Equal(t, time.Second, wait)
+
+	mr.FastForward(time.Second)
+	assert.Nil(t, guard.RecordFailure("Test@test.com ", "192.0.2.1"))
+	wait, _ = guard.Check("test@test.com", "192.0.2.2")
+	assert.Equal(t, 2*time.Second, wait)
+
+	// Reaching the threshold locks the account from every IP
+	mr.FastForward(2 * time.Second)
+	assert.Nil(t, guard.RecordFailure("test@test.com", "192.0.2.1"))
+	wait, _ = guard.Check("test@test.com", "198.51.100.7")
+	assert.Equal(t, 15*time.Minute, wait)
+
+	// Other accounts are only affected through the IP backoff
+	wait, _ = guard.Check("other@test.com", "198.51.100.7")
+	assert.Zero(t, wait)
+
+	mr.FastForward(15 * time.Minute)
+	wait, _ = guard.Check("test@test.com", "198.51.100.7")
+	assert.Zero(t, wait)
+}
+
+func TestLoginGuardIPLockout(t *testing.T) {
+	mr := miniredis.RunT(t)
+	guard := NewLoginGuard(redis.NewClient(&redis.Options{Addr: mr.Addr()}), 2, time.Hour, 15*time.Minute)
+
+	// Spraying one password across many accounts still locks the IP
+	for _, email := range []string{"a@test.com", "b@test.com", "c@test.com", "d@test.com", "e@test.com", "f@test.com", "g@test.com", "h@test.com"} {
+		assert.Nil(t, guard.RecordFailure(email, "192.0.2.1"))
+	}
+	wait, _ := guard.Check("new@test.com", "192.0.2.1")
+	assert.Equal(t, 15*time.Minute, wait)
+
+	wait, _ = guard.Check("new@test.com", "192.0.2.2")
+	assert.Zero(t, wait)
+}
+
+func TestLoginGuardResetAndUnlock(t *testing.T) {
+	mr := miniredis.RunT(t)
+	guard := NewLoginGuard(redis.NewClient(&redis.Options{Addr: mr.Addr()}), 2, time.Hour, 15*time.Minute)
+
+	guard.RecordFailure("test@test.com", "192.0.2.1")
+	assert.Nil(t, guard.Reset("test@test.com"))
+	mr.FastForward(time.Second)
+
+	// The reset failure no longer counts towards the lockout
+	guard.RecordFailure("test@test.com", "192.0.2.2")
+	wait, _ := guard.Check("test@test.com", "192.0.2.3")
+	assert.Equal(t, time.Second, wait)
+
+	mr.FastForward(time.Second)
+	guard.RecordFailure("test@test.com", "192.0.2.2")
+	wait, _ = guard.Check("test@test.com", "192.0.2.3")
+	assert.Equal(t, 15*time.Minute, wait)
+
+	assert.Nil(t, guard.Unlock("test@test.com"))
+	wait, _ = guard.Check("test@test.com", "192.0.2.3")
+	assert.Zero(t, wait)
+}
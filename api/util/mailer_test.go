@@ -0,0 +1,31 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryMailer(t *testing.T) {
+	mailer := NewMemoryMailer()
+	assert.Empty(t, mailer.Messages())
+
+	err := mailer.Send(Message{To: "test@test.com", Subject: "subject", Body: "body"})
+	assert.Nil(t, err)
+	assert.Equal(t, []Message{{To: "test@test.com", Subject: "subject", Body: "body"}}, mailer.Messages())
+}
+
+func TestSMTPMailerRejectsHeaderInjection(t *testing.T) {
+	mailer := NewSMTPMailer("localhost", "25", "", "", "noreply@test.com")
+	err := mailer.Send(Message{To: "test@test.com\r\nBcc: victim@test.com", Subject: "subject", Body: "body"})
+	assert.NotNil(t, err)
+}
+
+func TestLogMailerRedactsTokens(t *testing.T) {
+	body := "Open the following link:\n\nhttp://localhost:8080/verify-email?token=secret-token\n\nhttp://localhost:8080/reset?lang=en&token=other%2Btoken&x=1\n"
+	redacted := redactTokens(body)
+	assert.NotContains(t, redacted, "secret-token")
+	assert.NotContains(t, redacted, "other%2Btoken")
+	assert.Contains(t, redacted, "/verify-email?token=[redacted]\n")
+	assert.Contains(t, redacted, "?lang=en&token=[redacted]&x=1")
+}
@@ -0,0 +1,207 @@
+package util
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+)
+
+// AuthorizationCodeTTL is how long a client has to redeem an authorization
+// code.
+const AuthorizationCodeTTL = time.Minute
+
+var ErrInvalidAuthorizationCode = errors.New("Invalid authorization code")
+
+// AuthorizationGrant is what a user approved at the authorization endpoint,
+// kept until the client redeems the code.
+type AuthorizationGrant struct {
+	ClientID      string `json:"client_id"`
+	Subject       string `json:"sub"`
+	RedirectURI   string `json:"redirect_uri"`
+	Scope         string `json:"scope"`
+	CodeChallenge string `json:"code_challenge,omitempty"`
+	// Nonce is passed on to the ID token of OpenID Connect requests.
+	Nonce string `json:"nonce,omitempty"`
+}
+
+// AuthorizationCodeStore keeps authorization codes in Redis by hash. Codes
+// are single-use.
+type AuthorizationCodeStore struct {
+	rdb *redis.Client
+}
+
+func NewAuthorizationCodeStore(rdb *redis.Client) *AuthorizationCodeStore {
+	return &AuthorizationCodeStore{rdb: rdb}
+}
+
+func (s *AuthorizationCodeStore) Issue(grant AuthorizationGrant) (string, error) {
+	code, err := RandomToken(32)
+	if err != nil {
+		return "", err
+	}
+	value, err := json.Marshal(grant)
+	if err != nil {
+		return "", err
+	}
+	if err := s.rdb.Set(ctx, authorizationCodeKey(code), value, AuthorizationCodeTTL).Err(); err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// Consume returns the grant of code and invalidates it, provided check
+// accepts the grant. Otherwise the error of check is returned and the code
+// stays valid, so that requests which may not redeem it cannot burn it.
+func (s *AuthorizationCodeStore) Consume(code string, check func(grant *AuthorizationGrant) error) (*AuthorizationGrant, error) {
+	key := authorizationCodeKey(code)
+	var grant AuthorizationGrant
+	err := s.rdb.Watch(ctx, func(tx *redis.Tx) error {
+		value, err := tx.Get(ctx, key).Bytes()
+		if err == redis.Nil {
+			return ErrInvalidAuthorizationCode
+		} else if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(value, &grant); err != nil {
+			return err
+		}
+		if err := check(&grant); err != nil {
+			return err
+		}
+		// Fails if the code has been redeemed since it was read.
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, key)
+			return nil
+		})
+		return err
+	}, key)
+	if errors.Is(err, redis.TxFailedErr) {
+		return nil, ErrInvalidAuthorizationCode
+	} else if err != nil {
+		return nil, err
+	}
+	return &grant, nil
+}
+
+func authorizationCodeKey(code string) string {
+	return "oauth_code:" + HashToken(code)
+}
+
+// VerifyPKCE checks a code verifier against an S256 code challenge
+// (RFC 7636).
+func VerifyPKCE(verifier string, challenge string) bool {
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+// ParseScope splits a space separated scope parameter.
+func ParseScope(scope string) []string {
+	return strings.Fields(scope)
+}
+
+// ScopeIncludes reports whether every scope in requested is in granted.
+func ScopeIncludes(granted string, requested string) bool {
+	grantedScopes := map[string]bool{}
+	for _, scope := range ParseScope(granted) {
+		grantedScopes[scope] = true
+	}
+	for _, scope := range ParseScope(requested) {
+		if !grantedScopes[scope] {
+			return false
+		}
+	}
+	return true
+}
+
+// OAuthClaims are the claims of access tokens issued to OAuth clients. Their
+// audience is the client, so they are not accepted as first-party access
+// tokens by this service.
+type OAuthClaims struct {
+	ClientID string `json:"client_id"`
+	Scope    string `json:"scope,omitempty"`
+	// IssuedAtNano is as in Claims.
+	IssuedAtNano int64 `json:"iat_ns,omitempty"`
+	jwt.StandardClaims
+}
+
+// GenerateOAuthToken issues an access token to clientID acting for subject,
+// which is the client itself for the client credentials grant.
+func GenerateOAuthToken(keys *KeySet, subject string, clientID string, scope string) (string, error) {
+	now := time.Now()
+	return keys.Sign(&OAuthClaims{
+		ClientID:     clientID,
+		Scope:        scope,
+		IssuedAtNano: now.UnixNano(),
+		StandardClaims: jwt.StandardClaims{
+			Id:        uuid.NewString(),
+			Subject:   subject,
+			Issuer:    keys.Issuer,
+			Audience:  clientID,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(keys.AccessTokenTTL).Unix(),
+		},
+	})
+}
+
+func ParseOAuthToken(keys *KeySet, tokenString string) (*OAuthClaims, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &OAuthClaims{}, keys.Keyfunc)
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(*OAuthClaims)
+	if !ok || !token.Valid || claims.ClientID == "" {
+		return nil, errors.New("Invalid token")
+	}
+	if !claims.VerifyIssuer(keys.Issuer, true) || !claims.VerifyAudience(claims.ClientID, true) {
+		return nil, errors.New("Invalid token")
+	}
+	return claims, nil
+}
+
+// UserInfo holds the standard claims about a user (OpenID Connect Core
+// section 5.1). Claims outside the granted scope are left empty.
+type UserInfo struct {
+	Subject       string `json:"sub"`
+	Name          string `json:"name,omitempty"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified *bool  `json:"email_verified,omitempty"`
+}
+
+// IDTokenClaims are the claims of an OpenID Connect ID token.
+type IDTokenClaims struct {
+	Nonce         string `json:"nonce,omitempty"`
+	Name          string `json:"name,omitempty"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified *bool  `json:"email_verified,omitempty"`
+	jwt.StandardClaims
+}
+
+// GenerateIDToken issues an ID token telling clientID who the user is.
+// issuer is the URL OpenID Connect clients discover this service at, and
+// nonce is echoed from the authorization request.
+func GenerateIDToken(keys *KeySet, issuer string, clientID string, info UserInfo, nonce string) (string, error) {
+	now := time.Now()
+	return keys.Sign(&IDTokenClaims{
+		Nonce:         nonce,
+		Name:          info.Name,
+		Email:         info.Email,
+		EmailVerified: info.EmailVerified,
+		StandardClaims: jwt.StandardClaims{
+			Subject:   info.Subject,
+			Issuer:    issuer,
+			Audience:  clientID,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(keys.AccessTokenTTL).Unix(),
+		},
+	})
+}
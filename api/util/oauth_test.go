@@ -0,0 +1,91 @@
+package util
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthorizationCodeStore(t *testing.T) {
+	store := NewAuthorizationCodeStore(setupTestRedis(t))
+
+	grant := AuthorizationGrant{ClientID: "client", Subject: "user", RedirectURI: "https://app/callback", Scope: "profile"}
+	code, err := store.Issue(grant)
+	assert.Nil(t, err)
+
+	accept := func(*AuthorizationGrant) error { return nil }
+
+	// Codes the check rejects stay valid
+	errMismatch := errors.New("mismatch")
+	_, err = store.Consume(code, func(consumed *AuthorizationGrant) error {
+		assert.Equal(t, grant, *consumed)
+		return errMismatch
+	})
+	assert.ErrorIs(t, err, errMismatch)
+
+	consumed, err := store.Consume(code, accept)
+	assert.Nil(t, err)
+	assert.Equal(t, grant, *consumed)
+
+	// Codes are single-use
+	_, err = store.Consume(code, accept)
+	assert.ErrorIs(t, err, ErrInvalidAuthorizationCode)
+}
+
+// Example from RFC 7636 appendix B.
+func TestVerifyPKCE(t *testing.T) {
+	assert.True(t, VerifyPKCE("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk", "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"))
+	assert.False(t, VerifyPKCE("other", "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"))
+}
+
+func TestScopeIncludes(t *testing.T) {
+	assert.True(t, ScopeIncludes("openid profile email", "profile openid"))
+	assert.True(t, ScopeIncludes("openid", ""))
+	assert.False(t, ScopeIncludes("openid", "openid email"))
+}
+
+func TestOAuthToken(t *testing.T) {
+	keys := newTestKeySet()
+
+	tokenString, err := GenerateOAuthToken(keys, "user", "client", "profile")
+	assert.Nil(t, err)
+
+	claims, err := ParseOAuthToken(keys, tokenString)
+	assert.Nil(t, err)
+	assert.Equal(t, "client", claims.ClientID)
+	assert.Equal(t, "profile", claims.Scope)
+
+	// OAuth tokens and first-party tokens are not interchangeable
+	_, err = ParseToken(keys, tokenString)
+	assert.NotNil(t, err)
+	firstParty, _ := GenerateToken(keys, uuid.NewString(), nil)
+	_, err = ParseOAuthToken(keys, firstParty)
+	assert.NotNil(t, err)
+}
+
+func TestIDToken(t *testing.T) {
+	keys := newTestKeySet()
+	verified := true
+	info := UserInfo{Subject: "user", Email: "test@test.com", EmailVerified: &verified}
+
+	tokenString, err := GenerateIDToken(keys, "https://issuer", "client", info, "nonce")
+	assert.Nil(t, err)
+
+	claims := &IDTokenClaims{}
+	_, err = jwt.ParseWithClaims(tokenString, claims, keys.Keyfunc)
+	assert.Nil(t, err)
+	assert.Equal(t, "https://issuer", claims.Issuer)
+	assert.Equal(t, "client", claims.Audience)
+	assert.Equal(t, "nonce", claims.Nonce)
+	assert.Equal(t, "test@test.com", claims.Email)
+	assert.True(t, *claims.EmailVerified)
+
+	// ID tokens are not access tokens
+	_, err = ParseToken(keys, tokenString)
+	assert.NotNil(t, err)
+	_, err = ParseOAuthToken(keys, tokenString)
+	assert.NotNil(t, err)
+}
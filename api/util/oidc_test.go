@@ -0,0 +1,137 @@
+package util
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// mockOIDCProvider is a local identity provider that authorizes every
+// request for a fixed identity.
+type mockOIDCProvider struct {
+	*httptest.Server
+	keys     *KeySet
+	identity OIDCIdentity
+
+	mu sync.Mutex
+	// codes maps issued authorization codes to their PKCE challenge and
+	// nonce.
+	codes map[string]url.Values
+}
+
+func newMockOIDCProvider(t *testing.T, identity OIDCIdentity) *mockOIDCProvider {
+	s, err := GenerateSigner(AlgRS256)
+	assert.Nil(t, err)
+	p := &mockOIDCProvider{
+		keys:     NewKeySet(s, DefaultKeyGracePeriod),
+		identity: identity,
+		codes:    map[string]url.Values{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                p.URL,
+			"authorization_endpoint":                p.URL + "/authorize",
+			"token_endpoint":                        p.URL + "/token",
+			"jwks_uri":                              p.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{AlgRS256},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(p.keys.JWKS())
+	})
+	mux.HandleFunc("/token", p.token)
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+// authorize stands in for the user logging in at the provider and returns
+// the code the provider redirects back with.
+func (p *mockOIDCProvider) authorize(t *testing.T, authCodeURL string) string {
+	u, err := url.Parse(authCodeURL)
+	assert.Nil(t, err)
+	code, _ := RandomToken(16)
+	p.mu.Lock()
+	p.codes[code] = u.Query()
+	p.mu.Unlock()
+	return code
+}
+
+func (p *mockOIDCProvider) token(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	request, ok := p.codes[r.FormValue("code")]
+	delete(p.codes, r.FormValue("code"))
+	p.mu.Unlock()
+
+	verifier := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(verifier[:]) != request.Get("code_challenge") {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	// The provider issues ID tokens the way this service does as a provider,
+	// so go-oidc verifying them covers GenerateIDToken as well.
+	info := UserInfo{Subject: p.identity.Subject, Name: p.identity.Name, Email: p.identity.Email, EmailVerified: &p.identity.EmailVerified}
+	idToken, _ := GenerateIDToken(p.keys, p.URL, request.Get("client_id"), info, request.Get("nonce"))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+func TestOIDCProviderLogin(t *testing.T) {
+	identity := OIDCIdentity{Subject: "subject", Email: "test@test.com", EmailVerified: true, Name: "test"}
+	mock := newMockOIDCProvider(t, identity)
+	ctx := context.Background()
+
+	provider, err := NewOIDCProvider(ctx, "mock", mock.URL, "client", "secret", "http://localhost:8080/auth/mock/callback")
+	assert.Nil(t, err)
+
+	login, err := NewOIDCLoginState()
+	assert.Nil(t, err)
+	authCodeURL, _ := url.Parse(provider.AuthCodeURL(login))
+	assert.Equal(t, login.State, authCodeURL.Query().Get("state"))
+	assert.Equal(t, login.Nonce, authCodeURL.Query().Get("nonce"))
+	assert.Equal(t, "S256", authCodeURL.Query().Get("code_challenge_method"))
+
+	code := mock.authorize(t, authCodeURL.String())
+	got, err := provider.Exchange(ctx, code, login)
+	assert.Nil(t, err)
+	assert.Equal(t, identity, *got)
+
+	// Codes are single-use
+	_, err = provider.Exchange(ctx, code, login)
+	assert.ErrorIs(t, err, ErrInvalidOIDCResponse)
+}
+
+func TestOIDCProviderRejectsWrongVerifierAndNonce(t *testing.T) {
+	mock := newMockOIDCProvider(t, OIDCIdentity{Subject: "subject"})
+	ctx := context.Background()
+	provider, _ := NewOIDCProvider(ctx, "mock", mock.URL, "client", "secret", "http://localhost:8080/auth/mock/callback")
+
+	// A code intercepted by someone without the PKCE verifier is useless
+	login, _ := NewOIDCLoginState()
+	code := mock.authorize(t, provider.AuthCodeURL(login))
+	other, _ := NewOIDCLoginState()
+	_, err := provider.Exchange(ctx, code, other)
+	assert.ErrorIs(t, err, ErrInvalidOIDCResponse)
+
+	// An ID token issued for another login attempt is refused
+	code = mock.authorize(t, provider.AuthCodeURL(login))
+	_, err = provider.Exchange(ctx, code, &OIDCLoginState{State: login.State, Nonce: "other", Verifier: login.Verifier})
+	assert.ErrorIs(t, err, ErrInvalidOIDCResponse)
+}
@@ -9,7 +9,7 @@ import (
 
 func TestHashPassword(t *testing.T) {
 	password := "password"
-	hashedPassword, err := HashPassword(password)
+	hashedPassword, err := HashPassword(password, bcrypt.MinCost)
 	assert.Nil(t, err)
 	assert.NotEmpty(t, hashedPassword)
 }
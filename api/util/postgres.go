@@ -1,23 +1,27 @@
 package util
 
 import (
-	"os"
+	"context"
+	"time"
 
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 )
 
-func DBConnect() *gorm.DB {
-	connStr := "postgres://" + os.Getenv("DB_USER") + ":" + os.Getenv("DB_PASSWORD") + "@" +
-		os.Getenv("DB_HOST") + ":" + os.Getenv("DB_PORT") + "/" + os.Getenv("DB_NAME") + "?sslmode=disable"
-	db, err := gorm.Open(postgres.Open(connStr), &gorm.Config{
-		Logger: logger.Default.LogMode(logger.Info),
+// DBConnect opens the database at dsn, retrying with back-off until it can be
+// reached or ctx is done.
+func DBConnect(ctx context.Context, dsn string) (*gorm.DB, error) {
+	var db *gorm.DB
+	err := Retry(ctx, "postgres", 500*time.Millisecond, 10*time.Second, func(ctx context.Context) error {
+		var err error
+		db, err = gorm.Open(postgres.Open(dsn), &gorm.Config{
+			Logger: logger.Default.LogMode(logger.Info),
+		})
+		return err
 	})
-
 	if err != nil {
-		panic("Failed to connect to database")
+		return nil, err
 	}
-
-	return db
+	return db, nil
 }
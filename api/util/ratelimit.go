@@ -1,45 +1,198 @@
 package util
 
 import (
-	"net/http"
+	"log"
+	"math"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
 )
 
+// SubjectContextKey is where AuthenticateMiddleware stores the token subject
+// so that KeyByUser can find it without depending on the middleware package.
+const SubjectContextKey = "subject"
+
+// RateLimitResult is the state of a key's budget after a request.
+type RateLimitResult struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	RetryAfter time.Duration
+	ResetAfter time.Duration
+}
+
+// RateLimitStore implements the generic cell rate algorithm (GCRA): limit
+// requests are allowed per window, replenished evenly across it.
+type RateLimitStore interface {
+	Allow(key string, limit int, window time.Duration) (RateLimitResult, error)
+}
+
+// gcra computes the decision for a request at now given the stored
+// theoretical arrival time. It returns the new arrival time to store, which
+// is zero when the request is denied.
+func gcra(now, tat time.Time, limit int, window time.Duration) (RateLimitResult, time.Time) {
+	emission := window / time.Duration(limit)
+	if tat.Before(now) {
+		tat = now
+	}
+	newTAT := tat.Add(emission)
+	allowAt := newTAT.Add(-window)
+
+	if now.Before(allowAt) {
+		return RateLimitResult{
+			Limit:      limit,
+			RetryAfter: allowAt.Sub(now),
+			ResetAfter: tat.Sub(now),
+		}, time.Time{}
+	}
+	return RateLimitResult{
+		Allowed:    true,
+		Limit:      limit,
+		Remaining:  int(now.Sub(allowAt) / emission),
+		ResetAfter: newTAT.Sub(now),
+	}, newTAT
+}
+
+// MemoryRateLimitStore keeps budgets in process memory. Limits are not
+// shared between replicas and keys are never forgotten, so it is meant for
+// tests.
+type MemoryRateLimitStore struct {
+	mu   sync.Mutex
+	tats map[string]time.Time
+	now  func() time.Time
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{
+		tats: map[string]time.Time{},
+		now:  time.Now,
+	}
+}
+
+func (s *MemoryRateLimitStore) Allow(key string, limit int, window time.Duration) (RateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	result, tat := gcra(now, s.tats[key], limit, window)
+	if result.Allowed {
+		s.tats[key] = tat
+	}
+	return result, nil
+}
+
+// The same algorithm as gcra, evaluated atomically inside Redis using the
+// server clock so that all replicas agree on time. Times are in microseconds.
+var gcraScript = redis.NewScript(`
+local emission = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local tat = tonumber(redis.call("GET", KEYS[1]) or now)
+if tat < now then
+	tat = now
+end
+local new_tat = tat + emission
+local allow_at = new_tat - window
+if now < allow_at then
+	return {0, 0, allow_at - now, tat - now}
+end
+redis.call("SET", KEYS[1], new_tat, "PX", math.ceil((new_tat - now) / 1000))
+return {1, math.floor((now - allow_at) / emission), 0, new_tat - now}
+`)
+
+// RedisRateLimitStore shares budgets between all replicas using Redis.
+type RedisRateLimitStore struct {
+	rdb *redis.Client
+}
+
+func NewRedisRateLimitStore(rdb *redis.Client) *RedisRateLimitStore {
+	return &RedisRateLimitStore{rdb}
+}
+
+func (s *RedisRateLimitStore) Allow(key string, limit int, window time.Duration) (RateLimitResult, error) {
+	emission := window.Microseconds() / int64(limit)
+	values, err := gcraScript.Run(ctx, s.rdb, []string{"ratelimit:" + key}, emission, window.Microseconds()).Int64Slice()
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	return RateLimitResult{
+		Allowed:    values[0] == 1,
+		Limit:      limit,
+		Remaining:  int(values[1]),
+		RetryAfter: time.Duration(values[2]) * time.Microsecond,
+		ResetAfter: time.Duration(values[3]) * time.Microsecond,
+	}, nil
+}
+
+// RateLimitKeyFunc selects the budget a request is counted against.
+type RateLimitKeyFunc func(c *gin.Context) string
+
+func KeyByIP(c *gin.Context) string {
+	return "ip:" + c.ClientIP()
+}
+
+// KeyByUser counts authenticated requests per user and falls back to the
+// client IP for anonymous ones.
+func KeyByUser(c *gin.Context) string {
+	if subject := c.GetString(SubjectContextKey); subject != "" {
+		return "user:" + subject
+	}
+	return KeyByIP(c)
+}
+
+// KeyByRoute shares one budget between all clients of a route.
+func KeyByRoute(c *gin.Context) string {
+	return "route:" + c.Request.Method + " " + c.FullPath()
+}
+
 type RateLimiter struct {
-	tokens          int
-	lastRefreshTime time.Time
-	mu              sync.Mutex
+	store  RateLimitStore
+	limit  int
+	window time.Duration
+	key    RateLimitKeyFunc
+	// exceeded is recorded with c.Error for requests over the limit, for
+	// the error middleware to render.
+	exceeded error
 }
 
-func NewRateLimiter(tokensPerMinute int) *RateLimiter {
+func NewRateLimiter(store RateLimitStore, limit int, window time.Duration, key RateLimitKeyFunc, exceeded error) *RateLimiter {
 	return &RateLimiter{
-		tokens:          tokensPerMinute,
-		lastRefreshTime: time.Now(),
+		store:    store,
+		limit:    limit,
+		window:   window,
+		key:      key,
+		exceeded: exceeded,
 	}
 }
 
 func (r *RateLimiter) MiddleWare() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		r.mu.Lock()
-		defer r.mu.Unlock()
-
-		now := time.Now()
-		elapsed := now.Sub(r.lastRefreshTime)
-		if elapsed > time.Minute {
-			r.tokens = 1
-			r.lastRefreshTime = now
+		result, err := r.store.Allow(r.key(c), r.limit, r.window)
+		if err != nil {
+			// An unavailable store should not take the whole API down with it.
+			log.Printf("rate limit store unavailable, allowing request: %v", err)
+			c.Next()
+			return
 		}
 
-		if r.tokens > 0 {
-			r.tokens--
-			c.Next()
-		} else {
-			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
-				"error": "too many requests",
-			})
+		c.Header("X-RateLimit-Limit", strconv.Itoa(result.Limit))
+		c.Header("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		c.Header("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(result.ResetAfter)))
+
+		if !result.Allowed {
+			c.Header("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+			c.Abort()
+			c.Error(r.exceeded)
+			return
 		}
+		c.Next()
 	}
 }
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
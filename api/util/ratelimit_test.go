@@ -1,6 +1,7 @@
 package util
 
 import (
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -13,7 +14,19 @@ import (
 func TestRateLimiterMiddleware(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 	r := gin.Default()
-	limiter := NewRateLimiter(1) // 1 request per minute
+	store := NewMemoryRateLimitStore()
+	now := time.Now()
+	store.now = func() time.Time { return now }
+	errExceeded := errors.New("too many requests")
+	// Renders the recorded error as the error middleware would
+	r.Use(func(c *gin.Context) {
+		c.Next()
+		if err := c.Errors.Last(); err != nil {
+			assert.Equal(t, errExceeded, err.Err)
+			c.Status(http.StatusTooManyRequests)
+		}
+	})
+	limiter := NewRateLimiter(store, 1, time.Minute, KeyByIP, errExceeded) // 1 request per minute
 	r.Use(limiter.MiddleWare())
 	r.GET("/test", func(c *gin.Context) {
 		c.String(http.StatusOK, "success")
@@ -24,17 +37,83 @@ func TestRateLimiterMiddleware(t *testing.T) {
 	resp := httptest.NewRecorder()
 	r.ServeHTTP(resp, req)
 	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "1", resp.Header().Get("X-RateLimit-Limit"))
+	assert.Equal(t, "0", resp.Header().Get("X-RateLimit-Remaining"))
 
 	// Second request within a minute should be blocked
 	req = httptest.NewRequest(http.MethodGet, "/test", nil)
 	resp = httptest.NewRecorder()
 	r.ServeHTTP(resp, req)
 	assert.Equal(t, http.StatusTooManyRequests, resp.Code)
+	assert.Equal(t, "60", resp.Header().Get("Retry-After"))
+
+	// Other clients have their own budget
+	req = httptest.NewRequest(http.MethodGet, "/test", nil)
+	req.RemoteAddr = "198.51.100.7:1234"
+	resp = httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
 
 	// After waiting for more than a minute, the next request should pass
-	limiter.lastRefreshTime = limiter.lastRefreshTime.Add(-time.Minute)
+	now = now.Add(time.Minute)
 	req = httptest.NewRequest(http.MethodGet, "/test", nil)
 	resp = httptest.NewRecorder()
 	r.ServeHTTP(resp, req)
 	assert.Equal(t, http.StatusOK, resp.Code)
 }
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	now := time.Now()
+	store.now = func() time.Time { return now }
+
+	// The full budget is available as a burst
+	for i := 4; i >= 0; i-- {
+		result, _ := store.Allow("key", 5, time.Minute)
+		assert.True(t, result.Allowed)
+		assert.Equal(t, i, result.Remaining)
+	}
+	result, _ := store.Allow("key", 5, time.Minute)
+	assert.False(t, result.Allowed)
+	assert.Equal(t, 12*time.Second, result.RetryAfter)
+
+	// and replenishes evenly
+	now = now.Add(12 * time.Second)
+	result, _ = store.Allow("key", 5, time.Minute)
+	assert.True(t, result.Allowed)
+	assert.Equal(t, 0, result.Remaining)
+}
+
+func TestRedisRateLimitStore(t *testing.T) {
+	store := NewRedisRateLimitStore(setupTestRedis(t))
+
+	for i := 2; i >= 0; i-- {
+		result, err := store.Allow("key", 3, time.Hour)
+		assert.Nil(t, err)
+		assert.True(t, result.Allowed)
+		assert.Equal(t, i, result.Remaining)
+	}
+	result, err := store.Allow("key", 3, time.Hour)
+	assert.Nil(t, err)
+	assert.False(t, result.Allowed)
+	assert.InDelta(t, 20*time.Minute, result.RetryAfter, float64(time.Second))
+
+	result, err = store.Allow("other", 3, time.Hour)
+	assert.Nil(t, err)
+	assert.True(t, result.Allowed)
+}
+
+func TestRateLimitKeys(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/users/:id", func(c *gin.Context) {
+		assert.Equal(t, "ip:192.0.2.1", KeyByUser(c))
+		c.Set(SubjectContextKey, "user-id")
+		assert.Equal(t, "user:user-id", KeyByUser(c))
+		assert.Equal(t, "route:GET /users/:id", KeyByRoute(c))
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/users/1", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	r.ServeHTTP(httptest.NewRecorder(), req)
+}
@@ -2,23 +2,27 @@ package util
 
 import (
 	"context"
-	"fmt"
-	"os"
+	"time"
 
 	"github.com/go-redis/redis/v8"
 )
 
 var ctx = context.Background()
 
-func RedisClient() *redis.Client {
+// RedisClient connects to Redis, retrying with back-off until it answers or
+// connectCtx is done.
+func RedisClient(connectCtx context.Context, addr string, password string, db int) (*redis.Client, error) {
 	rdb := redis.NewClient(&redis.Options{
-		Addr:     os.Getenv("REDIS_HOST") + ":" + os.Getenv("REDIS_PORT"),
-		Password: os.Getenv("REDIS_PASSWORD"),
-		DB:       0,
+		Addr:     addr,
+		Password: password,
+		DB:       db,
+	})
+	err := Retry(connectCtx, "redis", 500*time.Millisecond, 10*time.Second, func(ctx context.Context) error {
+		return rdb.Ping(ctx).Err()
 	})
-	_, err := rdb.Ping(rdb.Context()).Result()
 	if err != nil {
-		panic(fmt.Sprintf("Failed to connect to redis: %v", err))
+		rdb.Close()
+		return nil, err
 	}
-	return rdb
+	return rdb, nil
 }
@@ -0,0 +1,236 @@
+package util
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Token lifetimes used unless configured otherwise.
+const (
+	DefaultAccessTokenTTL  = 15 * time.Minute
+	DefaultRefreshTokenTTL = 30 * 24 * time.Hour
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("Invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("Refresh token has already been used")
+)
+
+// RefreshTokenStore keeps opaque refresh tokens in Redis. Every token belongs
+// to a family that starts at login; rotating a token marks it as used and
+// issues the next token of the same family. Presenting a used token again
+// revokes the whole family.
+type RefreshTokenStore struct {
+	rdb *redis.Client
+	ttl time.Duration
+}
+
+// RefreshTokenGrant is what a refresh token stands for. Tokens issued to
+// OAuth clients carry the client and the scope it was granted; first-party
+// tokens leave both empty and may belong to a login session instead.
+type RefreshTokenGrant struct {
+	Subject   string `json:"sub"`
+	ClientID  string `json:"client_id,omitempty"`
+	Scope     string `json:"scope,omitempty"`
+	SessionID string `json:"sid,omitempty"`
+}
+
+type refreshTokenRecord struct {
+	RefreshTokenGrant
+	Family string `json:"family"`
+	// Created is when the family started, in Unix nanoseconds.
+	Created int64 `json:"created"`
+}
+
+func NewRefreshTokenStore(rdb *redis.Client, ttl time.Duration) *RefreshTokenStore {
+	return &RefreshTokenStore{
+		rdb: rdb,
+		ttl: ttl,
+	}
+}
+
+// IssueGrant starts a new token family for grant and returns its first token.
+// The family of a login session is the session, so that revoking either
+// revokes both.
+func (s *RefreshTokenStore) IssueGrant(grant RefreshTokenGrant) (string, error) {
+	family := grant.SessionID
+	if family == "" {
+		var err error
+		family, err = RandomToken(16)
+		if err != nil {
+			return "", err
+		}
+	}
+	return s.issue(refreshTokenRecord{RefreshTokenGrant: grant, Family: family, Created: time.Now().UnixNano()})
+}
+
+// RotateForClient consumes a token issued to clientID and returns its grant
+// together with the next token of the same family. Tokens of other clients
+// are rejected without being consumed.
+//
+// If check is not nil, it is called with the grant of a token that has not
+// been used yet, and an error from it is returned without consuming the
+// token. A used token revokes its family before check is called, and its
+// grant is returned with ErrRefreshTokenReused so that callers can revoke
+// what else was issued with it.
+func (s *RefreshTokenStore) RotateForClient(token string, clientID string, check func(grant *RefreshTokenGrant) error) (*RefreshTokenGrant, string, error) {
+	record, err := s.lookup(token)
+	if err != nil {
+		return nil, "", err
+	}
+	if record.ClientID != clientID {
+		return nil, "", ErrInvalidRefreshToken
+	}
+
+	used, err := s.rdb.Exists(ctx, refreshTokenUsedKey(token)).Result()
+	if err != nil {
+		return nil, "", err
+	}
+	if used == 0 && check != nil {
+		if err := check(&record.RefreshTokenGrant); err != nil {
+			return nil, "", err
+		}
+	}
+
+	// Of concurrent requests with the same token only one gets to use it.
+	first := used == 0
+	if first {
+		first, err = s.rdb.SetNX(ctx, refreshTokenUsedKey(token), true, s.ttl).Result()
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	if !first {
+		if err := s.RevokeFamily(record.Family); err != nil {
+			return nil, "", err
+		}
+		return &record.RefreshTokenGrant, "", ErrRefreshTokenReused
+	}
+
+	newToken, err := s.issue(*record)
+	if err != nil {
+		return nil, "", err
+	}
+	return &record.RefreshTokenGrant, newToken, nil
+}
+
+// Lookup returns the grant of a token that can still be used.
+func (s *RefreshTokenStore) Lookup(token string) (*RefreshTokenGrant, error) {
+	record, err := s.lookup(token)
+	if err != nil {
+		return nil, err
+	}
+	used, err := s.rdb.Exists(ctx, refreshTokenUsedKey(token)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if used > 0 {
+		return nil, ErrInvalidRefreshToken
+	}
+	return &record.RefreshTokenGrant, nil
+}
+
+// Revoke invalidates the family token belongs to. Unknown tokens are ignored.
+func (s *RefreshTokenStore) Revoke(token string) error {
+	record, err := s.lookup(token)
+	if errors.Is(err, ErrInvalidRefreshToken) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return s.RevokeFamily(record.Family)
+}
+
+func (s *RefreshTokenStore) RevokeFamily(family string) error {
+	return s.rdb.Set(ctx, refreshFamilyRevokedKey(family), true, s.ttl).Err()
+}
+
+// RevokeSubject invalidates every family of subject started until now.
+func (s *RefreshTokenStore) RevokeSubject(subject string) error {
+	return s.rdb.Set(ctx, refreshSubjectRevokedKey(subject), time.Now().UnixNano(), s.ttl).Err()
+}
+
+func (s *RefreshTokenStore) issue(record refreshTokenRecord) (string, error) {
+	token, err := RandomToken(32)
+	if err != nil {
+		return "", err
+	}
+	value, err := json.Marshal(record)
+	if err != nil {
+		return "", err
+	}
+	if err := s.rdb.Set(ctx, refreshTokenKey(token), value, s.ttl).Err(); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (s *RefreshTokenStore) lookup(token string) (*refreshTokenRecord, error) {
+	value, err := s.rdb.Get(ctx, refreshTokenKey(token)).Bytes()
+	if err == redis.Nil {
+		return nil, ErrInvalidRefreshToken
+	} else if err != nil {
+		return nil, err
+	}
+
+	var record refreshTokenRecord
+	if err := json.Unmarshal(value, &record); err != nil {
+		return nil, err
+	}
+
+	revoked, err := s.rdb.Exists(ctx, refreshFamilyRevokedKey(record.Family)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if revoked > 0 {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	revokedBefore, err := s.rdb.Get(ctx, refreshSubjectRevokedKey(record.Subject)).Int64()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	if record.Created < revokedBefore {
+		return nil, ErrInvalidRefreshToken
+	}
+	return &record, nil
+}
+
+// HashToken returns the SHA-256 hex digest of an opaque token. Tokens are
+// stored by hash so that a leaked dump cannot be replayed.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func refreshTokenKey(token string) string {
+	return "refresh_token:" + HashToken(token)
+}
+
+func refreshTokenUsedKey(token string) string {
+	return "refresh_token_used:" + HashToken(token)
+}
+
+func refreshFamilyRevokedKey(family string) string {
+	return "refresh_family_revoked:" + family
+}
+
+func refreshSubjectRevokedKey(subject string) string {
+	return "refresh_subject_revoked:" + subject
+}
+
+// RandomToken returns n random bytes encoded for use in URLs.
+func RandomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,152 @@
+package util
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupTestRedis(t *testing.T) *redis.Client {
+	mr := miniredis.RunT(t)
+	return redis.NewClient(&redis.Options{Addr: mr.Addr()})
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	store := NewRefreshTokenStore(setupTestRedis(t), DefaultRefreshTokenTTL)
+
+	token, err := store.IssueGrant(RefreshTokenGrant{Subject: "user"})
+	assert.Nil(t, err)
+	assert.NotEmpty(t, token)
+
+	grant, rotated, err := store.RotateForClient(token, "", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "user", grant.Subject)
+	assert.NotEqual(t, token, rotated)
+
+	// The rotated token is usable exactly once as well
+	grant, next, err := store.RotateForClient(rotated, "", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "user", grant.Subject)
+	assert.NotEmpty(t, next)
+
+	_, _, err = store.RotateForClient("unknown", "", nil)
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+}
+
+func TestRefreshTokenReuseRevokesFamily(t *testing.T) {
+	store := NewRefreshTokenStore(setupTestRedis(t), DefaultRefreshTokenTTL)
+
+	token, _ := store.IssueGrant(RefreshTokenGrant{Subject: "user"})
+	_, rotated, err := store.RotateForClient(token, "", nil)
+	assert.Nil(t, err)
+
+	// Replaying the consumed token is detected, telling whose it was
+	grant, _, err := store.RotateForClient(token, "", nil)
+	assert.ErrorIs(t, err, ErrRefreshTokenReused)
+	assert.Equal(t, "user", grant.Subject)
+
+	// and takes the legitimate successor down with it
+	_, _, err = store.RotateForClient(rotated, "", nil)
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+
+	// Other families are unaffected
+	other, _ := store.IssueGrant(RefreshTokenGrant{Subject: "user"})
+	_, _, err = store.RotateForClient(other, "", nil)
+	assert.Nil(t, err)
+}
+
+func TestRefreshTokenRevoke(t *testing.T) {
+	store := NewRefreshTokenStore(setupTestRedis(t), DefaultRefreshTokenTTL)
+
+	token, _ := store.IssueGrant(RefreshTokenGrant{Subject: "user"})
+	assert.Nil(t, store.Revoke(token))
+
+	_, _, err := store.RotateForClient(token, "", nil)
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+
+	assert.Nil(t, store.Revoke("unknown"))
+}
+
+func TestRefreshTokenRevokeSubject(t *testing.T) {
+	store := NewRefreshTokenStore(setupTestRedis(t), DefaultRefreshTokenTTL)
+
+	first, _ := store.IssueGrant(RefreshTokenGrant{Subject: "user"})
+	second, _ := store.IssueGrant(RefreshTokenGrant{Subject: "user"})
+	other, _ := store.IssueGrant(RefreshTokenGrant{Subject: "other"})
+
+	assert.Nil(t, store.RevokeSubject("user"))
+
+	_, _, err := store.RotateForClient(first, "", nil)
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+	_, _, err = store.RotateForClient(second, "", nil)
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+	_, _, err = store.RotateForClient(other, "", nil)
+	assert.Nil(t, err)
+
+	// Logging in again afterwards works
+	fresh, _ := store.IssueGrant(RefreshTokenGrant{Subject: "user"})
+	_, _, err = store.RotateForClient(fresh, "", nil)
+	assert.Nil(t, err)
+}
+
+func TestRefreshTokenClientGrant(t *testing.T) {
+	store := NewRefreshTokenStore(setupTestRedis(t), DefaultRefreshTokenTTL)
+
+	token, err := store.IssueGrant(RefreshTokenGrant{Subject: "user", ClientID: "client", Scope: "profile"})
+	assert.Nil(t, err)
+
+	grant, err := store.Lookup(token)
+	assert.Nil(t, err)
+	assert.Equal(t, "client", grant.ClientID)
+
+	// Client tokens are neither first-party tokens nor usable by other
+	// clients, and such attempts leave them intact
+	_, _, err = store.RotateForClient(token, "", nil)
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+	_, _, err = store.RotateForClient(token, "other", nil)
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+
+	// A failed check leaves the token intact as well
+	errDenied := errors.New("denied")
+	_, _, err = store.RotateForClient(token, "client", func(grant *RefreshTokenGrant) error {
+		assert.Equal(t, "profile", grant.Scope)
+		return errDenied
+	})
+	assert.ErrorIs(t, err, errDenied)
+
+	grant, rotated, err := store.RotateForClient(token, "client", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, RefreshTokenGrant{Subject: "user", ClientID: "client", Scope: "profile"}, *grant)
+
+	// Used tokens are no longer active
+	_, err = store.Lookup(token)
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+	_, err = store.Lookup(rotated)
+	assert.Nil(t, err)
+
+	// Replays revoke the family before the check could reject them
+	_, _, err = store.RotateForClient(token, "client", func(*RefreshTokenGrant) error {
+		return errDenied
+	})
+	assert.ErrorIs(t, err, ErrRefreshTokenReused)
+	_, err = store.Lookup(rotated)
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+}
+
+func TestRefreshTokenSessionFamily(t *testing.T) {
+	store := NewRefreshTokenStore(setupTestRedis(t), DefaultRefreshTokenTTL)
+
+	token, err := store.IssueGrant(RefreshTokenGrant{Subject: "user", SessionID: "session"})
+	assert.Nil(t, err)
+	grant, rotated, err := store.RotateForClient(token, "", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "session", grant.SessionID)
+
+	// Ending the session revokes its tokens
+	assert.Nil(t, store.RevokeFamily("session"))
+	_, _, err = store.RotateForClient(rotated, "", nil)
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+}
@@ -0,0 +1,32 @@
+package util
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Retry calls fn until it succeeds or ctx is done, waiting initial between
+// the first attempts and doubling the wait up to max. It returns the last
+// error of fn if ctx ends first.
+func Retry(ctx context.Context, name string, initial time.Duration, max time.Duration, fn func(ctx context.Context) error) error {
+	wait := initial
+	for {
+		err := fn(ctx)
+		if err == nil {
+			return nil
+		}
+		log.Printf("%s not ready, retrying in %s: %v", name, wait, err)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		if wait *= 2; wait > max {
+			wait = max
+		}
+	}
+}
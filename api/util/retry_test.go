@@ -0,0 +1,30 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetry(t *testing.T) {
+	attempts := 0
+	err := Retry(context.Background(), "test", time.Millisecond, 4*time.Millisecond, func(ctx context.Context) error {
+		if attempts++; attempts < 4 {
+			return errors.New("not yet")
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 4, attempts)
+
+	// The last error is returned once the context ends
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err = Retry(ctx, "test", time.Millisecond, 4*time.Millisecond, func(ctx context.Context) error {
+		return errors.New("unavailable")
+	})
+	assert.EqualError(t, err, "unavailable")
+}
@@ -0,0 +1,106 @@
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const EmailVerificationTTL = 24 * time.Hour
+
+var ErrInvalidVerificationToken = errors.New("Invalid or expired verification token")
+
+// EmailVerifier sends verification links and redeems them. Each link works
+// once and only for the address it was sent to, and a new link replaces the
+// user's previous one.
+//
+// Links carry a random token whose hash is kept in Redis, rather than a
+// signed token, so that they outlive key rotation.
+type EmailVerifier struct {
+	rdb     *redis.Client
+	mailer  Mailer
+	baseURL string
+}
+
+// emailVerification is what a verification token stands for.
+type emailVerification struct {
+	UserID string `json:"user_id"`
+	Email  string `json:"email"`
+}
+
+func NewEmailVerifier(rdb *redis.Client, mailer Mailer, baseURL string) *EmailVerifier {
+	return &EmailVerifier{
+		rdb:     rdb,
+		mailer:  mailer,
+		baseURL: baseURL,
+	}
+}
+
+func verificationKey(tokenHash string) string {
+	return "email_verification:" + tokenHash
+}
+
+func verificationUserKey(userID string) string {
+	return "email_verification_user:" + userID
+}
+
+// sendVerificationScript replaces the user's previous token, if any, with
+// a new one. It runs atomically, so that of concurrent sends only the last
+// token stays valid and every valid token has its reverse mapping.
+var sendVerificationScript = redis.NewScript(`
+local previous = redis.call("GET", KEYS[1])
+if previous then
+	redis.call("DEL", ARGV[4] .. previous)
+end
+redis.call("SET", KEYS[2], ARGV[2], "PX", ARGV[3])
+redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[3])
+return 1
+`)
+
+func (v *EmailVerifier) SendVerification(userID string, email string) error {
+	token, err := RandomToken(32)
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(emailVerification{UserID: userID, Email: email})
+	if err != nil {
+		return err
+	}
+
+	tokenHash := HashToken(token)
+	err = sendVerificationScript.Run(ctx, v.rdb,
+		[]string{verificationUserKey(userID), verificationKey(tokenHash)},
+		tokenHash, value, EmailVerificationTTL.Milliseconds(), verificationKey("")).Err()
+	if err != nil {
+		return err
+	}
+
+	link := v.baseURL + "/verify-email?token=" + url.QueryEscape(token)
+	return v.mailer.Send(Message{
+		To:      email,
+		Subject: "Verify your email address",
+		Body:    "Open the following link to verify your email address:\n\n" + link + "\n\nThe link expires in 24 hours.\n",
+	})
+}
+
+// Verify redeems token and returns the user ID and email it was issued for.
+func (v *EmailVerifier) Verify(token string) (string, string, error) {
+	// GETDEL makes redeeming atomic: of two concurrent requests with the same
+	// token only one gets it.
+	value, err := v.rdb.GetDel(ctx, verificationKey(HashToken(token))).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return "", "", ErrInvalidVerificationToken
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	var verification emailVerification
+	if err := json.Unmarshal(value, &verification); err != nil {
+		return "", "", err
+	}
+	return verification.UserID, verification.Email, nil
+}
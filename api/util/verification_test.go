@@ -0,0 +1,75 @@
+package util
+
+import (
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func verificationTokenFrom(t *testing.T, msg Message) string {
+	start := strings.Index(msg.Body, "http")
+	link, err := url.Parse(strings.Fields(msg.Body[start:])[0])
+	assert.Nil(t, err)
+	return link.Query().Get("token")
+}
+
+func TestEmailVerifier(t *testing.T) {
+	mailer := NewMemoryMailer()
+	verifier := NewEmailVerifier(setupTestRedis(t), mailer, "http://localhost:8080")
+
+	assert.Nil(t, verifier.SendVerification("user-id", "test@test.com"))
+	messages := mailer.Messages()
+	assert.Len(t, messages, 1)
+	assert.Equal(t, "test@test.com", messages[0].To)
+	assert.Contains(t, messages[0].Body, "http://localhost:8080/verify-email?token=")
+
+	token := verificationTokenFrom(t, messages[0])
+	userID, email, err := verifier.Verify(token)
+	assert.Nil(t, err)
+	assert.Equal(t, "user-id", userID)
+	assert.Equal(t, "test@test.com", email)
+
+	// Links work only once
+	_, _, err = verifier.Verify(token)
+	assert.ErrorIs(t, err, ErrInvalidVerificationToken)
+
+	_, _, err = verifier.Verify("invalid")
+	assert.ErrorIs(t, err, ErrInvalidVerificationToken)
+
+	// A new link replaces the previous one
+	assert.Nil(t, verifier.SendVerification("user-id", "test@test.com"))
+	assert.Nil(t, verifier.SendVerification("user-id", "new@test.com"))
+	messages = mailer.Messages()
+	_, _, err = verifier.Verify(verificationTokenFrom(t, messages[1]))
+	assert.ErrorIs(t, err, ErrInvalidVerificationToken)
+	_, email, err = verifier.Verify(verificationTokenFrom(t, messages[2]))
+	assert.Nil(t, err)
+	assert.Equal(t, "new@test.com", email)
+}
+
+func TestEmailVerifierConcurrentSends(t *testing.T) {
+	mailer := NewMemoryMailer()
+	verifier := NewEmailVerifier(setupTestRedis(t), mailer, "http://localhost:8080")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Nil(t, verifier.SendVerification("user-id", "test@test.com"))
+		}()
+	}
+	wg.Wait()
+
+	// Only the last link stored works
+	verified := 0
+	for _, msg := range mailer.Messages() {
+		if _, _, err := verifier.Verify(verificationTokenFrom(t, msg)); err == nil {
+			verified++
+		}
+	}
+	assert.Equal(t, 1, verified)
+}
@@ -0,0 +1,63 @@
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// WebAuthnSessionTTL bounds how long a registration or login ceremony may
+// take between its two requests.
+const WebAuthnSessionTTL = 5 * time.Minute
+
+var ErrWebAuthnSessionNotFound = errors.New("Unknown or expired WebAuthn session")
+
+// WebAuthnSessionStore keeps the challenge of a WebAuthn ceremony in Redis
+// until the client answers it. Sessions can be loaded only once, so every
+// challenge is answered at most once.
+type WebAuthnSessionStore struct {
+	rdb *redis.Client
+}
+
+func NewWebAuthnSessionStore(rdb *redis.Client) *WebAuthnSessionStore {
+	return &WebAuthnSessionStore{rdb: rdb}
+}
+
+// Save stores session and returns the ID the client has to send back.
+func (s *WebAuthnSessionStore) Save(session *webauthn.SessionData) (string, error) {
+	id, err := RandomToken(16)
+	if err != nil {
+		return "", err
+	}
+	value, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+	if err := s.rdb.Set(ctx, webAuthnSessionKey(id), value, WebAuthnSessionTTL).Err(); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// Load returns the session stored under id and removes it.
+func (s *WebAuthnSessionStore) Load(id string) (*webauthn.SessionData, error) {
+	value, err := s.rdb.GetDel(ctx, webAuthnSessionKey(id)).Bytes()
+	if err == redis.Nil {
+		return nil, ErrWebAuthnSessionNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	var session webauthn.SessionData
+	if err := json.Unmarshal(value, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func webAuthnSessionKey(id string) string {
+	return "webauthn_session:" + id
+}
@@ -0,0 +1,28 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebAuthnSessionStore(t *testing.T) {
+	store := NewWebAuthnSessionStore(setupTestRedis(t))
+
+	id, err := store.Save(&webauthn.SessionData{Challenge: "challenge", UserID: []byte("user")})
+	assert.Nil(t, err)
+	assert.NotEmpty(t, id)
+
+	session, err := store.Load(id)
+	assert.Nil(t, err)
+	assert.Equal(t, "challenge", session.Challenge)
+	assert.Equal(t, []byte("user"), session.UserID)
+
+	// A challenge can only be answered once
+	_, err = store.Load(id)
+	assert.ErrorIs(t, err, ErrWebAuthnSessionNotFound)
+
+	_, err = store.Load("unknown")
+	assert.ErrorIs(t, err, ErrWebAuthnSessionNotFound)
+}